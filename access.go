@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geobeau/Libbot/config"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// membershipCacheDuration is how long the group membership of a user is
+// trusted before checking it again
+const membershipCacheDuration = 10 * time.Minute
+
+// access decides who can use the bot and with which role
+type access struct {
+	cfg   config.Access
+	store *storage.Store
+	bot   *tb.Bot
+	// group is the chat whose members are allowed in group mode
+	group *tb.Chat
+
+	mu      sync.Mutex
+	members map[int]membership
+}
+
+type membership struct {
+	member  bool
+	checked time.Time
+}
+
+// newAccess returns the access control of the bot, the group is resolved
+// in group mode
+func newAccess(cfg config.Access, store *storage.Store, bot *tb.Bot) (*access, error) {
+	a := &access{cfg: cfg, store: store, bot: bot, members: map[int]membership{}}
+	if cfg.Mode == "group" {
+		group, err := bot.ChatByID(cfg.Group)
+		if err != nil {
+			return nil, fmt.Errorf("access group %s: %v", cfg.Group, err)
+		}
+		a.group = group
+	}
+	return a, nil
+}
+
+// listed tells if a user is in a list of ids and usernames
+func listed(list []string, user *tb.User) bool {
+	for _, entry := range list {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), "@")
+		if entry == strconv.Itoa(user.ID) || (user.Username != "" && strings.EqualFold(entry, user.Username)) {
+			return true
+		}
+	}
+	return false
+}
+
+// role returns the role of a user: the highest of the configured one and
+// the one given by an admin or an invite
+func (a *access) role(user *tb.User) string {
+	role := storage.RoleUser
+	switch {
+	case listed(a.cfg.Admins, user):
+		role = storage.RoleAdmin
+	case listed(a.cfg.Trusted, user):
+		role = storage.RoleTrusted
+	}
+	if granted := a.store.Access(user.ID).Role; storage.RoleRank(granted) > storage.RoleRank(role) {
+		role = granted
+	}
+	return role
+}
+
+// allowed tells if a user can use the bot. Admins and invited users are
+// allowed whatever the mode, banned users never are
+func (a *access) allowed(ctx context.Context, user *tb.User) bool {
+	granted := a.store.Access(user.ID)
+	switch {
+	case a.role(user) == storage.RoleAdmin:
+		return true
+	case granted.Banned:
+		return false
+	case a.cfg.Mode == "open" || granted.Invited:
+		return true
+	}
+	switch a.cfg.Mode {
+	case "allowlist":
+		return listed(a.cfg.Allowlist, user)
+	case "group":
+		return a.member(ctx, user)
+	}
+	return false
+}
+
+// member checks if a user belongs to the access group
+func (a *access) member(ctx context.Context, user *tb.User) bool {
+	a.mu.Lock()
+	cached, ok := a.members[user.ID]
+	a.mu.Unlock()
+	if ok && time.Since(cached.checked) < membershipCacheDuration {
+		return cached.member
+	}
+	member := false
+	chatMember, err := a.bot.ChatMemberOf(a.group, user)
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to check group membership", logging.Err(err))
+	} else {
+		switch chatMember.Role {
+		case tb.Creator, tb.Administrator, tb.Member, tb.Restricted:
+			member = true
+		}
+	}
+	a.mu.Lock()
+	a.members[user.ID] = membership{member: member, checked: time.Now()}
+	a.mu.Unlock()
+	return member
+}
+
+// deniedMessage tells a user how to get access
+func (a *access) deniedMessage(user *tb.User) string {
+	if a.store.Access(user.ID).Banned {
+		return "You are banned from this bot"
+	}
+	switch a.cfg.Mode {
+	case "group":
+		return "This bot is reserved to the members of " + a.cfg.Group + ". You can also ask an admin for an invite code and send /start <code>"
+	default:
+		return "This bot is private, ask an admin for an invite code and send /start <code>"
+	}
+}
+
+// canConvert tells if a role can convert books
+func (a *access) canConvert(role string) bool {
+	return storage.RoleRank(role) >= storage.RoleRank(a.cfg.ConvertRole)
+}
+
+// maxFileSize returns the size limit of the files sent to a role
+func (a *access) maxFileSize(role string, limit int) int {
+	if a.cfg.LargeFileSize > 0 && a.cfg.LargeFileSize < limit &&
+		storage.RoleRank(role) < storage.RoleRank(a.cfg.LargeFileRole) {
+		return a.cfg.LargeFileSize
+	}
+	return limit
+}
+
+type roleKey struct{}
+
+// withRole returns a context carrying the role of the user of a request
+func withRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// roleOf returns the role of the user of a request
+func roleOf(ctx context.Context) string {
+	if role, ok := ctx.Value(roleKey{}).(string); ok {
+		return role
+	}
+	return storage.RoleUser
+}
+
+// handleMessage registers a handler only called for the users allowed to
+// use the bot
+func (a *app) handleMessage(endpoint string, handler func(ctx context.Context, m *tb.Message)) {
+	a.bot.Handle(endpoint, func(m *tb.Message) {
+		ctx := newRequest(m.Sender)
+		if !a.access.allowed(ctx, m.Sender) {
+			logger.InfoContext(ctx, "Access denied")
+			a.bot.Send(m.Sender, a.access.deniedMessage(m.Sender))
+			return
+		}
+		handler(withRole(ctx, a.access.role(m.Sender)), m)
+	})
+}
+
+// handleCallback registers a button handler only called for the users
+// allowed to use the bot
+func (a *app) handleCallback(button *tb.InlineButton, handler func(ctx context.Context, c *tb.Callback)) {
+	a.bot.Handle(button, func(c *tb.Callback) {
+		ctx := newRequest(c.Sender)
+		if !a.access.allowed(ctx, c.Sender) {
+			logger.InfoContext(ctx, "Access denied")
+			a.bot.Respond(c, &tb.CallbackResponse{Text: "Access denied"})
+			a.bot.Send(c.Sender, a.access.deniedMessage(c.Sender))
+			return
+		}
+		handler(withRole(ctx, a.access.role(c.Sender)), c)
+	})
+}
+
+// handleStart welcomes a user and redeems the invite code given with /start
+func (a *app) handleStart(m *tb.Message) {
+	ctx := newRequest(m.Sender)
+	code := strings.TrimSpace(m.Payload)
+	if code != "" {
+		invite, err := a.store.RedeemInvite(code, m.Sender.ID)
+		if err != nil {
+			logger.InfoContext(ctx, "Invite refused", logging.Err(err))
+			a.bot.Send(m.Sender, "This invite code is invalid or was already used")
+			return
+		}
+		logger.InfoContext(ctx, "Invite redeemed", "role", invite.Role)
+	}
+	if !a.access.allowed(ctx, m.Sender) {
+		a.bot.Send(m.Sender, a.access.deniedMessage(m.Sender))
+		return
+	}
+	a.bot.Send(m.Sender, "Welcome! Send me the title or the author of a book to search for it")
+}
+
+// adminOnly restricts a handler to the admins
+func (a *app) adminOnly(handler func(ctx context.Context, m *tb.Message)) func(ctx context.Context, m *tb.Message) {
+	return func(ctx context.Context, m *tb.Message) {
+		if roleOf(ctx) != storage.RoleAdmin {
+			a.bot.Send(m.Sender, "This command is reserved to admins")
+			return
+		}
+		handler(ctx, m)
+	}
+}
+
+// handleInvite creates an invite code, for admins: /invite [role]
+func (a *app) handleInvite(ctx context.Context, m *tb.Message) {
+	if roleOf(ctx) != storage.RoleAdmin {
+		a.bot.Send(m.Sender, "Only admins can create invite codes")
+		return
+	}
+	role := strings.TrimSpace(m.Payload)
+	if role == "" {
+		role = storage.RoleUser
+	}
+	invite, err := a.store.CreateInvite(m.Sender.ID, role)
+	if err != nil {
+		a.bot.Send(m.Sender, fmt.Sprintf("Failed to create the invite: %v", err))
+		return
+	}
+	logger.InfoContext(ctx, "Invite created", "role", role)
+	a.bot.Send(m.Sender, fmt.Sprintf("Invite code for a %s: %s\nIt can be used once with /start %s", role, invite.Code, invite.Code))
+}
+
+// handleRole changes the role of a user, for admins: /role <user id> <role>
+func (a *app) handleRole(ctx context.Context, m *tb.Message) {
+	if roleOf(ctx) != storage.RoleAdmin {
+		a.bot.Send(m.Sender, "Only admins can change roles")
+		return
+	}
+	args := strings.Fields(m.Payload)
+	if len(args) != 2 {
+		a.bot.Send(m.Sender, "Usage: /role <user id> <"+strings.Join(storage.Roles, "|")+">")
+		return
+	}
+	userID, err := strconv.Atoi(args[0])
+	if err != nil {
+		a.bot.Send(m.Sender, "Invalid user id "+args[0])
+		return
+	}
+	if err := a.store.SetRole(userID, args[1]); err != nil {
+		a.bot.Send(m.Sender, fmt.Sprintf("Failed to change the role: %v", err))
+		return
+	}
+	logger.InfoContext(ctx, "Role changed", logging.User(userID), "role", args[1])
+	a.bot.Send(m.Sender, fmt.Sprintf("User %d is now %s", userID, args[1]))
+}
+
+// handleBan bans or unbans a user, for admins: /ban <user id> and
+// /unban <user id>
+func (a *app) handleBan(banned bool) func(ctx context.Context, m *tb.Message) {
+	return func(ctx context.Context, m *tb.Message) {
+		command := "/unban"
+		if banned {
+			command = "/ban"
+		}
+		userID, err := strconv.Atoi(strings.TrimSpace(m.Payload))
+		if err != nil {
+			a.bot.Send(m.Sender, "Usage: "+command+" <user id>")
+			return
+		}
+		if banned && a.access.role(&tb.User{ID: userID}) == storage.RoleAdmin {
+			a.bot.Send(m.Sender, "Admins can't be banned")
+			return
+		}
+		if err := a.store.SetBanned(userID, banned); err != nil {
+			a.bot.Send(m.Sender, fmt.Sprintf("Failed to save the ban: %v", err))
+			return
+		}
+		logger.InfoContext(ctx, "Ban changed", logging.User(userID), "banned", banned)
+		if banned {
+			a.bot.Send(m.Sender, fmt.Sprintf("User %d is banned", userID))
+		} else {
+			a.bot.Send(m.Sender, fmt.Sprintf("User %d is not banned anymore", userID))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/config"
+	"github.com/geobeau/Libbot/epub"
+	"github.com/geobeau/Libbot/language"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/metadata"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/scraper"
+	"github.com/geobeau/Libbot/throttle"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// sourceError tells the pipeline when the source is unavailable
+func sourceError(err error) error {
+	if errors.Is(err, throttle.ErrOpen) {
+		return fmt.Errorf("%w: %v", pipeline.ErrUnavailable, err)
+	}
+	return err
+}
+
+// newMetadataProvider returns the cached Open Library provider, nil when it
+// is disabled
+func newMetadataProvider(cfg config.Metadata) metadata.Provider {
+	if cfg.URL == "" {
+		return nil
+	}
+	provider := metadata.OpenLibrary{
+		BaseURL:   cfg.URL,
+		CoversURL: cfg.CoversURL,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	return metadata.NewCache(provider, time.Duration(cfg.CacheTTL)*time.Second, cfg.CacheSize)
+}
+
+// scraperFetcher fetches books from the scraped website, their metadata is
+// completed by the metadata provider when there is one
+type scraperFetcher struct {
+	metadata metadata.Provider
+}
+
+func (f scraperFetcher) Fetch(ctx context.Context, id string) (book.Book, pipeline.Download, error) {
+	bookMetadata, err := scraper.FetchBookMetadata(ctx, id)
+	if err != nil {
+		return book.Book{}, pipeline.Download{}, sourceError(err)
+	}
+	bookMetadata = metadata.Enrich(ctx, f.metadata, bookMetadata)
+	bookResp, err := scraper.GetBookFile(ctx, bookMetadata.Format().URL)
+	if err != nil {
+		return bookMetadata, pipeline.Download{}, sourceError(err)
+	}
+	_, params, err := mime.ParseMediaType(bookResp.Header.Get("Content-Disposition"))
+	if err != nil {
+		bookResp.Body.Close()
+		return bookMetadata, pipeline.Download{}, err
+	}
+	if params["filename"] == "" {
+		bookResp.Body.Close()
+		return bookMetadata, pipeline.Download{}, errors.New("no file name in response")
+	}
+	return bookMetadata, pipeline.Download{Filename: params["filename"], Body: bookResp.Body}, nil
+}
+
+// epubRepairProcessor fixes the common defects of EPUB files which make the
+// conversion fail
+type epubRepairProcessor struct{}
+
+func (epubRepairProcessor) Process(ctx context.Context, bookMetadata book.Book, file pipeline.File) (pipeline.File, string, error) {
+	if strings.ToLower(filepath.Ext(file.Name)) != ".epub" {
+		return file, "not an epub", nil
+	}
+	if report := epub.Check(file.Content); report.Valid() {
+		return file, "valid epub", nil
+	}
+	content, report, err := epub.Repair(file.Content)
+	if err != nil {
+		return file, "", err
+	}
+	for _, problem := range report.Problems {
+		logger.WarnContext(ctx, "EPUB problem left after repair", "problem", problem.String())
+	}
+	if len(report.Repairs) == 0 {
+		return file, "nothing to repair", nil
+	}
+	file.Content = content
+	return file, strings.Join(report.Repairs, ", "), nil
+}
+
+// epubMetadataProcessor writes the book metadata and cover inside EPUB files
+type epubMetadataProcessor struct{}
+
+func (epubMetadataProcessor) Process(ctx context.Context, bookMetadata book.Book, file pipeline.File) (pipeline.File, string, error) {
+	if strings.ToLower(filepath.Ext(file.Name)) != ".epub" {
+		return file, "not an epub", nil
+	}
+	if bookMetadata.Language == "" {
+		bookMetadata.Language = detectLanguage(ctx, file.Content)
+	}
+	var cover *epub.Cover
+	if bookMetadata.CoverURL != "" {
+		content, mediaType, err := scraper.FetchCover(ctx, bookMetadata.CoverURL)
+		if err != nil {
+			logger.WarnContext(ctx, "Failed to fetch cover", logging.Err(err))
+		} else {
+			cover = &epub.Cover{Content: content, MediaType: mediaType}
+		}
+	}
+	content, err := epub.Rewrite(file.Content, epub.MetadataFromBook(bookMetadata), cover)
+	if err != nil {
+		return file, "", err
+	}
+	detail := "rewrote metadata"
+	if cover != nil {
+		detail += " and cover"
+	}
+	file.Content = content
+	return file, detail, nil
+}
+
+// detectedTextBytes is the length of the text of a book read to detect its
+// language
+const detectedTextBytes = 20000
+
+// detectLanguage guesses the language of an EPUB from its text, it returns
+// an empty code when it can't tell
+func detectLanguage(ctx context.Context, content []byte) string {
+	text, err := epub.Text(content, detectedTextBytes)
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to read book text", logging.Err(err))
+		return ""
+	}
+	l, ok := language.Detect(text)
+	if !ok {
+		return ""
+	}
+	logger.DebugContext(ctx, "Detected language", "language", l.ID())
+	return l.ID()
+}
+
+// telegramUploader sends files as documents to a telegram user
+type telegramUploader struct {
+	bot *tb.Bot
+	to  tb.Recipient
+}
+
+// Upload implements the pipeline uploader, the reference is the telegram file
+// id of the document, it can be sent again without uploading it
+func (u telegramUploader) Upload(ctx context.Context, file pipeline.File) (string, error) {
+	u.bot.Send(u.to, "Uploading to Telegram...")
+	telegramFile := tb.FromReader(bytes.NewReader(file.Content))
+	telegramFile.FileName = file.Name
+	bookFile := &tb.Document{File: telegramFile}
+	sent, err := bookFile.Send(u.bot, u.to, nil)
+	if err != nil {
+		return "", err
+	}
+	if sent.Document == nil {
+		return "", nil
+	}
+	return sent.Document.FileID, nil
+}
+
+// telegramNotifier sends progress messages to a telegram user
+type telegramNotifier struct {
+	bot *tb.Bot
+	to  tb.Recipient
+}
+
+func (n telegramNotifier) Notify(message string) {
+	n.bot.Send(n.to, message)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/metrics"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// telegramCheckInterval is how long the result of a Telegram check is reused,
+// the probes must not flood the API
+const telegramCheckInterval = 30 * time.Second
+
+// telegramCheck checks that the Telegram API can be reached
+type telegramCheck struct {
+	bot     *tb.Bot
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (c *telegramCheck) check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < telegramCheckInterval {
+		return c.err
+	}
+	c.checked = time.Now()
+	c.err = getMe(c.bot)
+	return c.err
+}
+
+// getMe calls the getMe method, which only checks the token
+func getMe(b *tb.Bot) error {
+	data, err := b.Raw("getMe", map[string]string{})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if !resp.Ok {
+		return errors.New(resp.Description)
+	}
+	return nil
+}
+
+// adminServer serves the metrics and the health checks for the probes
+type adminServer struct {
+	server *http.Server
+}
+
+func (a *app) newAdminServer(listen string) *adminServer {
+	telegram := &telegramCheck{bot: a.bot}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		problems := []string{}
+		if a.queue.Closed() {
+			problems = append(problems, "shutting down")
+		}
+		if err := telegram.check(); err != nil {
+			problems = append(problems, "telegram: "+err.Error())
+		}
+		if err := a.converter().Available(); err != nil {
+			problems = append(problems, "converter: "+err.Error())
+		}
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return &adminServer{server: &http.Server{Addr: listen, Handler: mux}}
+}
+
+// serve runs the HTTP listener until shutdown is called
+func (s *adminServer) serve() {
+	logger.Info("Admin server listening", "address", s.server.Addr)
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fatal("Admin server failed", err)
+	}
+}
+
+// shutdown stops the HTTP listener
+func (s *adminServer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		logger.Error("Failed to stop admin server", logging.Err(err))
+	}
+}
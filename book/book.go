@@ -1,16 +1,269 @@
 package book
 
-// Book contains book metadata
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/geobeau/Libbot/isbn"
+	"github.com/geobeau/Libbot/language"
+)
+
+// Schemes of the identifiers
+const (
+	ISBN = "isbn"
+)
+
+// Author is an author of a book
+type Author struct {
+	Name string `json:"name"`
+}
+
+// Identifier identifies a book in a scheme, like its ISBN
+type Identifier struct {
+	Scheme string `json:"scheme"`
+	Value  string `json:"value"`
+}
+
+// Series is the series a book belongs to, Index is its position in the
+// series, 0 when unknown
+type Series struct {
+	Name  string  `json:"name,omitempty"`
+	Index float64 `json:"index,omitempty"`
+}
+
+// String returns the series like "Discworld #3"
+func (s Series) String() string {
+	if s.Index == 0 {
+		return s.Name
+	}
+	return s.Name + " #" + strconv.FormatFloat(s.Index, 'f', -1, 64)
+}
+
+// Format is a file of a book. Size is in bytes and URL is where the file is
+// downloaded from, both are 0 or empty when unknown
+type Format struct {
+	Extension string `json:"extension"`
+	Size      int64  `json:"size,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// Book contains book metadata. Numbers are 0 when unknown. Language is the
+// ISO 639-1 code of the language, or its ISO 639-3 code when it has none,
+// unknown languages are kept in lower case
 type Book struct {
-	ID       string
-	Author   string
-	Title    string
-	Year     string
-	Checksum string
-	Format   string
-	Pages    string
-	Size     string
-	Language string
-	Isbn	 string
-	CoverURL string
-}
\ No newline at end of file
+	ID          string       `json:"id"`
+	Title       string       `json:"title"`
+	Authors     []Author     `json:"authors,omitempty"`
+	Year        int          `json:"year,omitempty"`
+	Language    string       `json:"language,omitempty"`
+	Pages       int          `json:"pages,omitempty"`
+	Publisher   string       `json:"publisher,omitempty"`
+	Series      Series       `json:"series"`
+	Identifiers []Identifier `json:"identifiers,omitempty"`
+	Formats     []Format     `json:"formats,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	CoverURL    string       `json:"cover_url,omitempty"`
+}
+
+// Author returns the names of the authors separated by commas
+func (b Book) Author() string {
+	names := make([]string, 0, len(b.Authors))
+	for _, author := range b.Authors {
+		names = append(names, author.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Format returns the first format of the book, the one downloaded
+func (b Book) Format() Format {
+	if len(b.Formats) == 0 {
+		return Format{}
+	}
+	return b.Formats[0]
+}
+
+// IdentifiersOf returns the values of the identifiers of a scheme
+func (b Book) IdentifiersOf(scheme string) []string {
+	values := []string{}
+	for _, identifier := range b.Identifiers {
+		if strings.EqualFold(identifier.Scheme, scheme) {
+			values = append(values, identifier.Value)
+		}
+	}
+	return values
+}
+
+// ISBNs returns the valid ISBNs of the book, each once
+func (b Book) ISBNs() []isbn.ISBN {
+	isbns := []isbn.ISBN{}
+	for _, value := range b.IdentifiersOf(ISBN) {
+		if i, err := isbn.Parse(value); err == nil {
+			isbns = append(isbns, i)
+		}
+	}
+	return isbn.Unique(isbns)
+}
+
+// ISBNIdentifiers returns the identifiers of the valid ISBNs listed in a
+// text, as ISBN-13
+func ISBNIdentifiers(text string) []Identifier {
+	identifiers := []Identifier{}
+	for _, i := range isbn.Normalize(text) {
+		identifiers = append(identifiers, Identifier{Scheme: ISBN, Value: i.ISBN13()})
+	}
+	return identifiers
+}
+
+// Authors splits a list of author names separated by commas, semicolons or
+// ampersands
+func Authors(names string) []Author {
+	authors := []Author{}
+	for _, name := range strings.FieldsFunc(names, func(r rune) bool { return r == ',' || r == ';' || r == '&' }) {
+		if name = strings.TrimSpace(name); name != "" {
+			authors = append(authors, Author{Name: name})
+		}
+	}
+	return authors
+}
+
+// ParseYear reads a year printed by a source, 0 when it isn't one
+func ParseYear(text string) int {
+	year, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || year < 0 {
+		return 0
+	}
+	return year
+}
+
+// ParsePages reads a page count like "352" or "352 pages", 0 when there is
+// none
+func ParsePages(text string) int {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return 0
+	}
+	pages, err := strconv.Atoi(fields[0])
+	if err != nil || pages < 0 {
+		return 0
+	}
+	return pages
+}
+
+// units are the multiples of the byte printed by the sources
+var units = map[string]int64{
+	"B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30,
+	"KIB": 1 << 10, "MIB": 1 << 20, "GIB": 1 << 30,
+}
+
+// ParseSize reads a size like "1.2 MB", "1,2 MB" or "1,234.5 KB" in bytes, 0
+// when it isn't one
+func ParseSize(text string) int64 {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	i := strings.IndexFunc(text, func(r rune) bool { return (r < '0' || r > '9') && r != '.' && r != ',' })
+	if i < 0 {
+		i = len(text)
+	}
+	number, err := strconv.ParseFloat(decimalPoint(text[:i]), 64)
+	if err != nil || number < 0 {
+		return 0
+	}
+	unit := strings.TrimSpace(text[i:])
+	if unit == "" {
+		unit = "B"
+	}
+	multiple, ok := units[unit]
+	if !ok {
+		return 0
+	}
+	return int64(number * float64(multiple))
+}
+
+// decimalPoint returns a number with its commas as a decimal point when they
+// are one, like in "1,2", and without them when they separate thousands, like
+// in "1,234.5" or "1,234"
+func decimalPoint(number string) string {
+	comma := strings.IndexByte(number, ',')
+	if comma < 0 {
+		return number
+	}
+	if strings.Count(number, ",") > 1 || strings.Contains(number, ".") || len(number)-comma-1 == 3 {
+		return strings.Replace(number, ",", "", -1)
+	}
+	return strings.Replace(number, ",", ".", 1)
+}
+
+// FormatSize prints a size in bytes like "1.2 MB"
+func FormatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%d KB", size>>10)
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+// legacyBook is a book saved before the metadata was typed, every field was
+// a string
+type legacyBook struct {
+	ID          string
+	Author      string
+	Title       string
+	Year        string
+	Checksum    string
+	Format      string
+	Pages       string
+	Size        string
+	Language    string
+	Isbn        string
+	CoverURL    string
+	Description string
+	Subjects    []string
+	Series      string
+	Publisher   string
+}
+
+// UnmarshalJSON reads the books saved by the storage, including the ones
+// saved before the metadata was typed: their string year can't be decoded
+// as a number
+func (b *Book) UnmarshalJSON(data []byte) error {
+	type plain Book
+	var typed plain
+	err := json.Unmarshal(data, &typed)
+	if err == nil {
+		*b = Book(typed)
+		return nil
+	}
+	if _, ok := err.(*json.UnmarshalTypeError); !ok {
+		return err
+	}
+	var legacy legacyBook
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	*b = Book{
+		ID:          legacy.ID,
+		Title:       legacy.Title,
+		Authors:     Authors(legacy.Author),
+		Year:        ParseYear(legacy.Year),
+		Language:    language.Normalize(legacy.Language),
+		Pages:       ParsePages(legacy.Pages),
+		Publisher:   legacy.Publisher,
+		Series:      Series{Name: legacy.Series},
+		Description: legacy.Description,
+		Tags:        legacy.Subjects,
+		CoverURL:    legacy.CoverURL,
+	}
+	if identifiers := ISBNIdentifiers(legacy.Isbn); len(identifiers) > 0 {
+		b.Identifiers = identifiers
+	}
+	if legacy.Format != "" || legacy.Checksum != "" {
+		b.Formats = []Format{{Extension: legacy.Format, Size: ParseSize(legacy.Size), URL: legacy.Checksum}}
+	}
+	return nil
+}
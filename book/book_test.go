@@ -0,0 +1,122 @@
+package book
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		text string
+		want int64
+	}{
+		{"512", 512},
+		{"512 B", 512},
+		{"1.5 KB", 1536},
+		{"1,5 KB", 1536},
+		{"2 mb", 2 << 20},
+		{"1 GiB", 1 << 30},
+		{" 3MB ", 3 << 20},
+		{"1,234 KB", 1234 << 10},
+		{"1,234.5 KB", 1264128},
+		{"1,234,567 B", 1234567},
+		{"", 0},
+		{"big", 0},
+		{"1.2.3 MB", 0},
+		{"12 TB", 0},
+		{"-1 MB", 0},
+	}
+	for _, tt := range tests {
+		if got := ParseSize(tt.text); got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseYear(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"1990", 1990},
+		{" 2004 ", 2004},
+		{"", 0},
+		{"unknown", 0},
+		{"1990-05-01", 0},
+		{"-300", 0},
+	}
+	for _, tt := range tests {
+		if got := ParseYear(tt.text); got != tt.want {
+			t.Errorf("ParseYear(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalLegacy(t *testing.T) {
+	// a book as the storage saved it before the metadata was typed
+	stored := `{
+		"ID": "42",
+		"Author": "Terry Pratchett & Neil Gaiman",
+		"Title": "Good Omens",
+		"Year": "1990",
+		"Checksum": "https://example.com/get/42",
+		"Format": "epub",
+		"Pages": "412 pages",
+		"Size": "1,234.5 KB",
+		"Language": "English",
+		"Isbn": "0441013597",
+		"CoverURL": "https://example.com/covers/42.jpg",
+		"Description": "The world ends on a Saturday.",
+		"Subjects": ["fantasy", "humor"],
+		"Series": "",
+		"Publisher": "Gollancz"
+	}`
+	want := Book{
+		ID:          "42",
+		Title:       "Good Omens",
+		Authors:     []Author{{Name: "Terry Pratchett"}, {Name: "Neil Gaiman"}},
+		Year:        1990,
+		Language:    "en",
+		Pages:       412,
+		Publisher:   "Gollancz",
+		Identifiers: []Identifier{{Scheme: ISBN, Value: "9780441013593"}},
+		Formats:     []Format{{Extension: "epub", Size: 1264128, URL: "https://example.com/get/42"}},
+		Description: "The world ends on a Saturday.",
+		Tags:        []string{"fantasy", "humor"},
+		CoverURL:    "https://example.com/covers/42.jpg",
+	}
+	var got Book
+	if err := json.Unmarshal([]byte(stored), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() =\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+func TestUnmarshalTyped(t *testing.T) {
+	want := Book{
+		ID:      "42",
+		Title:   "Good Omens",
+		Authors: []Author{{Name: "Terry Pratchett"}},
+		Year:    1990,
+		Series:  Series{Name: "Discworld", Index: 3},
+		Formats: []Format{{Extension: "epub", Size: 2048}},
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Book
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() = %+v, want %+v", got, want)
+	}
+
+	if err := json.Unmarshal([]byte(`{"id": "42",`), &got); err == nil {
+		t.Error("Unmarshal() of a truncated book succeeded")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// broadcastInterval spaces the messages of a broadcast, Telegram refuses more
+// than 30 messages per second
+const broadcastInterval = 50 * time.Millisecond
+
+// handleBroadcast sends an announcement to every known user who isn't
+// banned nor forgotten, for admins: /broadcast <message>. A shutdown stops
+// the broadcast, how far it got is logged
+func (a *app) handleBroadcast(ctx context.Context, m *tb.Message) {
+	message := strings.TrimSpace(m.Payload)
+	if message == "" {
+		a.bot.Send(m.Sender, "Usage: /broadcast <message>")
+		return
+	}
+	recipients := a.store.Recipients()
+	// the broadcast outlives the request but not the bot
+	ctx = logging.WithRequestID(a.stopping, logging.RequestID(ctx))
+	started := a.goBackground(func() {
+		logger.InfoContext(ctx, "Broadcasting", "recipients", len(recipients))
+		a.bot.Send(m.Sender, fmt.Sprintf("Sending to %d users...", len(recipients)))
+		ticker := time.NewTicker(broadcastInterval)
+		defer ticker.Stop()
+		failed := 0
+		for i, id := range recipients {
+			select {
+			case <-ctx.Done():
+				logger.WarnContext(ctx, "Broadcast interrupted", "sent", i-failed, "failed", failed, "left", len(recipients)-i)
+				return
+			case <-ticker.C:
+			}
+			// users who blocked the bot make the sending fail
+			if _, err := a.bot.Send(&tb.User{ID: id}, message); err != nil {
+				logger.DebugContext(ctx, "Failed to broadcast", logging.User(id), logging.Err(err))
+				failed++
+			}
+		}
+		logger.InfoContext(ctx, "Broadcast sent", "recipients", len(recipients), "failed", failed)
+		a.bot.Send(m.Sender, fmt.Sprintf("Broadcast sent to %d users, %d failed", len(recipients)-failed, failed))
+	})
+	if !started {
+		a.bot.Send(m.Sender, "The bot is stopping, try again later")
+	}
+}
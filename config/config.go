@@ -0,0 +1,495 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/quota"
+)
+
+// Config is the configuration of the bot. Values are read in this order,
+// each source overriding the previous one: defaults, configuration file,
+// environment variables and command line flags
+type Config struct {
+	Token           string `toml:"token" env:"BOT_TOKEN" secret:"true" help:"telegram bot token given by botfather"`
+	StoragePath     string `toml:"storage_path" env:"STORAGE_PATH" help:"file storing the user data and the jobs, on a persistent volume in a container"`
+	Workers         int    `toml:"workers" env:"WORKERS" help:"number of downloads and conversions running at the same time"`
+	ResultsLimit    int    `toml:"results_limit" env:"RESULTS_LIMIT" help:"maximum number of search results sent"`
+	MaxFileSize     int    `toml:"max_file_size" env:"MAX_FILE_SIZE" help:"maximum size of a delivered file in bytes"`
+	ShutdownTimeout int    `toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" help:"seconds to wait for running jobs on shutdown"`
+
+	Source    Source    `toml:"source"`
+	Converter Converter `toml:"converter"`
+	Poller    Poller    `toml:"poller"`
+	SMTP      SMTP      `toml:"smtp"`
+	Library   Library   `toml:"library"`
+	Admin     Admin     `toml:"admin"`
+	Log       Log       `toml:"log"`
+	Access    Access    `toml:"access"`
+	Limits    Limits    `toml:"limits"`
+	Follow    Follow    `toml:"follow"`
+	Metadata  Metadata  `toml:"metadata"`
+}
+
+// Source configures the website books are fetched from
+type Source struct {
+	URL             string `toml:"url" env:"SOURCE_URL" help:"base URL of the book source"`
+	RateLimit       string `toml:"rate_limit" env:"SOURCE_RATE_LIMIT" help:"requests to a source like 5/1s for 5 at once then one every second, empty to disable"`
+	BreakerFailures int    `toml:"breaker_failures" env:"SOURCE_BREAKER_FAILURES" help:"consecutive failures making a source unavailable, 0 to disable"`
+	BreakerCooldown int    `toml:"breaker_cooldown" env:"SOURCE_BREAKER_COOLDOWN" help:"seconds before an unavailable source is tried again"`
+}
+
+// Converter configures calibre
+type Converter struct {
+	Binary  string `toml:"binary" env:"CONVERTER_BINARY" help:"path of the ebook-convert binary"`
+	TempDir string `toml:"temp_dir" env:"TEMP_DIR" help:"directory of the conversion temporary files"`
+}
+
+// Poller selects how updates are received
+type Poller struct {
+	Mode    string  `toml:"mode" env:"POLLER" help:"longpoll or webhook"`
+	Webhook Webhook `toml:"webhook"`
+}
+
+// Admin configures the HTTP server exposing the metrics and health checks
+type Admin struct {
+	Listen string `toml:"listen" env:"ADMIN_LISTEN" help:"address of the metrics and health server, empty to disable"`
+}
+
+// Access configures who can use the bot and what they can do
+type Access struct {
+	Mode          string   `toml:"mode" env:"ACCESS_MODE" help:"open, allowlist, group or invite"`
+	Allowlist     []string `toml:"allowlist" env:"ACCESS_ALLOWLIST" help:"user ids or usernames allowed in allowlist mode"`
+	Group         string   `toml:"group" env:"ACCESS_GROUP" help:"id or @username of the group or channel whose members are allowed in group mode"`
+	Admins        []string `toml:"admins" env:"ACCESS_ADMINS" help:"user ids or usernames of the admins"`
+	Trusted       []string `toml:"trusted" env:"ACCESS_TRUSTED" help:"user ids or usernames of the trusted users"`
+	ConvertRole   string   `toml:"convert_role" env:"ACCESS_CONVERT_ROLE" help:"role needed to convert books"`
+	LargeFileSize int      `toml:"large_file_size" env:"ACCESS_LARGE_FILE_SIZE" help:"size in bytes above which files need large_file_role, 0 to disable"`
+	LargeFileRole string   `toml:"large_file_role" env:"ACCESS_LARGE_FILE_ROLE" help:"role needed to download large files"`
+}
+
+// Limits configures how much each user can search, download and convert.
+// Admins have no rate limit
+type Limits struct {
+	Rates   []string `toml:"rates" env:"LIMITS_RATES" help:"rate limits by action, like search=5/10s for 5 at once then one every 10 seconds"`
+	User    []string `toml:"user" env:"LIMITS_USER" help:"daily quotas of the users by action, like download=20"`
+	Trusted []string `toml:"trusted" env:"LIMITS_TRUSTED" help:"daily quotas of the trusted users by action"`
+	Admin   []string `toml:"admin" env:"LIMITS_ADMIN" help:"daily quotas of the admins by action"`
+}
+
+// Quotas returns the daily quotas by role
+func (l Limits) Quotas() map[string][]string {
+	return map[string][]string{"user": l.User, "trusted": l.Trusted, "admin": l.Admin}
+}
+
+// Follow configures the searches of the authors and series followed by the
+// users
+type Follow struct {
+	Interval      int `toml:"interval" env:"FOLLOW_INTERVAL" help:"seconds between the searches of the followed authors and series, 0 to disable"`
+	Notifications int `toml:"notifications" env:"FOLLOW_NOTIFICATIONS" help:"maximum new release notifications per user and day"`
+}
+
+// Metadata configures the provider completing the metadata of the books, it
+// is disabled without URL
+type Metadata struct {
+	URL       string `toml:"url" env:"METADATA_URL" help:"base URL of the Open Library API like https://openlibrary.org, empty to disable"`
+	CoversURL string `toml:"covers_url" env:"METADATA_COVERS_URL" help:"base URL of the Open Library covers"`
+	CacheTTL  int    `toml:"cache_ttl" env:"METADATA_CACHE_TTL" help:"seconds the metadata of a book is cached"`
+	CacheSize int    `toml:"cache_size" env:"METADATA_CACHE_SIZE" help:"maximum number of books in the metadata cache"`
+}
+
+// Log configures the logs
+type Log struct {
+	Format   string   `toml:"format" env:"LOG_FORMAT" help:"logfmt or json"`
+	Level    string   `toml:"level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+	Packages []string `toml:"packages" env:"LOG_PACKAGES" help:"levels by package, like scraper=debug"`
+	PII      bool     `toml:"pii" env:"LOG_PII" help:"log user ids, names and search queries"`
+	HashKey  string   `toml:"hash_key" env:"LOG_HASH_KEY" secret:"true" help:"key of the user id hashes, random when empty"`
+}
+
+// webhookSecret matches the secret tokens accepted by telegram
+var webhookSecret = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// Webhook configures the webhook poller
+type Webhook struct {
+	Listen     string `toml:"listen" env:"WEBHOOK_LISTEN" help:"address of the webhook listener"`
+	PublicURL  string `toml:"public_url" env:"WEBHOOK_PUBLIC_URL" help:"public https URL reaching the listener"`
+	TLSCert    string `toml:"tls_cert" env:"WEBHOOK_TLS_CERT" help:"TLS certificate of the listener"`
+	TLSKey     string `toml:"tls_key" env:"WEBHOOK_TLS_KEY" help:"TLS key of the listener"`
+	SelfSigned bool   `toml:"self_signed" env:"WEBHOOK_SELF_SIGNED" help:"upload the certificate to telegram"`
+	Secret     string `toml:"secret" env:"WEBHOOK_SECRET" secret:"true" help:"token checked on the updates and added to the webhook path"`
+}
+
+// SMTP configures the email delivery, it is disabled without host
+type SMTP struct {
+	Host              string   `toml:"host" env:"SMTP_HOST" help:"SMTP server, enables send to Kindle"`
+	Port              int      `toml:"port" env:"SMTP_PORT" help:"SMTP port"`
+	Username          string   `toml:"username" env:"SMTP_USERNAME" help:"SMTP username"`
+	Password          string   `toml:"password" env:"SMTP_PASSWORD" secret:"true" help:"SMTP password"`
+	From              string   `toml:"from" env:"SMTP_FROM" help:"sender address"`
+	AllowedDomains    []string `toml:"allowed_domains" env:"SMTP_ALLOWED_DOMAINS" help:"domains accepted as delivery addresses"`
+	MaxAttachmentSize int      `toml:"max_attachment_size" env:"SMTP_MAX_ATTACHMENT_SIZE" help:"maximum attachment size in bytes"`
+}
+
+// Library configures the library delivery, it is disabled without WebDAV
+// URL nor directory
+type Library struct {
+	WebDAVURL      string `toml:"webdav_url" env:"LIBRARY_WEBDAV_URL" help:"WebDAV server receiving the books"`
+	WebDAVUsername string `toml:"webdav_username" env:"LIBRARY_WEBDAV_USERNAME" help:"WebDAV username"`
+	WebDAVPassword string `toml:"webdav_password" env:"LIBRARY_WEBDAV_PASSWORD" secret:"true" help:"WebDAV password"`
+	Dir            string `toml:"dir" env:"LIBRARY_DIR" help:"local directory receiving the books"`
+	Template       string `toml:"template" env:"LIBRARY_TEMPLATE" help:"path of the books in the library"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		StoragePath:     "libbot.json",
+		Workers:         2,
+		ShutdownTimeout: 60,
+		ResultsLimit:    10,
+		MaxFileSize:     50 << 20,
+		Source:          Source{URL: "https://1lib.education", RateLimit: "5/1s", BreakerFailures: 5, BreakerCooldown: 60},
+		Converter:       Converter{Binary: "ebook-convert", TempDir: os.TempDir()},
+		Poller:          Poller{Mode: "longpoll", Webhook: Webhook{Listen: ":8443"}},
+		SMTP: SMTP{
+			Port:              587,
+			AllowedDomains:    []string{"kindle.com", "free.kindle.com"},
+			MaxAttachmentSize: 50 << 20,
+		},
+		Library: Library{Template: "{{.Author}}/{{.Filename}}"},
+		Log:     Log{Format: logging.FormatLogfmt, Level: "info"},
+		Access:  Access{Mode: "open", ConvertRole: "user", LargeFileRole: "trusted"},
+		Limits: Limits{
+			Rates:   []string{"search=5/10s", "download=3/1m", "convert=2/2m"},
+			User:    []string{"search=200", "download=20", "convert=10"},
+			Trusted: []string{"search=500", "download=100", "convert=50"},
+		},
+		Follow: Follow{Notifications: 5},
+		Metadata: Metadata{
+			CoversURL: "https://covers.openlibrary.org",
+			CacheTTL:  24 * 60 * 60,
+			CacheSize: 1000,
+		},
+	}
+}
+
+// field is a configuration value along with the ways to set it
+type field struct {
+	key    string
+	env    string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+// flagName returns the command line flag of a field
+func (f field) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.key)
+}
+
+// fields lists the values of a configuration
+func fields(cfg *Config) []field {
+	list := []field{}
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			structField := t.Field(i)
+			key := prefix + structField.Tag.Get("toml")
+			if structField.Type.Kind() == reflect.Struct {
+				walk(key+".", v.Field(i))
+				continue
+			}
+			list = append(list, field{
+				key:    key,
+				env:    structField.Tag.Get("env"),
+				help:   structField.Tag.Get("help"),
+				secret: structField.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return list
+}
+
+// set converts a string to the type of a field
+func (f field) set(value string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", f.key, value)
+		}
+		f.value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", f.key, value)
+		}
+		f.value.SetBool(b)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("%s: unsupported type %s", f.key, f.value.Kind())
+	}
+	return nil
+}
+
+// setFromFile reads a secret from a file, as mounted by kubernetes secrets
+func (f field) setFromFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.key, err)
+	}
+	return f.set(strings.TrimRight(string(content), "\r\n"))
+}
+
+// Load reads the configuration from the file given by -config (or the
+// LIBBOT_CONFIG env variable), the environment and the command line
+// arguments. Secrets can also be read from files with the "_file" suffix
+// (like token_file, BOT_TOKEN_FILE or -token-file)
+func Load(args []string, getenv func(string) string, output io.Writer) (*Config, error) {
+	cfg := Default()
+	list := fields(cfg)
+
+	flags := flag.NewFlagSet("libbot", flag.ContinueOnError)
+	flags.SetOutput(output)
+	configPath := flags.String("config", getenv("LIBBOT_CONFIG"), "configuration file (TOML)")
+	flagValues := map[string]*string{}
+	for _, f := range list {
+		flagValues[f.flagName()] = flags.String(f.flagName(), "", f.help+" (env "+f.env+")")
+		if f.secret {
+			flagValues[f.flagName()+"-file"] = flags.String(f.flagName()+"-file", "", "file containing the "+f.help)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(list, *configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range list {
+		if f.secret {
+			if path := getenv(f.env + "_FILE"); path != "" {
+				if err := f.setFromFile(path); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if value := getenv(f.env); value != "" {
+			if err := f.set(value); err != nil {
+				return nil, fmt.Errorf("env %s: %v", f.env, err)
+			}
+		}
+	}
+
+	visited := map[string]bool{}
+	flags.Visit(func(fl *flag.Flag) { visited[fl.Name] = true })
+	for _, f := range list {
+		name := f.flagName()
+		if f.secret && visited[name+"-file"] {
+			if err := f.setFromFile(*flagValues[name+"-file"]); err != nil {
+				return nil, err
+			}
+		}
+		if visited[name] {
+			if err := f.set(*flagValues[name]); err != nil {
+				return nil, fmt.Errorf("flag -%s: %v", name, err)
+			}
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// loadFile applies the values of a configuration file
+func (cfg *Config) loadFile(list []field, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseTOML(content)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	byKey := map[string]field{}
+	for _, f := range list {
+		byKey[f.key] = f
+	}
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := values[key]
+		f, ok := byKey[key]
+		fromFile := false
+		if !ok && strings.HasSuffix(key, "_file") {
+			f, ok = byKey[strings.TrimSuffix(key, "_file")]
+			fromFile = ok && f.secret
+			ok = fromFile
+		}
+		if !ok {
+			return fmt.Errorf("%s: unknown key %s", path, key)
+		}
+		if items, isArray := value.([]string); isArray {
+			if f.value.Kind() != reflect.Slice {
+				return fmt.Errorf("%s: %s is not a list", path, key)
+			}
+			f.value.Set(reflect.ValueOf(items))
+			continue
+		}
+		if f.value.Kind() == reflect.Slice {
+			return fmt.Errorf("%s: %s must be a list", path, key)
+		}
+		if fromFile {
+			err = f.setFromFile(value.(string))
+		} else {
+			err = f.set(value.(string))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the consistency of the configuration
+func (cfg *Config) Validate() error {
+	problems := []string{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(cfg.Token != "", "token is not set (BOT_TOKEN, token or token_file)")
+	check(cfg.Workers > 0, "workers must be positive")
+	check(cfg.ShutdownTimeout >= 0, "shutdown_timeout must not be negative")
+	check(cfg.ResultsLimit > 0, "results_limit must be positive")
+	check(cfg.MaxFileSize > 0, "max_file_size must be positive")
+	check(strings.HasPrefix(cfg.Source.URL, "http://") || strings.HasPrefix(cfg.Source.URL, "https://"),
+		"source.url must be an http(s) URL")
+	if cfg.Source.RateLimit != "" {
+		if _, err := quota.ParseRate(cfg.Source.RateLimit); err != nil {
+			problems = append(problems, "source.rate_limit: "+err.Error())
+		}
+	}
+	check(cfg.Source.BreakerFailures >= 0, "source.breaker_failures must not be negative")
+	check(cfg.Source.BreakerCooldown > 0, "source.breaker_cooldown must be positive")
+	check(cfg.Converter.Binary != "", "converter.binary is not set")
+	if info, err := os.Stat(cfg.Converter.TempDir); err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("converter.temp_dir %q is not a directory", cfg.Converter.TempDir))
+	}
+
+	switch cfg.Poller.Mode {
+	case "longpoll":
+	case "webhook":
+		webhook := cfg.Poller.Webhook
+		check(strings.HasPrefix(webhook.PublicURL, "https://"), "poller.webhook.public_url must start with https://")
+		check((webhook.TLSCert == "") == (webhook.TLSKey == ""), "poller.webhook needs both tls_cert and tls_key")
+		check(!webhook.SelfSigned || webhook.TLSCert != "", "a self signed poller.webhook needs tls_cert")
+		check(webhookSecret.MatchString(webhook.Secret), "poller.webhook.secret must be 1 to 256 letters, digits, _ or -")
+	default:
+		problems = append(problems, fmt.Sprintf("poller.mode %q must be longpoll or webhook", cfg.Poller.Mode))
+	}
+
+	if cfg.SMTP.Host != "" {
+		check(cfg.SMTP.Port > 0 && cfg.SMTP.Port < 65536, "smtp.port is invalid")
+		check(strings.Contains(cfg.SMTP.From, "@"), "smtp.from must be an email address")
+		check(cfg.SMTP.MaxAttachmentSize > 0, "smtp.max_attachment_size must be positive")
+	}
+	if cfg.Library.WebDAVURL != "" {
+		check(strings.HasPrefix(cfg.Library.WebDAVURL, "http://") || strings.HasPrefix(cfg.Library.WebDAVURL, "https://"),
+			"library.webdav_url must be an http(s) URL")
+	}
+
+	check(cfg.Log.Format == logging.FormatLogfmt || cfg.Log.Format == logging.FormatJSON,
+		"log.format %q must be logfmt or json", cfg.Log.Format)
+	if _, err := logging.ParseLevel(cfg.Log.Level); err != nil {
+		problems = append(problems, "log.level: "+err.Error())
+	}
+	if _, err := logging.ParsePackageLevels(cfg.Log.Packages); err != nil {
+		problems = append(problems, "log.packages: "+err.Error())
+	}
+
+	switch cfg.Access.Mode {
+	case "open", "invite":
+	case "allowlist":
+		check(len(cfg.Access.Allowlist) > 0, "access.allowlist is empty")
+	case "group":
+		check(cfg.Access.Group != "", "access.group is not set")
+	default:
+		problems = append(problems, fmt.Sprintf("access.mode %q must be open, allowlist, group or invite", cfg.Access.Mode))
+	}
+	check(validRole(cfg.Access.ConvertRole), "access.convert_role %q must be user, trusted or admin", cfg.Access.ConvertRole)
+	check(validRole(cfg.Access.LargeFileRole), "access.large_file_role %q must be user, trusted or admin", cfg.Access.LargeFileRole)
+	check(cfg.Access.LargeFileSize >= 0, "access.large_file_size must not be negative")
+
+	if _, err := quota.ParseRates(cfg.Limits.Rates); err != nil {
+		problems = append(problems, "limits.rates: "+err.Error())
+	}
+	for role, quotas := range cfg.Limits.Quotas() {
+		if _, err := quota.ParseQuotas(quotas); err != nil {
+			problems = append(problems, "limits."+role+": "+err.Error())
+		}
+	}
+
+	check(cfg.Follow.Interval >= 0, "follow.interval must not be negative")
+	check(cfg.Follow.Notifications >= 0, "follow.notifications must not be negative")
+
+	if cfg.Metadata.URL != "" {
+		check(strings.HasPrefix(cfg.Metadata.URL, "http://") || strings.HasPrefix(cfg.Metadata.URL, "https://"),
+			"metadata.url must be an http(s) URL")
+		check(strings.HasPrefix(cfg.Metadata.CoversURL, "http://") || strings.HasPrefix(cfg.Metadata.CoversURL, "https://"),
+			"metadata.covers_url must be an http(s) URL")
+		check(cfg.Metadata.CacheTTL >= 0, "metadata.cache_ttl must not be negative")
+		check(cfg.Metadata.CacheSize >= 0, "metadata.cache_size must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Print writes the configuration, secrets are masked
+func (cfg *Config) Print(output io.Writer) {
+	for _, f := range fields(cfg) {
+		value := fmt.Sprint(f.value.Interface())
+		if f.secret && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(output, "%s = %s\n", f.key, value)
+	}
+}
+
+func validRole(role string) bool {
+	return role == "user" || role == "trusted" || role == "admin"
+}
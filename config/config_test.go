@@ -0,0 +1,333 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// env returns a getenv function reading a map
+func env(values map[string]string) func(string) string {
+	return func(key string) string {
+		return values[key]
+	}
+}
+
+// tempFiles writes files in a temporary directory and returns their paths
+// by name, the directory is removed at the end of the test
+func tempFiles(t *testing.T, files map[string]string) map[string]string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "libbot-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	paths := map[string]string{}
+	for name, content := range files {
+		paths[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(paths[name], []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil, env(map[string]string{"BOT_TOKEN": "t"}), ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.Token = "t"
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("Load() = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	paths := tempFiles(t, map[string]string{"libbot.toml": `
+token = "file token"
+workers = 3
+results_limit = 5
+
+[access]
+admins = ["alice", "bob"]
+
+[poller.webhook]
+listen = ":9443"
+`})
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		check func(cfg *Config) interface{}
+		want  interface{}
+	}{
+		{
+			name: "file",
+			args: []string{"-config", paths["libbot.toml"]},
+			check: func(cfg *Config) interface{} {
+				return []interface{}{cfg.Token, cfg.Workers, cfg.Access.Admins, cfg.Poller.Webhook.Listen}
+			},
+			want: []interface{}{"file token", 3, []string{"alice", "bob"}, ":9443"},
+		},
+		{
+			name:  "file from env",
+			env:   map[string]string{"LIBBOT_CONFIG": paths["libbot.toml"]},
+			check: func(cfg *Config) interface{} { return cfg.Workers },
+			want:  3,
+		},
+		{
+			name: "env overrides file",
+			args: []string{"-config", paths["libbot.toml"]},
+			env:  map[string]string{"WORKERS": "4", "ACCESS_ADMINS": "carol, dave,", "WEBHOOK_LISTEN": ":7443"},
+			check: func(cfg *Config) interface{} {
+				return []interface{}{cfg.Workers, cfg.ResultsLimit, cfg.Access.Admins, cfg.Poller.Webhook.Listen}
+			},
+			want: []interface{}{4, 5, []string{"carol", "dave"}, ":7443"},
+		},
+		{
+			name: "flags override env",
+			args: []string{"-config", paths["libbot.toml"], "-workers", "6", "-access-admins", "erin", "-poller-webhook-listen", ":6443"},
+			env:  map[string]string{"WORKERS": "4", "ACCESS_ADMINS": "carol"},
+			check: func(cfg *Config) interface{} {
+				return []interface{}{cfg.Workers, cfg.ResultsLimit, cfg.Access.Admins, cfg.Poller.Webhook.Listen}
+			},
+			want: []interface{}{6, 5, []string{"erin"}, ":6443"},
+		},
+		{
+			name:  "empty env is ignored",
+			args:  []string{"-config", paths["libbot.toml"]},
+			env:   map[string]string{"WORKERS": ""},
+			check: func(cfg *Config) interface{} { return cfg.Workers },
+			want:  3,
+		},
+		{
+			name:  "boolean flag",
+			args:  []string{"-log-pii", "true"},
+			env:   map[string]string{"BOT_TOKEN": "t"},
+			check: func(cfg *Config) interface{} { return cfg.Log.PII },
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Load(tt.args, env(tt.env), ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.check(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	paths := tempFiles(t, map[string]string{
+		"file_token":  "from token_file\n",
+		"env_token":   "from BOT_TOKEN_FILE\r\n",
+		"flag_token":  "from -token-file",
+		"smtp":        "smtp password",
+		"config.toml": "",
+	})
+	config := func(content string) string {
+		if err := ioutil.WriteFile(paths["config.toml"], []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return paths["config.toml"]
+	}
+	tests := []struct {
+		name string
+		file string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "token_file",
+			file: `token_file = "` + paths["file_token"] + `"`,
+			want: "from token_file",
+		},
+		{
+			name: "BOT_TOKEN_FILE overrides token_file",
+			file: `token_file = "` + paths["file_token"] + `"`,
+			env:  map[string]string{"BOT_TOKEN_FILE": paths["env_token"]},
+			want: "from BOT_TOKEN_FILE",
+		},
+		{
+			name: "BOT_TOKEN overrides BOT_TOKEN_FILE",
+			env:  map[string]string{"BOT_TOKEN_FILE": paths["env_token"], "BOT_TOKEN": "from BOT_TOKEN"},
+			want: "from BOT_TOKEN",
+		},
+		{
+			name: "-token-file overrides BOT_TOKEN",
+			args: []string{"-token-file", paths["flag_token"]},
+			env:  map[string]string{"BOT_TOKEN": "from BOT_TOKEN"},
+			want: "from -token-file",
+		},
+		{
+			name: "-token overrides -token-file",
+			args: []string{"-token-file", paths["flag_token"], "-token", "from -token"},
+			want: "from -token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-config", config(tt.file)}, tt.args...)
+			cfg, err := Load(args, env(tt.env), ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Token != tt.want {
+				t.Errorf("Token = %q, want %q", cfg.Token, tt.want)
+			}
+		})
+	}
+
+	t.Run("nested secret", func(t *testing.T) {
+		file := "token = \"t\"\n[smtp]\npassword_file = \"" + paths["smtp"] + "\""
+		cfg, err := Load([]string{"-config", config(file)}, env(nil), ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.SMTP.Password != "smtp password" {
+			t.Errorf("SMTP.Password = %q, want %q", cfg.SMTP.Password, "smtp password")
+		}
+	})
+}
+
+func TestLoadErrors(t *testing.T) {
+	paths := tempFiles(t, map[string]string{
+		"unknown.toml":    "token = \"t\"\n[poller]\npush = true",
+		"not_secret.toml": `workers_file = "/run/secrets/workers"`,
+		"not_list.toml":   `workers = [1, 2]`,
+		"list.toml":       `[access]` + "\n" + `admins = "alice"`,
+		"bad_int.toml":    `workers = "many"`,
+		"syntax.toml":     "token = \"t\"\nworkers",
+		"missing_secret":  `token_file = "/nonexistent/token"`,
+	})
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		err  string
+	}{
+		{"unknown key", []string{"-config", paths["unknown.toml"]}, nil, paths["unknown.toml"] + ": unknown key poller.push"},
+		{"file suffix of a value which isn't secret", []string{"-config", paths["not_secret.toml"]}, nil, "unknown key workers_file"},
+		{"array for a value", []string{"-config", paths["not_list.toml"]}, nil, "workers is not a list"},
+		{"value for a list", []string{"-config", paths["list.toml"]}, nil, "access.admins must be a list"},
+		{"invalid integer in the file", []string{"-config", paths["bad_int.toml"]}, nil, `workers: "many" is not an integer`},
+		{"syntax error", []string{"-config", paths["syntax.toml"]}, nil, paths["syntax.toml"] + ": line 2: expected key = value"},
+		{"missing secret file", []string{"-config", paths["missing_secret"]}, nil, "token: open /nonexistent/token"},
+		{"missing file", []string{"-config", "/nonexistent/libbot.toml"}, nil, "/nonexistent/libbot.toml"},
+		{"invalid integer in the env", nil, map[string]string{"BOT_TOKEN": "t", "WORKERS": "many"}, `env WORKERS: workers: "many" is not an integer`},
+		{"invalid boolean flag", []string{"-log-pii", "maybe"}, map[string]string{"BOT_TOKEN": "t"}, `flag -log-pii: log.pii: "maybe" is not a boolean`},
+		{"unknown flag", []string{"-nope"}, nil, "flag provided but not defined: -nope"},
+		{"argument", []string{"run"}, nil, `unexpected argument "run"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.args, env(tt.env), ioutil.Discard)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		// want is the list of problems, empty when the configuration is valid
+		want []string
+	}{
+		{"valid", func(cfg *Config) {}, nil},
+		{"no token", func(cfg *Config) { cfg.Token = "" }, []string{"token is not set (BOT_TOKEN, token or token_file)"}},
+		{"several problems", func(cfg *Config) { cfg.Workers = 0; cfg.ResultsLimit = -1 },
+			[]string{"workers must be positive", "results_limit must be positive"}},
+		{"source url", func(cfg *Config) { cfg.Source.URL = "ftp://example.com" }, []string{"source.url must be an http(s) URL"}},
+		{"source rate", func(cfg *Config) { cfg.Source.RateLimit = "fast" }, []string{"source.rate_limit: "}},
+		{"source rate disabled", func(cfg *Config) { cfg.Source.RateLimit = "" }, nil},
+		{"temp dir", func(cfg *Config) { cfg.Converter.TempDir = "/nonexistent" }, []string{`converter.temp_dir "/nonexistent" is not a directory`}},
+		{"poller mode", func(cfg *Config) { cfg.Poller.Mode = "push" }, []string{`poller.mode "push" must be longpoll or webhook`}},
+		{"webhook", func(cfg *Config) {
+			cfg.Poller.Mode = "webhook"
+			cfg.Poller.Webhook.PublicURL = "https://libbot.example.com"
+			cfg.Poller.Webhook.Secret = "my_secret-1"
+		}, nil},
+		{"webhook without secret", func(cfg *Config) {
+			cfg.Poller.Mode = "webhook"
+			cfg.Poller.Webhook.PublicURL = "https://libbot.example.com"
+		}, []string{"poller.webhook.secret must be 1 to 256 letters, digits, _ or -"}},
+		{"webhook secret with a slash", func(cfg *Config) {
+			cfg.Poller.Mode = "webhook"
+			cfg.Poller.Webhook.PublicURL = "https://libbot.example.com"
+			cfg.Poller.Webhook.Secret = "my/secret"
+		}, []string{"poller.webhook.secret must be 1 to 256 letters, digits, _ or -"}},
+		{"webhook over http", func(cfg *Config) {
+			cfg.Poller.Mode = "webhook"
+			cfg.Poller.Webhook.PublicURL = "http://libbot.example.com"
+			cfg.Poller.Webhook.Secret = "s"
+			cfg.Poller.Webhook.TLSKey = "key.pem"
+		}, []string{"poller.webhook.public_url must start with https://", "poller.webhook needs both tls_cert and tls_key"}},
+		{"smtp", func(cfg *Config) { cfg.SMTP.Host = "smtp.example.com"; cfg.SMTP.Port = 0; cfg.SMTP.From = "libbot" },
+			[]string{"smtp.port is invalid", "smtp.from must be an email address"}},
+		{"log format", func(cfg *Config) { cfg.Log.Format = "xml" }, []string{`log.format "xml" must be logfmt or json`}},
+		{"log level", func(cfg *Config) { cfg.Log.Level = "loud" }, []string{"log.level: "}},
+		{"empty allowlist", func(cfg *Config) { cfg.Access.Mode = "allowlist" }, []string{"access.allowlist is empty"}},
+		{"access mode", func(cfg *Config) { cfg.Access.Mode = "closed" }, []string{`access.mode "closed" must be open, allowlist, group or invite`}},
+		{"convert role", func(cfg *Config) { cfg.Access.ConvertRole = "owner" }, []string{`access.convert_role "owner" must be user, trusted or admin`}},
+		{"rates", func(cfg *Config) { cfg.Limits.Rates = []string{"search"} }, []string{"limits.rates: "}},
+		{"quotas", func(cfg *Config) { cfg.Limits.Trusted = []string{"download=many"} }, []string{"limits.trusted: "}},
+		{"follow", func(cfg *Config) { cfg.Follow.Interval = -1 }, []string{"follow.interval must not be negative"}},
+		{"metadata", func(cfg *Config) { cfg.Metadata.URL = "openlibrary.org" }, []string{"metadata.url must be an http(s) URL"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Token = "t"
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() succeeded, want %q", tt.want)
+			}
+			lines := strings.Split(err.Error(), "\n  ")
+			if lines[0] != "invalid configuration:" || len(lines) != len(tt.want)+1 {
+				t.Fatalf("Validate() error = %q, want %q", err, tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i+1], want) {
+					t.Errorf("problem %d = %q, want %q", i, lines[i+1], want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := Default()
+	cfg.Token = "123:secret"
+	buf := new(bytes.Buffer)
+	cfg.Print(buf)
+	output := buf.String()
+	for _, line := range []string{"token = ********\n", "workers = 2\n", "smtp.password = \n", "access.admins = []\n"} {
+		if !strings.Contains(output, line) {
+			t.Errorf("Print() has no %q:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "123:secret") {
+		t.Error("Print() shows the token")
+	}
+}
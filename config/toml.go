@@ -0,0 +1,151 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML reads the subset of TOML used by the configuration file: tables,
+// comments, strings, integers, booleans and single line arrays. It returns
+// the values by dotted key, arrays are returned as []string and the other
+// values as string
+func parseTOML(content []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") || strings.HasPrefix(text, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table %s", line, text)
+			}
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			if section == "" {
+				return nil, fmt.Errorf("line %d: empty table name", line)
+			}
+			continue
+		}
+		eq := strings.Index(text, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key := strings.Trim(strings.TrimSpace(text[:eq]), `"`)
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", line)
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", line, key)
+		}
+		value, err := parseValue(strings.TrimSpace(text[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// stripComment removes a # comment which is not inside a string
+func stripComment(line string) string {
+	quote := rune(0)
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote == '"':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseValue(text string) (interface{}, error) {
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("arrays must be on a single line")
+		}
+		items := []string{}
+		for _, item := range splitArray(text[1 : len(text)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			value, err := parseValue(item)
+			if err != nil {
+				return nil, err
+			}
+			scalar, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			items = append(items, scalar)
+		}
+		return items, nil
+	}
+	return parseScalar(text)
+}
+
+// splitArray splits the items of an array on the commas outside of strings
+func splitArray(text string) []string {
+	items := []string{}
+	quote := rune(0)
+	escaped := false
+	start := 0
+	for i, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote == '"':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == ',':
+			items = append(items, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, text[start:])
+}
+
+func parseScalar(text string) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") || strings.Contains(text[1:len(text)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", text)
+		}
+		return text[1 : len(text)-1], nil
+	case text == "true" || text == "false":
+		return text, nil
+	}
+	number := strings.Replace(text, "_", "", -1)
+	if _, err := strconv.ParseInt(number, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid value %s", text)
+	}
+	return number, nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]interface{}
+	}{
+		{
+			name:    "basic strings",
+			content: `a = "quote \" backslash \\ tab \t unicode \u00e9"`,
+			want:    map[string]interface{}{"a": "quote \" backslash \\ tab \t unicode é"},
+		},
+		{
+			name:    "literal strings",
+			content: `a = 'C:\path\n'`,
+			want:    map[string]interface{}{"a": `C:\path\n`},
+		},
+		{
+			name:    "integers and booleans",
+			content: "size = 52_428_800\nworkers = 2\npii = true\nself_signed = false",
+			want:    map[string]interface{}{"size": "52428800", "workers": "2", "pii": "true", "self_signed": "false"},
+		},
+		{
+			name:    "arrays",
+			content: `a = ["x", 'y, z', "w\"]", ]` + "\nb = []",
+			want:    map[string]interface{}{"a": []string{"x", "y, z", `w"]`}, "b": []string{}},
+		},
+		{
+			name:    "tables",
+			content: "token = \"t\"\n[poller]\nmode = \"webhook\"\n[ poller.webhook ]\nlisten = \":8443\"",
+			want:    map[string]interface{}{"token": "t", "poller.mode": "webhook", "poller.webhook.listen": ":8443"},
+		},
+		{
+			name:    "comments",
+			content: "# comment\n\n  a = \"# not a comment\" # comment\nb = 'x' # '\nc = [\"x\"] # [",
+			want:    map[string]interface{}{"a": "# not a comment", "b": "x", "c": []string{"x"}},
+		},
+		{
+			name:    "quoted key",
+			content: `"token" = "t"`,
+			want:    map[string]interface{}{"token": "t"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"unclosed table", "[poller", "line 1: invalid table [poller"},
+		{"array of tables", "[[poller]]", "line 1: invalid table [[poller]]"},
+		{"empty table", "a = 1\n[ ]", "line 2: empty table name"},
+		{"no value", "token", "line 1: expected key = value"},
+		{"empty key", `= "t"`, "line 1: empty key"},
+		{"duplicate key", "[log]\nlevel = \"info\"\nlevel = \"debug\"", "line 3: duplicate key log.level"},
+		{"multiline array", "rates = [\n\"search=5/10s\"\n]", "line 1: arrays must be on a single line"},
+		{"nested array", "rates = [[\"a\"]]", "line 1: nested arrays are not supported"},
+		{"unterminated string", `token = "t`, `line 1: invalid string "t`},
+		{"invalid escape", `token = "\q"`, `line 1: invalid string "\q"`},
+		{"quote in literal string", `token = 'a'b'`, `line 1: invalid string 'a'b'`},
+		{"bare word", "mode = webhook", "line 1: invalid value webhook"},
+		{"float", "index = 1.5", "line 1: invalid value 1.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(tt.content))
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseTOML() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`a = 1 # one`, `a = 1 `},
+		{`a = "#" # one`, `a = "#" `},
+		{`a = "\"#" # one`, `a = "\"#" `},
+		{`a = '\' # one`, `a = '\' `},
+		{`a = "x" # "#"`, `a = "x" `},
+		{`# comment`, ``},
+		{`a = "unterminated #`, `a = "unterminated #`},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.line); got != tt.want {
+			t.Errorf("stripComment(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
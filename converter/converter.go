@@ -1,53 +1,108 @@
 package converter
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/naming"
 )
 
-// ConvertFile convert a file using Calibre
-func ConvertFile(filename string, content []byte) (string, []byte, error) {
-	dir, err := ioutil.TempDir("/tmp", "book")
-	if err != nil {
-		log.Print(err)
-		return "", nil, err
+var logger = logging.Package("converter")
+
+// tempPrefix prefixes the temporary directories of the conversions
+const tempPrefix = "libbot-"
+
+// Calibre converts books using the ebook-convert tool of Calibre
+type Calibre struct {
+	// Binary is the path of ebook-convert, it is looked up in PATH by default
+	Binary string
+	// TempDir holds the temporary files, the system one is used by default
+	TempDir string
+}
+
+func (c Calibre) binary() string {
+	if c.Binary == "" {
+		return "ebook-convert"
 	}
-	reg, err := regexp.Compile("[^a-zA-Z0-9.]+")
+	return c.Binary
+}
+
+// Available checks that ebook-convert can be run
+func (c Calibre) Available() error {
+	_, err := exec.LookPath(c.binary())
+	return err
+}
+
+// Convert converts a file to the given format using Calibre, it returns the name of the converted file
+func (c Calibre) Convert(ctx context.Context, filename string, content []byte, format string) (string, []byte, error) {
+	dir, err := ioutil.TempDir(c.TempDir, tempPrefix)
 	if err != nil {
-		log.Print(err)
+		logger.ErrorContext(ctx, "Failed to create temporary directory", logging.Err(err))
+		return "", nil, err
 	}
-
 	defer os.RemoveAll(dir) // clean up
 
-	path := filepath.Join(dir, reg.ReplaceAllString(filename, ""))
-	log.Print("Writing to disk: ", path)
+	name := naming.Sanitize(filepath.Base(filename))
+	if strings.TrimSuffix(name, filepath.Ext(name)) == "" {
+		name = "book" + filepath.Ext(name)
+	}
+	path := filepath.Join(dir, name)
+	logger.DebugContext(ctx, "Writing to disk", "path", path)
 	if err := ioutil.WriteFile(path, content, 0644); err != nil {
-		log.Print("Writing to disk failed: ", err)
+		logger.ErrorContext(ctx, "Writing to disk failed", "path", path, logging.Err(err))
 		return "", nil, err
 	}
 
 	baseName := strings.TrimSuffix(path, filepath.Ext(path))
-	mobiName := baseName + ".mobi"
+	convertedName := baseName + "." + strings.ToLower(strings.TrimPrefix(format, "."))
+	if convertedName == path {
+		return "", nil, fmt.Errorf("%s is already in %s format", filename, format)
+	}
 
-	cmd := exec.Command("ebook-convert", path, mobiName, "--mobi-keep-original-images")
-	log.Printf("Running converter and waiting for it to finish...")
+	args := []string{path, convertedName}
+	if filepath.Ext(convertedName) == ".mobi" {
+		args = append(args, "--mobi-keep-original-images")
+	}
+	cmd := exec.CommandContext(ctx, c.binary(), args...)
+	logger.InfoContext(ctx, "Running converter", "file", name, "format", format)
 	output, cmdErr := cmd.Output()
-	log.Printf("Output %s\n", output)
+	logger.DebugContext(ctx, "Converter output", "output", string(output))
 	if cmdErr != nil {
-		log.Print("Error while running converter: ", cmdErr)
+		logger.ErrorContext(ctx, "Error while running converter", logging.Err(cmdErr))
 		return "", nil, cmdErr
 	}
 
-	content, err = ioutil.ReadFile(mobiName)
+	content, err = ioutil.ReadFile(convertedName)
 	if err != nil {
-		log.Print(err)
+		logger.ErrorContext(ctx, "Failed to read converted file", logging.Err(err))
 		return "", nil, err
 	}
 
-	return mobiName, content, nil
+	return filepath.Base(convertedName), content, nil
+}
+
+// Cleanup removes the temporary directories left by conversions which didn't
+// finish, like the ones interrupted by a shutdown
+func (c Calibre) Cleanup() error {
+	dir := c.TempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		logger.Info("Removing temporary directory", "path", leftover)
+		if err := os.RemoveAll(leftover); err != nil {
+			return err
+		}
+	}
+	return nil
 }
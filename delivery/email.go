@@ -0,0 +1,234 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/pipeline"
+)
+
+var logger = logging.Package("delivery")
+
+// DefaultMaxAttachmentSize is the attachment limit of the Kindle mail service
+const DefaultMaxAttachmentSize = 50 * 1024 * 1024
+
+// DefaultTimeout bounds the sending of an email when the Mailer sets none
+const DefaultTimeout = 2 * time.Minute
+
+// ErrAddressNotAllowed is returned for addresses outside of the allowed domains
+var ErrAddressNotAllowed = errors.New("address not allowed")
+
+// ErrTooLarge is returned when a file exceeds the attachment size limit
+var ErrTooLarge = errors.New("file too large to be sent by email")
+
+// Mailer sends books as email attachments through a SMTP server
+type Mailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// AllowedDomains restricts the recipients, any domain is allowed if empty
+	AllowedDomains []string
+	// MaxAttachmentSize is the maximum size of a file in bytes
+	MaxAttachmentSize int
+	// Timeout bounds the whole exchange with the server, a hung server
+	// would block the job forever
+	Timeout time.Duration
+}
+
+// CheckAddress validates an address and returns it without display name
+func (m *Mailer) CheckAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return "", err
+	}
+	if len(m.AllowedDomains) == 0 {
+		return parsed.Address, nil
+	}
+	domain := strings.ToLower(parsed.Address[strings.LastIndex(parsed.Address, "@")+1:])
+	for _, allowed := range m.AllowedDomains {
+		if domain == strings.ToLower(strings.TrimSpace(allowed)) {
+			return parsed.Address, nil
+		}
+	}
+	return "", fmt.Errorf("%w: only %s addresses are accepted", ErrAddressNotAllowed, strings.Join(m.AllowedDomains, ", "))
+}
+
+// Send emails a file to an address
+func (m *Mailer) Send(ctx context.Context, to string, file pipeline.File) error {
+	to, err := m.CheckAddress(to)
+	if err != nil {
+		return err
+	}
+	limit := m.MaxAttachmentSize
+	if limit <= 0 {
+		limit = DefaultMaxAttachmentSize
+	}
+	if len(file.Content) > limit {
+		return fmt.Errorf("%w (%d MB, limit is %d MB)", ErrTooLarge, len(file.Content)>>20, limit>>20)
+	}
+	message, err := m.message(to, file)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	address := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	logger.InfoContext(ctx, "Sending email", "server", address, "file", file.Name)
+	return m.send(ctx, address, auth, to, message)
+}
+
+// send delivers a message like smtp.SendMail, the exchange stops when the
+// context is done or the timeout expires
+func (m *Mailer) send(ctx context.Context, address string, auth smtp.Auth, to string, message []byte) error {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// a cancelled context interrupts the reads and writes in progress
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message builds a MIME message with the file as attachment
+func (m *Mailer) message(to string, file pipeline.File) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := multipart.NewWriter(buf)
+	headers := []string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", file.Name),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + writer.Boundary(),
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	text, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "%s, sent by libbot\r\n", file.Name)
+
+	contentType := ContentType(file.Name)
+	attachment, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": file.Name})},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": file.Name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(file.Content)
+	// lines of base64 must not exceed 76 characters
+	for len(encoded) > 76 {
+		attachment.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	attachment.Write([]byte(encoded + "\r\n"))
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// contentTypes lists the ebook formats unknown to the mime package
+var contentTypes = map[string]string{
+	".epub": "application/epub+zip",
+	".mobi": "application/x-mobipocket-ebook",
+	".azw3": "application/vnd.amazon.ebook",
+	".fb2":  "application/x-fictionbook+xml",
+	".djvu": "image/vnd.djvu",
+}
+
+// ContentType returns the media type of a file from its extension
+func ContentType(name string) string {
+	extension := strings.ToLower(filepath.Ext(name))
+	if contentType, ok := contentTypes[extension]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(extension); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// EmailUploader delivers the files of the pipeline by email
+type EmailUploader struct {
+	Mailer *Mailer
+	To     string
+}
+
+// Upload implements the pipeline uploader
+func (u EmailUploader) Upload(ctx context.Context, file pipeline.File) (string, error) {
+	return "", u.Mailer.Send(ctx, u.To, file)
+}
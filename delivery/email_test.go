@@ -0,0 +1,243 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geobeau/Libbot/pipeline"
+)
+
+// smtpServer is a local SMTP stand-in accepting every message
+type smtpServer struct {
+	listener net.Listener
+	// messages receives the envelope and data of the messages
+	messages chan smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// newSMTPServer starts a stand-in, a silent server accepts connections and
+// never answers
+func newSMTPServer(t *testing.T, silent bool) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{listener: listener, messages: make(chan smtpMessage, 1)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if silent {
+				t.Cleanup(func() { conn.Close() })
+				continue
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// serve answers the commands of a client
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ready")
+	message := smtpMessage{}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 HELP")
+		case "MAIL":
+			message.from = strings.TrimPrefix(line, "MAIL FROM:")
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			message.to = append(message.to, strings.TrimPrefix(line, "RCPT TO:"))
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 send the message")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			message.data = data
+			s.messages <- message
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// mailer returns a mailer sending to the stand-in
+func (s *smtpServer) mailer() *Mailer {
+	address := s.listener.Addr().(*net.TCPAddr)
+	return &Mailer{
+		Host:           address.IP.String(),
+		Port:           address.Port,
+		From:           "libbot@example.com",
+		AllowedDomains: []string{"kindle.com"},
+	}
+}
+
+func TestSend(t *testing.T) {
+	server := newSMTPServer(t, false)
+	file := pipeline.File{Name: "Café.epub", Content: bytes.Repeat([]byte("epub content "), 20)}
+	if err := server.mailer().Send(context.Background(), "Reader <reader@Kindle.com>", file); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	received := <-server.messages
+	if received.from != "<libbot@example.com>" || len(received.to) != 1 || received.to[0] != "<reader@Kindle.com>" {
+		t.Errorf("envelope from %q to %q", received.from, received.to)
+	}
+
+	message, err := mail.ReadMessage(bytes.NewReader(received.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := message.Header.Get("To"); to != "reader@Kindle.com" {
+		t.Errorf("To = %q", to)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != file.Name {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, %v", mediaType, err)
+	}
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	if _, err := reader.NextPart(); err != nil {
+		t.Fatalf("text part: %v", err)
+	}
+	attachment, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("attachment: %v", err)
+	}
+	if contentType := attachment.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/epub+zip") {
+		t.Errorf("attachment Content-Type = %q", contentType)
+	}
+	if attachment.FileName() != file.Name {
+		t.Errorf("attachment name = %q, want %q", attachment.FileName(), file.Name)
+	}
+	encoded, err := ioutil.ReadAll(attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stand-in reads the lines without their CRLF
+	lines := strings.Fields(string(encoded))
+	for _, line := range lines {
+		if len(line) > 76 {
+			t.Errorf("base64 line of %d characters", len(line))
+		}
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	if err != nil || !bytes.Equal(content, file.Content) {
+		t.Errorf("attachment content = %q, %v", content, err)
+	}
+}
+
+func TestSendRefused(t *testing.T) {
+	server := newSMTPServer(t, false)
+	tests := []struct {
+		name    string
+		to      string
+		maxSize int
+		size    int
+		err     error
+	}{
+		{"domain not allowed", "reader@example.com", 0, 10, ErrAddressNotAllowed},
+		{"too large", "reader@kindle.com", 100, 101, ErrTooLarge},
+		{"too large by default", "reader@kindle.com", 0, DefaultMaxAttachmentSize + 1, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := server.mailer()
+			m.MaxAttachmentSize = tt.maxSize
+			file := pipeline.File{Name: "book.epub", Content: make([]byte, tt.size)}
+			if err := m.Send(context.Background(), tt.to, file); !errors.Is(err, tt.err) {
+				t.Errorf("Send() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+	select {
+	case <-server.messages:
+		t.Error("a refused email was sent")
+	default:
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	m := &Mailer{AllowedDomains: []string{"kindle.com", " Free.Kindle.com "}}
+	tests := []struct {
+		address string
+		want    string
+		err     bool
+	}{
+		{"reader@kindle.com", "reader@kindle.com", false},
+		{"Reader <reader@free.kindle.com>", "reader@free.kindle.com", false},
+		{"reader@evil-kindle.com", "", true},
+		{"not an address", "", true},
+	}
+	for _, tt := range tests {
+		got, err := m.CheckAddress(tt.address)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("CheckAddress(%q) = %q, %v", tt.address, got, err)
+		}
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	server := newSMTPServer(t, true)
+	m := server.mailer()
+	m.Timeout = 200 * time.Millisecond
+	start := time.Now()
+	err := m.Send(context.Background(), "reader@kindle.com", pipeline.File{Name: "book.epub", Content: []byte("epub")})
+	if err == nil {
+		t.Fatal("Send() to a hung server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send() returned after %v", elapsed)
+	}
+}
+
+func TestSendCancelled(t *testing.T) {
+	server := newSMTPServer(t, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err := server.mailer().Send(ctx, "reader@kindle.com", pipeline.File{Name: "book.epub", Content: []byte("epub")})
+	if err == nil {
+		t.Fatal("Send() with a cancelled context succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Send() returned after %v", elapsed)
+	}
+}
@@ -0,0 +1,162 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/naming"
+	"github.com/geobeau/Libbot/pipeline"
+)
+
+// DefaultTemplate stores books in a folder per author
+const DefaultTemplate = "{{.Author}}/{{.Filename}}"
+
+// Library stores files in the folder of a user
+type Library interface {
+	Save(ctx context.Context, user string, relativePath string, content []byte) error
+}
+
+// Folder is a library in a local directory, usually synced to e-readers by
+// another tool
+type Folder struct {
+	Path string
+}
+
+// Save writes a file in the folder of a user
+func (f Folder) Save(ctx context.Context, user string, relativePath string, content []byte) error {
+	target := filepath.Join(f.Path, naming.Sanitize(user), filepath.FromSlash(relativePath))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp := target + ".part"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	// the sync tools never see a partial file
+	return os.Rename(tmp, target)
+}
+
+// WebDAV is a library on a WebDAV server, as used by KOReader
+type WebDAV struct {
+	// URL is the root of the libraries, each user has a folder below it
+	URL      string
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// Save uploads a file in the folder of a user, creating the missing folders
+func (w WebDAV) Save(ctx context.Context, user string, relativePath string, content []byte) error {
+	segments := append([]string{naming.Sanitize(user)}, strings.Split(relativePath, "/")...)
+	current := strings.TrimSuffix(w.URL, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		current += "/" + url.PathEscape(segment)
+		resp, err := w.do(ctx, "MKCOL", current+"/", nil)
+		if err != nil {
+			return err
+		}
+		// 405 means the folder already exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("MKCOL %s: %s", current, resp.Status)
+		}
+	}
+	target := current + "/" + url.PathEscape(segments[len(segments)-1])
+	resp, err := w.do(ctx, "PUT", target, content)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("PUT %s: %s", target, resp.Status)
+	}
+	return nil
+}
+
+func (w WebDAV) do(ctx context.Context, method string, target string, content []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if content != nil {
+		req.Header.Set("Content-Type", ContentType(target))
+	}
+	if w.Username != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	logger.DebugContext(ctx, "WebDAV request", "method", method, "url", target)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// templateData is what naming templates can use
+type templateData struct {
+	book.Book
+	// Filename is the readable file name built from the book metadata
+	Filename string
+	// Ext is the extension of the file, with its dot
+	Ext string
+}
+
+// ParseTemplate parses a naming template, like "{{.Author}}/{{.Filename}}"
+func ParseTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultTemplate
+	}
+	return template.New("library").Parse(text)
+}
+
+// LibraryPath renders the path of a file in a library, each segment of the
+// path is sanitized
+func LibraryPath(tmpl *template.Template, file pipeline.File) (string, error) {
+	data := templateData{Book: file.Book, Filename: file.Name, Ext: path.Ext(file.Name)}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	segments := []string{}
+	for _, segment := range strings.Split(buf.String(), "/") {
+		if segment = naming.Sanitize(segment); segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 {
+		return file.Name, nil
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// LibraryUploader delivers the files of the pipeline to the library of a user
+type LibraryUploader struct {
+	Library  Library
+	User     string
+	Template *template.Template
+}
+
+// Upload implements the pipeline uploader, the reference is the path of the
+// file in the library
+func (u LibraryUploader) Upload(ctx context.Context, file pipeline.File) (string, error) {
+	relativePath, err := LibraryPath(u.Template, file)
+	if err != nil {
+		return "", err
+	}
+	logger.InfoContext(ctx, "Saving to library", "path", relativePath)
+	return relativePath, u.Library.Save(ctx, u.User, relativePath, file.Content)
+}
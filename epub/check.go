@@ -0,0 +1,502 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Problem is a defect found in an EPUB
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// Report lists the problems of an EPUB and the repairs made to it
+type Report struct {
+	Problems []Problem
+	Repairs  []string
+}
+
+// Valid tells if no problem was found
+func (r Report) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) problem(path string, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) repair(format string, args ...interface{}) {
+	r.Repairs = append(r.Repairs, fmt.Sprintf(format, args...))
+}
+
+// manifestItem is an item of the manifest of the package document
+type manifestItem struct {
+	index      int
+	id         string
+	href       string
+	path       string
+	mediaType  string
+	properties string
+}
+
+var encodingDeclaration = regexp.MustCompile(`^(<\?xml[^>]*encoding=["'])([^"']+)(["'])`)
+
+// Check validates the structure of an EPUB: the mimetype entry, the
+// container, the package document, the table of contents and the content
+// documents
+func Check(content []byte) Report {
+	report := Report{}
+	checkMimetype(content, &report)
+	b, err := Open(content)
+	if err != nil {
+		report.problem("", "cannot open: %v", err)
+		return report
+	}
+	b.check(&report)
+	return report
+}
+
+// Repair fixes the common defects of an EPUB: the archive is packaged again
+// with a proper mimetype entry, manifest items pointing to missing files are
+// dropped, text documents are converted to UTF-8 and malformed XHTML
+// documents are written again from a lenient parsing. The returned report
+// lists the repairs and the remaining problems
+func Repair(content []byte) ([]byte, Report, error) {
+	report := Report{}
+	checkMimetype(content, &report)
+	if len(report.Problems) > 0 {
+		report.repair("rewrote the mimetype entry")
+	}
+	b, err := Open(content)
+	if err != nil {
+		return nil, report, err
+	}
+	b.fixEncodings(&report)
+	b.fixMarkup(&report)
+	b.dropDangling(&report)
+
+	repaired, err := b.Bytes()
+	if err != nil {
+		return nil, report, err
+	}
+	reopened, err := Open(repaired)
+	if err != nil {
+		return nil, report, err
+	}
+	report.Problems = nil
+	reopened.check(&report)
+	return repaired, report, nil
+}
+
+// checkMimetype verifies that the archive starts with an uncompressed
+// mimetype entry
+func checkMimetype(content []byte, report *Report) {
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		report.problem("", "not a zip archive: %v", err)
+		return
+	}
+	if len(reader.File) == 0 || reader.File[0].Name != "mimetype" {
+		report.problem("mimetype", "must be the first entry of the archive")
+		return
+	}
+	mimetype := reader.File[0]
+	if mimetype.Method != zip.Store {
+		report.problem("mimetype", "must be stored without compression")
+	}
+	if len(mimetype.Extra) > 0 {
+		report.problem("mimetype", "must not have extra fields")
+	}
+	rc, err := mimetype.Open()
+	if err != nil {
+		report.problem("mimetype", "cannot be read: %v", err)
+		return
+	}
+	defer rc.Close()
+	value, err := ioutil.ReadAll(rc)
+	if err != nil || string(value) != MimeType {
+		report.problem("mimetype", "must contain %q", MimeType)
+	}
+}
+
+// manifest returns the items of the manifest
+func (b *Book) manifest(elements []element) []manifestItem {
+	pkg := find(elements, -1, "package")
+	manifest := find(elements, pkg, "manifest")
+	if manifest < 0 {
+		return nil
+	}
+	items := []manifestItem{}
+	for _, i := range children(elements, manifest) {
+		e := elements[i]
+		if e.name != "item" {
+			continue
+		}
+		items = append(items, manifestItem{
+			index:      i,
+			id:         e.attr("id"),
+			href:       e.attr("href"),
+			path:       b.resolve(unescapeHref(e.attr("href"))),
+			mediaType:  e.attr("media-type"),
+			properties: e.attr("properties"),
+		})
+	}
+	return items
+}
+
+func unescapeHref(href string) string {
+	return strings.NewReplacer("%20", " ", "%25", "%").Replace(href)
+}
+
+func (b *Book) check(report *Report) {
+	if !utf8.Valid(b.opf) {
+		report.problem(b.opfPath, "is not valid UTF-8")
+	}
+	if err := wellFormed(b.opf); err != nil {
+		report.problem(b.opfPath, "malformed XML: %v", err)
+	}
+	elements, err := scan(b.opf)
+	if err != nil {
+		report.problem(b.opfPath, "cannot be parsed: %v", err)
+		return
+	}
+	pkg := find(elements, -1, "package")
+	if pkg < 0 {
+		report.problem(b.opfPath, "no package element")
+		return
+	}
+	metadata := find(elements, pkg, "metadata")
+	if metadata < 0 {
+		report.problem(b.opfPath, "no metadata element")
+	} else {
+		for _, required := range []string{"title", "identifier", "language"} {
+			if find(elements, metadata, required) < 0 {
+				report.problem(b.opfPath, "no %s in metadata", required)
+			}
+		}
+	}
+
+	items := b.manifest(elements)
+	if len(items) == 0 {
+		report.problem(b.opfPath, "empty manifest")
+	}
+	ids := map[string]manifestItem{}
+	for _, item := range items {
+		if item.id == "" {
+			report.problem(b.opfPath, "manifest item %q has no id", item.href)
+		} else if _, ok := ids[item.id]; ok {
+			report.problem(b.opfPath, "duplicate manifest id %q", item.id)
+		}
+		ids[item.id] = item
+		file := b.file(item.path)
+		if file == nil {
+			report.problem(b.opfPath, "manifest item %q points to missing file %s", item.id, item.path)
+			continue
+		}
+		if isText(item.mediaType) {
+			b.checkDocument(item, file.content, report)
+		}
+	}
+
+	spine := find(elements, pkg, "spine")
+	if spine < 0 {
+		report.problem(b.opfPath, "no spine")
+		return
+	}
+	itemrefs := 0
+	for _, i := range children(elements, spine) {
+		if elements[i].name != "itemref" {
+			continue
+		}
+		itemrefs++
+		idref := elements[i].attr("idref")
+		if _, ok := ids[idref]; !ok {
+			report.problem(b.opfPath, "spine references unknown item %q", idref)
+		}
+	}
+	if itemrefs == 0 {
+		report.problem(b.opfPath, "empty spine")
+	}
+	b.checkNavigation(elements, spine, ids, report)
+}
+
+// checkNavigation verifies that the NCX (EPUB 2) or the navigation
+// document (EPUB 3) is present
+func (b *Book) checkNavigation(elements []element, spine int, ids map[string]manifestItem, report *Report) {
+	if b.version(elements) >= 3 {
+		for _, item := range ids {
+			if strings.Contains(" "+item.properties+" ", " nav ") {
+				return
+			}
+		}
+		report.problem(b.opfPath, "no navigation document")
+		return
+	}
+	toc := elements[spine].attr("toc")
+	if toc == "" {
+		report.problem(b.opfPath, "spine has no toc attribute")
+		return
+	}
+	ncx, ok := ids[toc]
+	if !ok {
+		report.problem(b.opfPath, "toc references unknown item %q", toc)
+		return
+	}
+	file := b.file(ncx.path)
+	if file == nil {
+		return
+	}
+	ncxElements, err := scan(file.content)
+	if err != nil || find(ncxElements, -1, "navMap") < 0 {
+		report.problem(ncx.path, "NCX has no navMap")
+	}
+}
+
+func (b *Book) checkDocument(item manifestItem, content []byte, report *Report) {
+	if !utf8.Valid(content) {
+		report.problem(item.path, "is not valid UTF-8")
+		return
+	}
+	if err := wellFormed(content); err != nil {
+		report.problem(item.path, "malformed XML: %v", err)
+	}
+}
+
+// dropDangling removes the manifest items and spine references pointing to
+// missing files
+func (b *Book) dropDangling(report *Report) {
+	elements, err := scan(b.opf)
+	if err != nil {
+		return
+	}
+	dangling := map[string]bool{}
+	edits := []edit{}
+	for _, item := range b.manifest(elements) {
+		if b.file(item.path) != nil {
+			continue
+		}
+		dangling[item.id] = true
+		edits = append(edits, removal(b.opf, elements[item.index]))
+		report.repair("dropped manifest item %q pointing to missing %s", item.id, item.path)
+	}
+	spine := find(elements, find(elements, -1, "package"), "spine")
+	if spine >= 0 {
+		for _, i := range children(elements, spine) {
+			if elements[i].name == "itemref" && dangling[elements[i].attr("idref")] {
+				edits = append(edits, removal(b.opf, elements[i]))
+			}
+		}
+	}
+	b.opf = applyEdits(b.opf, edits)
+}
+
+// fixEncodings converts the package document and the text documents to
+// UTF-8, the original is expected to be in Windows-1252 (a superset of
+// ISO-8859-1) when it is not valid UTF-8
+func (b *Book) fixEncodings(report *Report) {
+	fix := func(name string, content []byte) []byte {
+		declared := ""
+		if match := encodingDeclaration.FindSubmatch(content); match != nil {
+			declared = strings.ToLower(string(match[2]))
+		}
+		if utf8.Valid(content) && (declared == "" || declared == "utf-8" || declared == "utf8") {
+			return content
+		}
+		if !singleByte(declared) {
+			return content
+		}
+		if !utf8.Valid(content) {
+			content = windows1252ToUTF8(content)
+		}
+		report.repair("converted %s to UTF-8", name)
+		return encodingDeclaration.ReplaceAll(content, []byte("${1}utf-8${3}"))
+	}
+	b.opf = fix(b.opfPath, b.opf)
+	elements, err := scan(b.opf)
+	if err != nil {
+		return
+	}
+	for _, item := range b.manifest(elements) {
+		if file := b.file(item.path); file != nil && isText(item.mediaType) {
+			file.content = fix(item.path, file.content)
+		}
+	}
+}
+
+// fixMarkup writes again the XHTML documents which are not well-formed,
+// parsed like a browser would: unclosed elements are closed, HTML entities
+// are replaced and stray ampersands are escaped
+func (b *Book) fixMarkup(report *Report) {
+	elements, err := scan(b.opf)
+	if err != nil {
+		return
+	}
+	for _, item := range b.manifest(elements) {
+		file := b.file(item.path)
+		if file == nil || (item.mediaType != "application/xhtml+xml" && item.mediaType != "text/html") {
+			continue
+		}
+		if !utf8.Valid(file.content) || wellFormed(file.content) == nil {
+			continue
+		}
+		fixed := reserialize(file.content)
+		if fixed == nil || wellFormed(fixed) != nil {
+			continue
+		}
+		file.content = fixed
+		report.repair("rewrote the malformed markup of %s", item.path)
+	}
+}
+
+var (
+	textEscaper      = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attributeEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// reserialize parses a document leniently and writes it back as XML, the
+// namespace prefixes of the source are kept. It returns nil when the
+// document cannot be read to the end
+func reserialize(document []byte) []byte {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	// the decoder replaces the prefixes with their namespace
+	prefixes := map[string]string{"http://www.w3.org/XML/1998/namespace": "xml"}
+	name := func(n xml.Name, element bool) string {
+		if n.Space == "" {
+			return n.Local
+		}
+		if n.Space == "xmlns" {
+			return "xmlns:" + n.Local
+		}
+		prefix, ok := prefixes[n.Space]
+		if !ok {
+			// unbound prefix
+			return n.Space + ":" + n.Local
+		}
+		if prefix == "" && element {
+			return n.Local
+		}
+		return qualified(prefix, n.Local)
+	}
+
+	buf := new(bytes.Buffer)
+	open := []string{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if decoder.InputOffset() < int64(len(document)) {
+				return nil
+			}
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					prefixes[a.Value] = a.Name.Local
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					prefixes[a.Value] = ""
+				}
+			}
+			buf.WriteString("<" + name(t.Name, true))
+			for _, a := range t.Attr {
+				buf.WriteString(" " + name(a.Name, false) + `="` + attributeEscaper.Replace(a.Value) + `"`)
+			}
+			buf.WriteString(">")
+			open = append(open, name(t.Name, true))
+		case xml.EndElement:
+			buf.WriteString("</" + name(t.Name, true) + ">")
+			open = open[:len(open)-1]
+		case xml.CharData:
+			buf.WriteString(textEscaper.Replace(string(t)))
+		case xml.Comment:
+			buf.WriteString("<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			buf.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			buf.WriteString("<!" + string(t) + ">")
+		}
+	}
+	// the elements still open at the end of the document are closed
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString("</" + open[i] + ">")
+	}
+	return buf.Bytes()
+}
+
+// singleByte tells if a declared encoding can be read as Windows-1252
+func singleByte(encoding string) bool {
+	switch encoding {
+	case "", "utf-8", "utf8", "iso-8859-1", "iso8859-1", "latin1", "latin-1", "windows-1252", "cp1252", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// windows1252 maps the 0x80-0x9F range of Windows-1252, the other bytes
+// have the same value in unicode
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+func windows1252ToUTF8(content []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(content)+len(content)/8))
+	for _, c := range content {
+		switch {
+		case c < 0x80:
+			buf.WriteByte(c)
+		case c < 0xA0:
+			buf.WriteRune(windows1252[c-0x80])
+		default:
+			buf.WriteRune(rune(c))
+		}
+	}
+	return buf.Bytes()
+}
+
+func isText(mediaType string) bool {
+	switch mediaType {
+	case "application/xhtml+xml", "application/x-dtbncx+xml", "text/html", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// wellFormed parses a document and returns the first XML error
+func wellFormed(document []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package epub
+
+import (
+	"archive/zip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// with returns the files with the content of one of them replaced
+func with(files []fixtureFile, name, content string) []fixtureFile {
+	replaced := append([]fixtureFile{}, files...)
+	for i := range replaced {
+		if replaced[i].name == name {
+			replaced[i].content = content
+		}
+	}
+	return replaced
+}
+
+const malformedChapter = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Chapter 1</title></head>
+<body><section epub:type="chapter"><p>Fish & chips&nbsp;<br></p>
+<p>It was a dark and stormy night.`
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []fixtureFile
+		// problems are the prefixes of the problems found by Check
+		problems []string
+		repairs  []string
+		// contains are parts of the repaired files
+		contains map[string][]string
+		// missing are parts removed from the repaired files
+		missing map[string][]string
+	}{
+		{
+			name:  "valid",
+			files: epub2(),
+		},
+		{
+			name:     "mimetype not first",
+			files:    append(epub3()[1:], epub3()[0]),
+			problems: []string{"mimetype: must be the first entry of the archive"},
+			repairs:  []string{"rewrote the mimetype entry"},
+		},
+		{
+			name:     "compressed mimetype",
+			files:    append([]fixtureFile{{"mimetype", MimeType, zip.Deflate}}, epub2()[1:]...),
+			problems: []string{"mimetype: must be stored without compression"},
+			repairs:  []string{"rewrote the mimetype entry"},
+		},
+		{
+			name: "dangling manifest item",
+			files: with(epub2(), "OEBPS/content.opf", strings.Replace(strings.Replace(epub2OPF,
+				`<itemref idref="chapter1"/>`, `<itemref idref="chapter1"/><itemref idref="chapter2"/>`, 1),
+				`<item id="chapter1"`, `<item id="chapter2" href="chapter2.xhtml" media-type="application/xhtml+xml"/><item id="chapter1"`, 1)),
+			problems: []string{`OEBPS/content.opf: manifest item "chapter2" points to missing file OEBPS/chapter2.xhtml`},
+			repairs:  []string{`dropped manifest item "chapter2" pointing to missing OEBPS/chapter2.xhtml`},
+			contains: map[string][]string{"OEBPS/content.opf": {`<item id="chapter1"`, `<itemref idref="chapter1"/>`}},
+			missing:  map[string][]string{"OEBPS/content.opf": {"chapter2"}},
+		},
+		{
+			name: "windows-1252 document",
+			files: with(epub2(), "OEBPS/chapter1.xhtml", strings.NewReplacer(
+				"UTF-8", "windows-1252",
+				"It was a dark and stormy night.", "Caf\xe9 \x93cr\xe8me\x94 \x80",
+			).Replace(chapter)),
+			problems: []string{"OEBPS/chapter1.xhtml: is not valid UTF-8"},
+			repairs:  []string{"converted OEBPS/chapter1.xhtml to UTF-8"},
+			contains: map[string][]string{"OEBPS/chapter1.xhtml": {`encoding="utf-8"`, "<p>Café “crème” €</p>"}},
+		},
+		{
+			name:     "malformed XHTML",
+			files:    with(epub3(), "OEBPS/chapter1.xhtml", malformedChapter),
+			problems: []string{"OEBPS/chapter1.xhtml: malformed XML: "},
+			repairs:  []string{"rewrote the malformed markup of OEBPS/chapter1.xhtml"},
+			contains: map[string][]string{"OEBPS/chapter1.xhtml": {
+				`<?xml version="1.0" encoding="UTF-8"?>`,
+				`<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">`,
+				`<section epub:type="chapter"><p>Fish &amp; chips` + "\u00a0" + `<br></br></p>`,
+				`<p>It was a dark and stormy night.</p></section></body></html>`,
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := build(t, tt.files...)
+			report := Check(content)
+			if len(report.Problems) != len(tt.problems) {
+				t.Fatalf("Check() problems = %v, want %q", report.Problems, tt.problems)
+			}
+			for i, problem := range report.Problems {
+				if !strings.HasPrefix(problem.String(), tt.problems[i]) {
+					t.Errorf("Check() problem = %q, want %q", problem, tt.problems[i])
+				}
+			}
+
+			repaired, report, err := Repair(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report.Repairs, tt.repairs) {
+				t.Errorf("Repair() repairs = %q, want %q", report.Repairs, tt.repairs)
+			}
+			if !report.Valid() {
+				t.Errorf("Repair() left problems %v", report.Problems)
+			}
+			if again := Check(repaired); !again.Valid() {
+				t.Errorf("Check() of the repaired EPUB = %v, want no problem", again.Problems)
+			}
+			if first := entries(t, repaired)[0]; first.Name != "mimetype" || first.Method != zip.Store {
+				t.Errorf("first entry = %q with method %d, want an uncompressed mimetype", first.Name, first.Method)
+			}
+			for name, parts := range tt.contains {
+				file := read(t, repaired, name)
+				for _, part := range parts {
+					if !strings.Contains(file, part) {
+						t.Errorf("%s has no %q:\n%s", name, part, file)
+					}
+				}
+			}
+			for name, parts := range tt.missing {
+				file := read(t, repaired, name)
+				for _, part := range parts {
+					if strings.Contains(file, part) {
+						t.Errorf("%s still has %q:\n%s", name, part, file)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCheckNotZip(t *testing.T) {
+	report := Check([]byte("not an archive"))
+	if report.Valid() || !strings.HasPrefix(report.Problems[0].String(), "not a zip archive") {
+		t.Errorf("Check() = %v, want a problem", report.Problems)
+	}
+	if _, _, err := Repair([]byte("not an archive")); err == nil {
+		t.Error("Repair() succeeded on a file which isn't an archive")
+	}
+}
+
+func TestReserialize(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     string
+	}{
+		{"unclosed", `<div><p>one<p>two`, `<div><p>one<p>two</p></p></div>`},
+		{"void element", `<p>a<br>b<img src=cover></p>`, `<p>a<br></br>b<img src="cover"></img></p>`},
+		{"entities", `<p title="a&b">&eacute; & &unknown;</p>`, `<p title="a&amp;b">é &amp; &amp;unknown;</p>`},
+		{"xml prefix", `<p xml:lang="fr">oui`, `<p xml:lang="fr">oui</p>`},
+		{"comment", `<!-- note --><p>a</p>`, `<!-- note --><p>a</p>`},
+		{"unreadable", `<p>a</p></div><p>b</p>`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(reserialize([]byte(tt.document))); got != tt.want {
+				t.Errorf("reserialize() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// MimeType is the content of the mimetype entry of every EPUB
+const MimeType = "application/epub+zip"
+
+const containerPath = "META-INF/container.xml"
+
+// ErrNoRootfile is returned when the container doesn't reference any OPF file
+var ErrNoRootfile = errors.New("no rootfile in container")
+
+// entry is a file of the EPUB archive
+type entry struct {
+	name     string
+	content  []byte
+	modified time.Time
+}
+
+// Book is an opened EPUB which can be modified and packaged again
+type Book struct {
+	entries []*entry
+	opfPath string
+	opf     []byte
+}
+
+// Open reads an EPUB archive and locates its package document
+func Open(content []byte) (*Book, error) {
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	book := &Book{}
+	for _, file := range reader.File {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		book.entries = append(book.entries, &entry{name: file.Name, content: data, modified: file.Modified})
+	}
+
+	container := book.file(containerPath)
+	if container == nil {
+		return nil, fmt.Errorf("missing %s", containerPath)
+	}
+	book.opfPath, err = rootfile(container.content)
+	if err != nil {
+		return nil, err
+	}
+	opf := book.file(book.opfPath)
+	if opf == nil {
+		return nil, fmt.Errorf("missing package document %s", book.opfPath)
+	}
+	book.opf = opf.content
+	return book, nil
+}
+
+// rootfile returns the path of the first package document of a container
+func rootfile(container []byte) (string, error) {
+	var parsed struct {
+		Rootfiles []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(container, &parsed); err != nil {
+		return "", fmt.Errorf("%s: %w", containerPath, err)
+	}
+	for _, rootfile := range parsed.Rootfiles {
+		if rootfile.FullPath != "" && (rootfile.MediaType == "" || rootfile.MediaType == "application/oebps-package+xml") {
+			return rootfile.FullPath, nil
+		}
+	}
+	return "", ErrNoRootfile
+}
+
+// file returns an entry of the archive, or nil if it doesn't exist
+func (b *Book) file(name string) *entry {
+	for _, e := range b.entries {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// setFile adds or replaces an entry of the archive
+func (b *Book) setFile(name string, content []byte) {
+	if e := b.file(name); e != nil {
+		e.content = content
+		return
+	}
+	b.entries = append(b.entries, &entry{name: name, content: content, modified: time.Now()})
+}
+
+// removeFile removes an entry of the archive
+func (b *Book) removeFile(name string) {
+	kept := b.entries[:0]
+	for _, e := range b.entries {
+		if e.name != name {
+			kept = append(kept, e)
+		}
+	}
+	b.entries = kept
+}
+
+// resolve returns the archive path of a href relative to the package document
+func (b *Book) resolve(href string) string {
+	if i := strings.IndexAny(href, "#?"); i >= 0 {
+		href = href[:i]
+	}
+	return path.Join(path.Dir(b.opfPath), href)
+}
+
+// Bytes packages the EPUB: the mimetype entry is written first and
+// uncompressed as required by the OCF specification
+func (b *Book) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+
+	mimetype, err := writer.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(mimetype, MimeType); err != nil {
+		return nil, err
+	}
+
+	for _, e := range b.entries {
+		if e.name == "mimetype" {
+			continue
+		}
+		content := e.content
+		if e.name == b.opfPath {
+			content = b.opf
+		}
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.modified}
+		w, err := writer.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
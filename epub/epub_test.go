@@ -0,0 +1,224 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const container = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+const epub2OPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>Old title</dc:title>
+    <dc:creator opf:role="aut">Unknown</dc:creator>
+    <dc:language>en</dc:language>
+    <dc:identifier id="bookid">calibre:1234</dc:identifier>
+    <dc:identifier opf:scheme="ISBN">0000000000</dc:identifier>
+    <meta name="cover" content="old-cover"/>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="chapter1" href="chapter1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="old-cover" href="cover.jpg" media-type="image/jpeg"/>
+  </manifest>
+  <spine toc="ncx">
+    <itemref idref="chapter1"/>
+  </spine>
+</package>`
+
+const epub3OPF = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Old title</dc:title>
+    <dc:creator id="creator">Unknown</dc:creator>
+    <meta refines="#creator" property="file-as">Unknown</meta>
+    <dc:language>en</dc:language>
+    <dc:identifier id="bookid">urn:uuid:0b7e2f5c-4f2b-4d0a-9d5e-3f1c2a6b7d8e</dc:identifier>
+    <meta property="dcterms:modified">2020-01-01T00:00:00Z</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="chapter1" href="chapter1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="old-cover" href="cover.jpg" media-type="image/jpeg" properties="cover-image"/>
+  </manifest>
+  <spine>
+    <itemref idref="chapter1"/>
+  </spine>
+</package>`
+
+const ncx = `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head><meta name="dtb:uid" content="calibre:1234"/></head>
+  <docTitle><text>Old title</text></docTitle>
+  <navMap>
+    <navPoint id="p1" playOrder="1"><navLabel><text>Chapter 1</text></navLabel><content src="chapter1.xhtml"/></navPoint>
+  </navMap>
+</ncx>`
+
+const nav = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>Contents</title></head>
+<body><nav epub:type="toc"><ol><li><a href="chapter1.xhtml">Chapter 1</a></li></ol></nav></body>
+</html>`
+
+const chapter = `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>Chapter 1</title></head>
+<body><p>It was a dark and stormy night.</p></body>
+</html>`
+
+// fixtureFile is an entry of a test EPUB
+type fixtureFile struct {
+	name    string
+	content string
+	method  uint16
+}
+
+// build packages the files in an archive, in the given order
+func build(t *testing.T, files ...fixtureFile) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	writer := zip.NewWriter(buf)
+	for _, f := range files {
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// epub2 returns the files of a small EPUB 2
+func epub2() []fixtureFile {
+	return []fixtureFile{
+		{"mimetype", MimeType, zip.Store},
+		{containerPath, container, zip.Deflate},
+		{"OEBPS/content.opf", epub2OPF, zip.Deflate},
+		{"OEBPS/toc.ncx", ncx, zip.Deflate},
+		{"OEBPS/chapter1.xhtml", chapter, zip.Deflate},
+		{"OEBPS/cover.jpg", "old cover", zip.Store},
+	}
+}
+
+// epub3 returns the files of a small EPUB 3
+func epub3() []fixtureFile {
+	return []fixtureFile{
+		{"mimetype", MimeType, zip.Store},
+		{containerPath, container, zip.Deflate},
+		{"OEBPS/content.opf", epub3OPF, zip.Deflate},
+		{"OEBPS/nav.xhtml", nav, zip.Deflate},
+		{"OEBPS/chapter1.xhtml", chapter, zip.Deflate},
+		{"OEBPS/cover.jpg", "old cover", zip.Store},
+	}
+}
+
+// entries returns the entries of an archive in order
+func entries(t *testing.T, content []byte) []*zip.File {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader.File
+}
+
+// read returns the content of an entry of an archive
+func read(t *testing.T, content []byte, name string) string {
+	t.Helper()
+	for _, f := range entries(t, content) {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	t.Fatalf("no %s in the archive", name)
+	return ""
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []fixtureFile
+		err   string
+	}{
+		{"epub 2", epub2(), ""},
+		{"epub 3", epub3(), ""},
+		{"no container", []fixtureFile{{"mimetype", MimeType, zip.Store}}, "missing " + containerPath},
+		{"no rootfile", []fixtureFile{{containerPath, `<container><rootfiles/></container>`, zip.Deflate}}, ErrNoRootfile.Error()},
+		{"no package document", []fixtureFile{{containerPath, container, zip.Deflate}}, "missing package document OEBPS/content.opf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := Open(build(t, tt.files...))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Open() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.opfPath != "OEBPS/content.opf" {
+				t.Errorf("opfPath = %q, want OEBPS/content.opf", b.opfPath)
+			}
+		})
+	}
+}
+
+func TestOpenNotZip(t *testing.T) {
+	if _, err := Open([]byte("not an archive")); err == nil {
+		t.Error("Open() succeeded on a file which isn't an archive")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	// the mimetype is last and compressed in the source
+	files := epub2()
+	files = append(files[1:], fixtureFile{"mimetype", MimeType, zip.Deflate})
+	b, err := Open(build(t, files...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := entries(t, content)
+	if got[0].Name != "mimetype" || got[0].Method != zip.Store {
+		t.Errorf("first entry = %q with method %d, want an uncompressed mimetype", got[0].Name, got[0].Method)
+	}
+	if len(got) != len(files) {
+		t.Errorf("got %d entries, want %d", len(got), len(files))
+	}
+	if mimetype := read(t, content, "mimetype"); mimetype != MimeType {
+		t.Errorf("mimetype = %q, want %q", mimetype, MimeType)
+	}
+	if chapter1 := read(t, content, "OEBPS/chapter1.xhtml"); chapter1 != chapter {
+		t.Errorf("chapter1.xhtml = %q, want it unchanged", chapter1)
+	}
+}
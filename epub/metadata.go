@@ -0,0 +1,411 @@
+package epub
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/language"
+)
+
+// coverID is the manifest id of the cover embedded by libbot
+const coverID = "libbot-cover"
+
+// ErrNoMetadata is returned when the package document has no metadata element
+var ErrNoMetadata = errors.New("no metadata in package document")
+
+// Creator is an author of the book
+type Creator struct {
+	Name string
+	// FileAs is the name used for sorting, like "Tolkien, J. R. R."
+	FileAs string
+}
+
+// Identifier is an identifier of the book such as an ISBN
+type Identifier struct {
+	Scheme string
+	Value  string
+}
+
+// Metadata contains the fields written in the package document, empty
+// fields are left untouched
+type Metadata struct {
+	Title       string
+	Creators    []Creator
+	Language    string
+	Identifiers []Identifier
+	Series      string
+	SeriesIndex string
+}
+
+// Cover is an image embedded as the book cover
+type Cover struct {
+	Content   []byte
+	MediaType string
+}
+
+// MetadataFromBook builds the metadata to write from a book
+func MetadataFromBook(b book.Book) Metadata {
+	m := Metadata{Title: strings.TrimSpace(b.Title), Series: strings.TrimSpace(b.Series.Name)}
+	if m.Series != "" && b.Series.Index > 0 {
+		m.SeriesIndex = strconv.FormatFloat(b.Series.Index, 'f', -1, 64)
+	}
+	for _, author := range b.Authors {
+		if name := strings.TrimSpace(author.Name); name != "" {
+			m.Creators = append(m.Creators, Creator{Name: name, FileAs: FileAs(name)})
+		}
+	}
+	if l, ok := language.Parse(b.Language); ok {
+		m.Language = l.ID()
+	} else if code := strings.ToLower(strings.TrimSpace(b.Language)); len(code) == 2 || len(code) == 3 {
+		m.Language = code
+	}
+	for _, isbn := range b.ISBNs() {
+		m.Identifiers = append(m.Identifiers, Identifier{Scheme: "ISBN", Value: isbn.ISBN13()})
+	}
+	return m
+}
+
+// particles are the lowercase words belonging to the family name they
+// precede, like "Le" in "Ursula K. Le Guin"
+var particles = map[string]bool{
+	"da": true, "das": true, "de": true, "del": true, "della": true, "den": true,
+	"der": true, "des": true, "di": true, "do": true, "dos": true, "du": true,
+	"la": true, "le": true, "st.": true, "ten": true, "ter": true, "van": true,
+	"von": true,
+}
+
+// suffixes follow the family name, like "Jr." in "Martin Luther King Jr."
+var suffixes = map[string]bool{
+	"jr": true, "jr.": true, "sr": true, "sr.": true, "ii": true, "iii": true, "iv": true,
+}
+
+// FileAs returns the sorting form of a name: "J. R. R. Tolkien" becomes
+// "Tolkien, J. R. R." and "Ursula K. Le Guin" becomes "Le Guin, Ursula K."
+func FileAs(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, ",") {
+		return name
+	}
+	parts := strings.Fields(name)
+	suffix := ""
+	if len(parts) > 2 && suffixes[strings.ToLower(parts[len(parts)-1])] {
+		suffix = ", " + parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 2 {
+		return name
+	}
+	// the family name starts at its particles, one given name is always kept
+	family := len(parts) - 1
+	for family > 1 && particles[strings.ToLower(parts[family-1])] {
+		family--
+	}
+	return strings.Join(parts[family:], " ") + ", " + strings.Join(parts[:family], " ") + suffix
+}
+
+// Rewrite writes metadata and an optional cover in an EPUB and returns the
+// packaged result
+func Rewrite(content []byte, m Metadata, cover *Cover) ([]byte, error) {
+	b, err := Open(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.SetMetadata(m); err != nil {
+		return nil, err
+	}
+	if cover != nil && len(cover.Content) > 0 {
+		if err := b.SetCover(*cover); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes()
+}
+
+// version returns the major EPUB version of the package document
+func (b *Book) version(elements []element) int {
+	pkg := find(elements, -1, "package")
+	if pkg >= 0 && strings.HasPrefix(elements[pkg].attr("version"), "3") {
+		return 3
+	}
+	return 2
+}
+
+// SetMetadata replaces the title, creators, language, identifiers and
+// series of the package document
+func (b *Book) SetMetadata(m Metadata) error {
+	elements, err := scan(b.opf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", b.opfPath, err)
+	}
+	pkg := find(elements, -1, "package")
+	metadata := find(elements, pkg, "metadata")
+	if pkg < 0 || metadata < 0 {
+		return ErrNoMetadata
+	}
+	version := b.version(elements)
+	uniqueID := elements[pkg].attr("unique-identifier")
+	dc, dcBound := prefixFor(elements, []int{pkg, metadata}, dcNamespace)
+	if !dcBound {
+		dc = "dc"
+	}
+	opf, opfBound := prefixFor(elements, []int{pkg, metadata}, opfNamespace)
+	if !opfBound || opf == "" {
+		opf = "opf"
+		opfBound = false
+	}
+
+	// pick the elements replaced by the new metadata
+	removed := map[int]bool{}
+	removedIDs := map[string]bool{}
+	for _, i := range children(elements, metadata) {
+		e := elements[i]
+		drop := false
+		switch {
+		case e.name == "title" && m.Title != "":
+			drop = true
+		case e.name == "creator" && len(m.Creators) > 0:
+			drop = true
+		case e.name == "language" && m.Language != "":
+			drop = true
+		case e.name == "identifier" && len(m.Identifiers) > 0:
+			drop = uniqueID == "" || e.attr("id") != uniqueID
+		case e.name == "meta" && m.Series != "":
+			name, property := e.attr("name"), e.attr("property")
+			drop = name == "calibre:series" || name == "calibre:series_index" || property == "belongs-to-collection"
+		}
+		if drop {
+			removed[i] = true
+			if id := e.attr("id"); id != "" {
+				removedIDs[id] = true
+			}
+		}
+	}
+	// EPUB 3 refinements of removed elements are dropped too
+	for _, i := range children(elements, metadata) {
+		refines := strings.TrimPrefix(elements[i].attr("refines"), "#")
+		if elements[i].name == "meta" && removedIDs[refines] {
+			removed[i] = true
+		}
+	}
+
+	edits := []edit{}
+	for i := range removed {
+		edits = append(edits, removal(b.opf, elements[i]))
+	}
+
+	indent := indentation(b.opf, elements, metadata)
+	dcAttr := ""
+	if !dcBound {
+		dcAttr = ` xmlns:dc="` + dcNamespace + `"`
+	}
+	opfAttr := ""
+	if !opfBound {
+		opfAttr = ` xmlns:opf="` + opfNamespace + `"`
+	}
+	var added strings.Builder
+	if m.Title != "" {
+		fmt.Fprintf(&added, "%s<%s:title%s>%s</%s:title>", indent, dc, dcAttr, escape(m.Title), dc)
+	}
+	for i, creator := range m.Creators {
+		id := fmt.Sprintf("libbot-creator%d", i+1)
+		if version >= 3 {
+			fmt.Fprintf(&added, `%s<%s:creator%s id="%s">%s</%s:creator>`, indent, dc, dcAttr, id, escape(creator.Name), dc)
+			if creator.FileAs != "" {
+				fmt.Fprintf(&added, `%s<meta refines="#%s" property="file-as">%s</meta>`, indent, id, escape(creator.FileAs))
+			}
+			fmt.Fprintf(&added, `%s<meta refines="#%s" property="role" scheme="marc:relators">aut</meta>`, indent, id)
+			continue
+		}
+		fmt.Fprintf(&added, `%s<%s:creator%s%s %s:role="aut"`, indent, dc, dcAttr, opfAttr, opf)
+		if creator.FileAs != "" {
+			fmt.Fprintf(&added, ` %s:file-as="%s"`, opf, escape(creator.FileAs))
+		}
+		fmt.Fprintf(&added, ">%s</%s:creator>", escape(creator.Name), dc)
+	}
+	if m.Language != "" {
+		fmt.Fprintf(&added, "%s<%s:language%s>%s</%s:language>", indent, dc, dcAttr, escape(m.Language), dc)
+	}
+	for _, identifier := range m.Identifiers {
+		if version >= 3 {
+			value := identifier.Value
+			if strings.EqualFold(identifier.Scheme, "isbn") && !strings.HasPrefix(value, "urn:") {
+				value = "urn:isbn:" + value
+			}
+			fmt.Fprintf(&added, "%s<%s:identifier%s>%s</%s:identifier>", indent, dc, dcAttr, escape(value), dc)
+			continue
+		}
+		fmt.Fprintf(&added, `%s<%s:identifier%s%s %s:scheme="%s">%s</%s:identifier>`,
+			indent, dc, dcAttr, opfAttr, opf, escape(identifier.Scheme), escape(identifier.Value), dc)
+	}
+	if m.Series != "" {
+		fmt.Fprintf(&added, `%s<meta name="calibre:series" content="%s"/>`, indent, escape(m.Series))
+		if m.SeriesIndex != "" {
+			fmt.Fprintf(&added, `%s<meta name="calibre:series_index" content="%s"/>`, indent, escape(m.SeriesIndex))
+		}
+		if version >= 3 {
+			fmt.Fprintf(&added, `%s<meta property="belongs-to-collection" id="libbot-series">%s</meta>`, indent, escape(m.Series))
+			fmt.Fprintf(&added, `%s<meta refines="#libbot-series" property="collection-type">series</meta>`, indent)
+			if m.SeriesIndex != "" {
+				fmt.Fprintf(&added, `%s<meta refines="#libbot-series" property="group-position">%s</meta>`, indent, escape(m.SeriesIndex))
+			}
+		}
+	}
+	if elements[metadata].contentStart == elements[metadata].end {
+		// <metadata/> is turned into an element with content
+		e := elements[metadata]
+		edits = append(edits, edit{start: e.start, end: e.end,
+			replacement: startTag(e, e.attrs, false) + added.String() + "\n  </" + qualified(e.prefix, e.name) + ">"})
+	} else {
+		edits = append(edits, insertion(b.opf, elements[metadata], added.String()))
+	}
+	b.opf = applyEdits(b.opf, edits)
+	return nil
+}
+
+// insertion returns an edit adding content at the end of an element,
+// before the indentation of its closing tag
+func insertion(document []byte, e element, content string) edit {
+	position := e.contentEnd
+	for position > e.contentStart && strings.ContainsRune(" \t\r\n", rune(document[position-1])) {
+		position--
+	}
+	return edit{start: position, end: position, replacement: content}
+}
+
+// SetCover embeds an image as the cover of the book
+func (b *Book) SetCover(cover Cover) error {
+	elements, err := scan(b.opf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", b.opfPath, err)
+	}
+	pkg := find(elements, -1, "package")
+	metadata := find(elements, pkg, "metadata")
+	manifest := find(elements, pkg, "manifest")
+	if metadata < 0 || manifest < 0 {
+		return ErrNoMetadata
+	}
+	mediaType := cover.MediaType
+	if mediaType == "" {
+		mediaType = "image/jpeg"
+	}
+	extension := ".jpg"
+	switch mediaType {
+	case "image/png":
+		extension = ".png"
+	case "image/gif":
+		extension = ".gif"
+	}
+	version := b.version(elements)
+	href := coverID + extension
+
+	edits := []edit{}
+	previous := ""
+	for _, i := range children(elements, manifest) {
+		e := elements[i]
+		if e.attr("id") == coverID {
+			previous = b.resolve(e.attr("href"))
+			edits = append(edits, removal(b.opf, e))
+			continue
+		}
+		properties := strings.Fields(e.attr("properties"))
+		kept := []string{}
+		for _, property := range properties {
+			if property != "cover-image" {
+				kept = append(kept, property)
+			}
+		}
+		if len(kept) == len(properties) {
+			continue
+		}
+		attrs := []xml.Attr{}
+		for _, a := range e.attrs {
+			if a.Name.Local == "properties" {
+				if len(kept) == 0 {
+					continue
+				}
+				a.Value = strings.Join(kept, " ")
+			}
+			attrs = append(attrs, a)
+		}
+		edits = append(edits, edit{start: e.start, end: e.contentStart,
+			replacement: startTag(e, attrs, e.contentStart == e.end)})
+	}
+	for _, i := range children(elements, metadata) {
+		if elements[i].name == "meta" && elements[i].attr("name") == "cover" {
+			edits = append(edits, removal(b.opf, elements[i]))
+		}
+	}
+
+	item := fmt.Sprintf(`<item id="%s" href="%s" media-type="%s"`, coverID, href, mediaType)
+	if version >= 3 {
+		item += ` properties="cover-image"`
+	}
+	edits = append(edits,
+		insertion(b.opf, elements[manifest], indentation(b.opf, elements, manifest)+item+"/>"),
+		insertion(b.opf, elements[metadata], indentation(b.opf, elements, metadata)+
+			fmt.Sprintf(`<meta name="cover" content="%s"/>`, coverID)))
+	b.opf = applyEdits(b.opf, edits)
+
+	if previous != "" {
+		b.removeFile(previous)
+	}
+	b.setFile(b.resolve(href), cover.Content)
+	return nil
+}
+
+// ReadMetadata returns the metadata written in the package document of an
+// EPUB
+func ReadMetadata(content []byte) (Metadata, error) {
+	b, err := Open(content)
+	if err != nil {
+		return Metadata{}, err
+	}
+	elements, err := scan(b.opf)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("%s: %w", b.opfPath, err)
+	}
+	metadata := find(elements, find(elements, -1, "package"), "metadata")
+	if metadata < 0 {
+		return Metadata{}, ErrNoMetadata
+	}
+	m := Metadata{}
+	fileAs := map[string]string{}
+	creatorIDs := map[int]string{}
+	for _, i := range children(elements, metadata) {
+		e := elements[i]
+		text := strings.TrimSpace(e.text)
+		switch {
+		case e.name == "title" && m.Title == "":
+			m.Title = text
+		case e.name == "creator":
+			creatorIDs[len(m.Creators)] = e.attr("id")
+			m.Creators = append(m.Creators, Creator{Name: text, FileAs: e.attr("file-as")})
+		case e.name == "language" && m.Language == "":
+			m.Language = text
+		case e.name == "identifier":
+			scheme := e.attr("scheme")
+			if strings.HasPrefix(strings.ToLower(text), "urn:isbn:") {
+				scheme, text = "ISBN", text[len("urn:isbn:"):]
+			}
+			m.Identifiers = append(m.Identifiers, Identifier{Scheme: scheme, Value: text})
+		case e.name == "meta" && e.attr("name") == "calibre:series":
+			m.Series = e.attr("content")
+		case e.name == "meta" && e.attr("name") == "calibre:series_index":
+			m.SeriesIndex = e.attr("content")
+		case e.name == "meta" && e.attr("property") == "belongs-to-collection" && m.Series == "":
+			m.Series = text
+		case e.name == "meta" && e.attr("property") == "file-as":
+			fileAs[strings.TrimPrefix(e.attr("refines"), "#")] = text
+		}
+	}
+	for i, id := range creatorIDs {
+		if as, ok := fileAs[id]; ok && id != "" && m.Creators[i].FileAs == "" {
+			m.Creators[i].FileAs = as
+		}
+	}
+	return m, nil
+}
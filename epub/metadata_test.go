@@ -0,0 +1,154 @@
+package epub
+
+import (
+	"archive/zip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/geobeau/Libbot/book"
+)
+
+func TestFileAs(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"J. R. R. Tolkien", "Tolkien, J. R. R."},
+		{"Ursula K. Le Guin", "Le Guin, Ursula K."},
+		{"Ludwig van Beethoven", "van Beethoven, Ludwig"},
+		{"Charles de la Fontaine", "de la Fontaine, Charles"},
+		{"Martin Luther King Jr.", "King, Martin Luther, Jr."},
+		{"Henry Ford II", "Ford, Henry, II"},
+		{"Le Corbusier", "Corbusier, Le"},
+		{"Tolkien, J. R. R.", "Tolkien, J. R. R."},
+		{" Homer ", "Homer"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := FileAs(tt.name); got != tt.want {
+			t.Errorf("FileAs(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMetadataFromBook(t *testing.T) {
+	b := book.Book{
+		Title:    " The Left Hand of Darkness ",
+		Authors:  []book.Author{{Name: "Ursula K. Le Guin"}, {Name: " "}},
+		Language: "English",
+		Series:   book.Series{Name: "Hainish Cycle", Index: 4},
+		Identifiers: []book.Identifier{
+			{Scheme: book.ISBN, Value: "0441478123"},
+		},
+	}
+	want := Metadata{
+		Title:       "The Left Hand of Darkness",
+		Creators:    []Creator{{Name: "Ursula K. Le Guin", FileAs: "Le Guin, Ursula K."}},
+		Language:    "en",
+		Identifiers: []Identifier{{Scheme: "ISBN", Value: "9780441478125"}},
+		Series:      "Hainish Cycle",
+		SeriesIndex: "4",
+	}
+	if got := MetadataFromBook(b); !reflect.DeepEqual(got, want) {
+		t.Errorf("MetadataFromBook() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	m := Metadata{
+		Title:       "The Left Hand of Darkness",
+		Creators:    []Creator{{Name: "Ursula K. Le Guin", FileAs: "Le Guin, Ursula K."}},
+		Language:    "en",
+		Identifiers: []Identifier{{Scheme: "ISBN", Value: "9780441478125"}},
+		Series:      "Hainish Cycle",
+		SeriesIndex: "4",
+	}
+	cover := &Cover{Content: []byte("new cover"), MediaType: "image/png"}
+	tests := []struct {
+		name  string
+		files []fixtureFile
+		// unique is the identifier of the book kept by the rewrite
+		unique Identifier
+	}{
+		{"epub 2", epub2(), Identifier{Value: "calibre:1234"}},
+		{"epub 3", epub3(), Identifier{Value: "urn:uuid:0b7e2f5c-4f2b-4d0a-9d5e-3f1c2a6b7d8e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			once, err := Rewrite(build(t, tt.files...), m, cover)
+			if err != nil {
+				t.Fatal(err)
+			}
+			twice, err := Rewrite(once, m, cover)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opf := read(t, twice, "OEBPS/content.opf")
+			if first := read(t, once, "OEBPS/content.opf"); opf != first {
+				t.Errorf("second rewrite changed the package document:\n%s\nwant:\n%s", opf, first)
+			}
+			files := entries(t, twice)
+			if files[0].Name != "mimetype" || files[0].Method != zip.Store {
+				t.Errorf("first entry = %q with method %d, want an uncompressed mimetype", files[0].Name, files[0].Method)
+			}
+			if len(files) != len(tt.files)+1 {
+				t.Errorf("got %d entries, want %d", len(files), len(tt.files)+1)
+			}
+			for _, s := range []string{`<item id="libbot-cover"`, `<meta name="cover" content="libbot-cover"/>`, `name="cover"`} {
+				if n := strings.Count(opf, s); n != 1 {
+					t.Errorf("%s found %d times in:\n%s", s, n, opf)
+				}
+			}
+			if n := strings.Count(opf, "cover-image"); tt.name == "epub 3" && n != 1 {
+				t.Errorf("cover-image found %d times in:\n%s", n, opf)
+			}
+			if got := read(t, twice, "OEBPS/libbot-cover.png"); got != "new cover" {
+				t.Errorf("cover = %q, want %q", got, "new cover")
+			}
+
+			got, err := ReadMetadata(twice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := m
+			want.Identifiers = append([]Identifier{tt.unique}, m.Identifiers...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ReadMetadata() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRewriteWithoutCover(t *testing.T) {
+	content, err := Rewrite(build(t, epub2()...), Metadata{Title: "New title"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMetadata(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the title is replaced
+	want := Metadata{
+		Title:       "New title",
+		Creators:    []Creator{{Name: "Unknown"}},
+		Language:    "en",
+		Identifiers: []Identifier{{Value: "calibre:1234"}, {Scheme: "ISBN", Value: "0000000000"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadMetadata() = %+v, want %+v", got, want)
+	}
+	if opf := read(t, content, "OEBPS/content.opf"); !strings.Contains(opf, `<meta name="cover" content="old-cover"/>`) {
+		t.Errorf("the cover was changed:\n%s", opf)
+	}
+}
+
+func TestReadMetadataNoMetadata(t *testing.T) {
+	files := epub2()
+	files[2].content = `<package xmlns="http://www.idpf.org/2007/opf" version="2.0"><manifest/></package>`
+	if _, err := ReadMetadata(build(t, files...)); err != ErrNoMetadata {
+		t.Errorf("ReadMetadata() error = %v, want %v", err, ErrNoMetadata)
+	}
+}
@@ -0,0 +1,203 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Namespaces used in package documents
+const (
+	dcNamespace  = "http://purl.org/dc/elements/1.1/"
+	opfNamespace = "http://www.idpf.org/2007/opf"
+)
+
+// element is an element of the package document along with its position,
+// positions are byte offsets so untouched parts are kept as is
+type element struct {
+	prefix string
+	name   string
+	attrs  []xml.Attr
+	text   string
+	depth  int
+	parent int
+	// start and end delimit the whole element, contentStart and contentEnd
+	// delimit what is between its tags
+	start, end               int
+	contentStart, contentEnd int
+}
+
+func (e element) attr(name string) string {
+	for _, a := range e.attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// scan lists the elements of a document in order of appearance
+func scan(document []byte) ([]element, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	decoder.Strict = false
+	// offsets are computed on the raw bytes so the charset doesn't matter
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	elements := []element{}
+	stack := []int{}
+	for {
+		offset := int(decoder.InputOffset())
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return elements, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := -1
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			elements = append(elements, element{
+				prefix:       t.Name.Space,
+				name:         t.Name.Local,
+				attrs:        t.Copy().Attr,
+				depth:        len(stack),
+				parent:       parent,
+				start:        offset,
+				contentStart: int(decoder.InputOffset()),
+			})
+			stack = append(stack, len(elements)-1)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			current := &elements[stack[len(stack)-1]]
+			current.contentEnd = offset
+			current.end = int(decoder.InputOffset())
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				elements[stack[len(stack)-1]].text += string(t)
+			}
+		}
+	}
+}
+
+// find returns the index of the first element with the given local name
+// whose parent is parent (or any parent if -1)
+func find(elements []element, parent int, name string) int {
+	for i, e := range elements {
+		if e.name == name && (parent < 0 || e.parent == parent) {
+			return i
+		}
+	}
+	return -1
+}
+
+// children returns the indexes of the direct children of an element
+func children(elements []element, parent int) []int {
+	indexes := []int{}
+	for i, e := range elements {
+		if e.parent == parent {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// prefixFor returns the prefix bound to a namespace by one of the given
+// elements, or an empty string and false if none is bound
+func prefixFor(elements []element, indexes []int, namespace string) (string, bool) {
+	for _, i := range indexes {
+		if i < 0 {
+			continue
+		}
+		for _, a := range elements[i].attrs {
+			if a.Name.Space == "xmlns" && a.Value == namespace {
+				return a.Name.Local, true
+			}
+		}
+	}
+	return "", false
+}
+
+// edit replaces a range of a document
+type edit struct {
+	start, end  int
+	replacement string
+}
+
+// applyEdits applies non overlapping edits to a document
+func applyEdits(document []byte, edits []edit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	result := append([]byte{}, document...)
+	for _, e := range edits {
+		tail := append([]byte(e.replacement), result[e.end:]...)
+		result = append(result[:e.start], tail...)
+	}
+	return result
+}
+
+// removal returns an edit removing an element along with the indentation
+// preceding it
+func removal(document []byte, e element) edit {
+	start := e.start
+	for start > 0 && (document[start-1] == ' ' || document[start-1] == '\t') {
+		start--
+	}
+	if start > 0 && document[start-1] == '\n' {
+		start--
+		if start > 0 && document[start-1] == '\r' {
+			start--
+		}
+	}
+	return edit{start: start, end: e.end}
+}
+
+// indentation returns the whitespace preceding the first child of an
+// element, used to lay out inserted elements like the existing ones
+func indentation(document []byte, elements []element, parent int) string {
+	for _, i := range children(elements, parent) {
+		start := elements[i].start
+		line := bytes.LastIndexByte(document[:start], '\n')
+		if line >= 0 && strings.TrimSpace(string(document[line:start])) == "" {
+			return string(document[line:start])
+		}
+		return ""
+	}
+	return "\n    "
+}
+
+// startTag renders the start tag of an element with new attributes
+func startTag(e element, attrs []xml.Attr, selfClosing bool) string {
+	var builder strings.Builder
+	builder.WriteString("<" + qualified(e.prefix, e.name))
+	for _, a := range attrs {
+		builder.WriteString(" " + qualified(a.Name.Space, a.Name.Local) + `="` + escape(a.Value) + `"`)
+	}
+	if selfClosing {
+		builder.WriteString("/>")
+	} else {
+		builder.WriteString(">")
+	}
+	return builder.String()
+}
+
+func qualified(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + ":" + name
+}
+
+func escape(s string) string {
+	buf := new(bytes.Buffer)
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
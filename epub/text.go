@@ -0,0 +1,80 @@
+package epub
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// skippedElements hold no text of the book
+var skippedElements = map[string]bool{"head": true, "script": true, "style": true}
+
+// Text returns the text of the documents of the spine in reading order, up
+// to max bytes. It is meant to detect the language of a book
+func Text(content []byte, max int) (string, error) {
+	b, err := Open(content)
+	if err != nil {
+		return "", err
+	}
+	elements, err := scan(b.opf)
+	if err != nil {
+		return "", err
+	}
+	items := map[string]manifestItem{}
+	for _, item := range b.manifest(elements) {
+		items[item.id] = item
+	}
+	spine := find(elements, find(elements, -1, "package"), "spine")
+	if spine < 0 {
+		return "", nil
+	}
+	var text strings.Builder
+	for _, i := range children(elements, spine) {
+		item, ok := items[elements[i].attr("idref")]
+		if elements[i].name != "itemref" || !ok || !isText(item.mediaType) {
+			continue
+		}
+		if file := b.file(item.path); file != nil {
+			documentText(&text, file.content, max)
+		}
+		if text.Len() >= max {
+			break
+		}
+	}
+	return text.String(), nil
+}
+
+// documentText appends the text of an XHTML document, the parsing is
+// lenient as many books have broken markup
+func documentText(text *strings.Builder, document []byte, max int) {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+	skipped := 0
+	for text.Len() < max {
+		token, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skipped > 0 || skippedElements[strings.ToLower(t.Name.Local)] {
+				skipped++
+			}
+		case xml.EndElement:
+			if skipped > 0 {
+				skipped--
+			}
+		case xml.CharData:
+			if skipped == 0 {
+				if chunk := strings.TrimSpace(string(t)); chunk != "" {
+					text.WriteString(chunk)
+					text.WriteByte(' ')
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/quota"
+	"github.com/geobeau/Libbot/scraper"
+	"github.com/geobeau/Libbot/storage"
+	"github.com/geobeau/Libbot/throttle"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// notificationAction counts the new release notifications in the usage of a
+// user, it isn't rate limited like the user actions
+const notificationAction = "notification"
+
+// maxNotifiedBooks is the number of new books listed in a notification
+const maxNotifiedBooks = 5
+
+// unfollowButton stops following, its data is the follow id
+var unfollowButton = tb.InlineButton{Unique: "unfollow_button"}
+
+// matches tells if a book found by the search of a follow belongs to the
+// followed author or series. The sources don't give the series, the title of
+// the books of a series usually contains its name
+func matches(follow storage.Follow, b book.Book) bool {
+	name := strings.ToLower(follow.Name)
+	if follow.Kind == storage.FollowAuthor {
+		return strings.Contains(strings.ToLower(b.Author()), name)
+	}
+	return strings.Contains(strings.ToLower(b.Title), name)
+}
+
+// handleFollow follows an author or a series: /follow author:<name> or
+// /follow series:<name>. Without argument it lists the follows
+func (a *app) handleFollow(ctx context.Context, m *tb.Message) {
+	if a.cfg.Follow.Interval <= 0 {
+		a.bot.Send(m.Sender, "New releases aren't checked on this bot")
+		return
+	}
+	payload := strings.TrimSpace(m.Payload)
+	if payload == "" {
+		a.listFollows(m.Sender)
+		return
+	}
+	parts := strings.SplitN(payload, ":", 2)
+	kind := strings.ToLower(strings.TrimSpace(parts[0]))
+	if len(parts) != 2 || (kind != storage.FollowAuthor && kind != storage.FollowSeries) {
+		a.bot.Send(m.Sender, "Usage: /follow author:<name> or /follow series:<name>")
+		return
+	}
+	follow, err := a.store.AddFollow(m.Sender.ID, kind, parts[1])
+	if err != nil {
+		a.bot.Send(m.Sender, fmt.Sprintf("Failed to follow: %v", err))
+		return
+	}
+	logger.InfoContext(ctx, "Following", "kind", follow.Kind)
+	a.bot.Send(m.Sender, fmt.Sprintf("You follow the %s %s, you will be told about its new books", follow.Kind, follow.Name))
+}
+
+// listFollows sends the follows of a user with buttons to stop following
+func (a *app) listFollows(user *tb.User) {
+	follows := a.store.Follows(user.ID)
+	if len(follows) == 0 {
+		a.bot.Send(user, "You follow nothing yet, use /follow author:<name> or /follow series:<name>")
+		return
+	}
+	keyboard := [][]tb.InlineButton{}
+	for _, follow := range follows {
+		button := unfollowButton
+		button.Text = fmt.Sprintf("Unfollow the %s %s", follow.Kind, follow.Name)
+		button.Data = strconv.Itoa(follow.ID)
+		keyboard = append(keyboard, []tb.InlineButton{button})
+	}
+	a.bot.Send(user, "You follow:", &tb.ReplyMarkup{InlineKeyboard: keyboard})
+}
+
+// unfollow stops following an author or a series
+func (a *app) unfollow(ctx context.Context, c *tb.Callback) {
+	id, _ := strconv.Atoi(c.Data)
+	if err := a.store.RemoveFollow(c.Sender.ID, id); err != nil {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Already unfollowed"})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Unfollowed"})
+	a.bot.Delete(c.Message)
+	a.listFollows(c.Sender)
+}
+
+// watchFollows searches the followed authors and series periodically until
+// the context is cancelled
+func (a *app) watchFollows(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.checkFollows(ctx)
+		}
+	}
+}
+
+// checkFollows searches the followed authors and series and tells their
+// followers about the new books. Each name is searched once whoever follows
+// it. The check stops when the source is unavailable
+func (a *app) checkFollows(ctx context.Context) {
+	ctx = logging.WithRequestID(ctx, logging.NewRequestID())
+	all := a.store.AllFollows()
+	users := []int{}
+	for userID := range all {
+		users = append(users, userID)
+	}
+	sort.Ints(users)
+	logger.InfoContext(ctx, "Checking follows", "users", len(users))
+	searches := map[string][]book.Book{}
+	for _, userID := range users {
+		for _, follow := range all[userID] {
+			query := strings.ToLower(follow.Name)
+			books, ok := searches[query]
+			if !ok {
+				var err error
+				books, err = scraper.SearchBooks(ctx, follow.Name)
+				if errors.Is(err, throttle.ErrOpen) || ctx.Err() != nil {
+					logger.WarnContext(ctx, "Follow check interrupted", logging.Err(err))
+					return
+				}
+				if err != nil {
+					logger.ErrorContext(ctx, "Follow search failed", logging.Err(err))
+					continue
+				}
+				searches[query] = books
+			}
+			a.checkFollow(ctx, userID, follow, books)
+		}
+	}
+}
+
+// checkFollow compares the books found for a follow with the ones already
+// seen and notifies the user of the new ones
+func (a *app) checkFollow(ctx context.Context, userID int, follow storage.Follow, books []book.Book) {
+	found, fresh := []string{}, []book.Book{}
+	for _, b := range books {
+		if !matches(follow, b) {
+			continue
+		}
+		found = append(found, b.ID)
+		if !contains(follow.Seen, b.ID) {
+			fresh = append(fresh, b)
+		}
+	}
+	if err := a.store.MarkSeen(userID, follow.ID, found, time.Now()); err != nil {
+		logger.ErrorContext(ctx, "Failed to save follow", logging.Err(err))
+		return
+	}
+	// the first search only records the books already out
+	if follow.Checked.IsZero() || len(fresh) == 0 {
+		return
+	}
+	limit := quota.Limit{Daily: a.cfg.Follow.Notifications}
+	if _, err := a.store.Consume(userID, notificationAction, limit, time.Now()); err != nil {
+		logger.InfoContext(ctx, "Notification skipped", logging.User(userID), logging.Err(err))
+		return
+	}
+	if len(fresh) > maxNotifiedBooks {
+		fresh = fresh[:maxNotifiedBooks]
+	}
+	lines := []string{fmt.Sprintf("New for the %s %s:", follow.Kind, follow.Name)}
+	keyboard := [][]tb.InlineButton{}
+	for i, b := range fresh {
+		lines = append(lines, fmt.Sprintf("%d. %s - %s", i+1, b.Title, b.Author()))
+		download := downloadButton
+		download.Text = fmt.Sprintf("%d. %s", i+1, download.Text)
+		download.Data = b.ID
+		keyboard = append(keyboard, []tb.InlineButton{download})
+	}
+	if _, err := a.bot.Send(&tb.User{ID: userID}, strings.Join(lines, "\n"), &tb.ReplyMarkup{InlineKeyboard: keyboard}); err != nil {
+		logger.WarnContext(ctx, "Failed to notify", logging.User(userID), logging.Err(err))
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+
+	"github.com/geobeau/Libbot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// forgetMe deletes everything the bot stored about a user
+func (a *app) forgetMe(ctx context.Context, m *tb.Message) {
+	if err := a.store.ForgetUser(m.Sender.ID); err != nil {
+		logger.ErrorContext(ctx, "Failed to delete user data", logging.Err(err))
+		a.bot.Send(m.Sender, "Failed to delete your data, please try again")
+		return
+	}
+	a.uploads.forget(m.Sender.ID)
+	logger.InfoContext(ctx, "Deleted user data", logging.User(m.Sender.ID))
+	a.bot.Send(m.Sender, "All your data (settings, pending requests and sent files) has been deleted")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/quota"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// historyPageSize is the number of deliveries shown per page of /history
+const historyPageSize = 5
+
+// Buttons of /history. The data of the page button is the page, the data of
+// the others is the delivery id and the page showing it
+var (
+	historyPageButton    = tb.InlineButton{Unique: "history_page_button"}
+	historyResendButton  = tb.InlineButton{Unique: "history_resend_button"}
+	historyConvertButton = tb.InlineButton{Unique: "history_convert_button"}
+	historyDeleteButton  = tb.InlineButton{Unique: "history_delete_button"}
+)
+
+// recordDeliveries adds the files delivered by a job to the history of its
+// user. The uploads skipped after a restart are not recorded, their
+// reference is unknown
+func (a *app) recordDeliveries(ctx context.Context, job storage.Job, result pipeline.Result) {
+	for _, outcome := range result.Outcomes {
+		uploaded := outcome.Stage == pipeline.UploadOriginal || outcome.Stage == pipeline.UploadConverted
+		if !uploaded || outcome.Status != pipeline.Succeeded || outcome.Detail != "" {
+			continue
+		}
+		delivery := storage.Delivery{
+			Kind:     job.Kind,
+			Book:     outcome.File.Book,
+			Filename: outcome.File.Name,
+			Format:   strings.TrimPrefix(strings.ToLower(filepath.Ext(outcome.File.Name)), "."),
+		}
+		switch job.Kind {
+		case jobDownload:
+			delivery.BookID = job.BookID
+			delivery.FileID = outcome.Ref
+		case jobConvert:
+			delivery.FileID = outcome.Ref
+		default:
+			delivery.BookID = job.BookID
+		}
+		_, err := a.store.AddDelivery(job.UserID, delivery)
+		switch {
+		case errors.Is(err, storage.ErrForgotten):
+			logger.DebugContext(ctx, "Delivery of a forgotten user dropped", "job", job.ID)
+			return
+		case err != nil:
+			logger.ErrorContext(ctx, "Failed to save delivery", logging.Err(err))
+		}
+	}
+}
+
+// historyPage describes a page of the history of a user
+func (a *app) historyPage(userID, page int) (string, *tb.ReplyMarkup) {
+	history := a.store.History(userID)
+	if len(history) == 0 {
+		return "Your history is empty, the books you get are listed here", &tb.ReplyMarkup{}
+	}
+	page, pages, start, end := paginate(len(history), historyPageSize, page)
+	entries := history[start:end]
+	lines := []string{fmt.Sprintf("Your books (page %d/%d):", page+1, pages)}
+	keyboard := [][]tb.InlineButton{}
+	for i, delivery := range entries {
+		number := page*historyPageSize + i + 1
+		author := ""
+		if name := delivery.Book.Author(); name != "" {
+			author = " - " + name
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s%s\n%s, %s on %s", number, delivery.Book.Title, author,
+			strings.ToUpper(delivery.Format), delivery.Kind, delivery.Delivered.Format("2006-01-02")))
+
+		data := fmt.Sprintf("%d|%d", delivery.ID, page)
+		row := []tb.InlineButton{}
+		if delivery.FileID != "" || delivery.BookID != "" {
+			resend := historyResendButton
+			resend.Text, resend.Data = "Send again", data
+			row = append(row, resend)
+		}
+		if delivery.FileID != "" {
+			convert := historyConvertButton
+			convert.Text, convert.Data = "Convert", data
+			row = append(row, convert)
+		}
+		remove := historyDeleteButton
+		remove.Text, remove.Data = "Delete", data
+		row = append(row, remove)
+		row[0].Text = fmt.Sprintf("%d. %s", number, row[0].Text)
+		keyboard = append(keyboard, row)
+	}
+	if navigation := pageButtons(historyPageButton, page, pages, strconv.Itoa); len(navigation) > 0 {
+		keyboard = append(keyboard, navigation)
+	}
+	return strings.Join(lines, "\n"), &tb.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+// paginate returns the page to show, clamped to the existing pages, the
+// number of pages and the bounds of the items of the page
+func paginate(total, size, page int) (int, int, int, int) {
+	pages := (total + size - 1) / size
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+	start := page * size
+	end := start + size
+	if end > total {
+		end = total
+	}
+	return page, pages, start, end
+}
+
+// pageButtons returns the buttons going to the previous and the next pages,
+// data gives the data of the button showing a page
+func pageButtons(button tb.InlineButton, page, pages int, data func(page int) string) []tb.InlineButton {
+	buttons := []tb.InlineButton{}
+	if page > 0 {
+		previous := button
+		previous.Text, previous.Data = "« Previous", data(page-1)
+		buttons = append(buttons, previous)
+	}
+	if page+1 < pages {
+		next := button
+		next.Text, next.Data = "Next »", data(page+1)
+		buttons = append(buttons, next)
+	}
+	return buttons
+}
+
+// handleHistory shows the first page of the history of a user
+func (a *app) handleHistory(ctx context.Context, m *tb.Message) {
+	text, markup := a.historyPage(m.Sender.ID, 0)
+	a.bot.Send(m.Sender, text, markup)
+}
+
+// showHistoryPage shows another page of the history
+func (a *app) showHistoryPage(ctx context.Context, c *tb.Callback) {
+	page, _ := strconv.Atoi(c.Data)
+	text, markup := a.historyPage(c.Sender.ID, page)
+	a.bot.Respond(c, &tb.CallbackResponse{})
+	a.bot.Edit(c.Message, text, markup)
+}
+
+// historyDelivery returns the delivery of a history button and the page
+// showing it
+func (a *app) historyDelivery(c *tb.Callback) (storage.Delivery, int, bool) {
+	parts := strings.SplitN(c.Data, "|", 2)
+	id, err := strconv.Atoi(parts[0])
+	page := 0
+	if len(parts) == 2 {
+		page, _ = strconv.Atoi(parts[1])
+	}
+	delivery, ok := a.store.Delivery(c.Sender.ID, id)
+	if err != nil || !ok {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "This entry was deleted"})
+		return storage.Delivery{}, page, false
+	}
+	return delivery, page, true
+}
+
+// resendDelivery sends a file of the history again: files sent on telegram
+// are sent right away, the others are delivered again
+func (a *app) resendDelivery(ctx context.Context, c *tb.Callback) {
+	delivery, _, ok := a.historyDelivery(c)
+	if !ok {
+		return
+	}
+	if delivery.FileID != "" {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Sending " + delivery.Filename})
+		document := &tb.Document{File: tb.File{FileID: delivery.FileID}, FileName: delivery.Filename}
+		if _, err := a.bot.Send(c.Sender, document); err != nil {
+			logger.ErrorContext(ctx, "Failed to send again", logging.Err(err))
+			a.bot.Send(c.Sender, "Failed to send the file again, it may have expired")
+		}
+		return
+	}
+	if !a.allow(ctx, c.Sender, quota.Download) {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Try again later"})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Sending again..."})
+	job := storage.Job{UserID: c.Sender.ID, Kind: delivery.Kind, BookID: delivery.BookID, Formats: []string{delivery.Format}}
+	if err := a.submit(ctx, job).Err(); err != nil {
+		logger.ErrorContext(ctx, "Delivery failed", logging.Err(err))
+	}
+}
+
+// convertDelivery offers to convert a file of the history to another format
+func (a *app) convertDelivery(ctx context.Context, c *tb.Callback) {
+	delivery, _, ok := a.historyDelivery(c)
+	if !ok {
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{})
+	key := fmt.Sprintf("h%d-%d", c.Sender.ID, delivery.ID)
+	a.uploads.add(key, upload{
+		userID: c.Sender.ID,
+		file:   tb.File{FileID: delivery.FileID},
+		name:   delivery.Filename,
+		book:   delivery.Book,
+	})
+	a.bot.Send(c.Sender, "Convert "+delivery.Filename+" to:", &tb.ReplyMarkup{
+		InlineKeyboard: [][]tb.InlineButton{convertButtons(key, "."+delivery.Format)},
+	})
+}
+
+// deleteDelivery removes an entry of the history
+func (a *app) deleteDelivery(ctx context.Context, c *tb.Callback) {
+	delivery, page, ok := a.historyDelivery(c)
+	if !ok {
+		return
+	}
+	if err := a.store.RemoveDelivery(c.Sender.ID, delivery.ID); err != nil {
+		logger.ErrorContext(ctx, "Failed to delete delivery", logging.Err(err))
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Failed to delete the entry"})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Deleted"})
+	text, markup := a.historyPage(c.Sender.ID, page)
+	a.bot.Edit(c.Message, text, markup)
+}
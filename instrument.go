@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/geobeau/Libbot/config"
+	"github.com/geobeau/Libbot/jobs"
+	"github.com/geobeau/Libbot/metrics"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/quota"
+	"github.com/geobeau/Libbot/throttle"
+)
+
+var (
+	searchesTotal = metrics.NewCounterVec("libbot_searches_total",
+		"Searches by result.", "result")
+	jobsTotal = metrics.NewCounterVec("libbot_jobs_total",
+		"Downloads and conversions by kind and result.", "kind", "result")
+	conversionsTotal = metrics.NewCounterVec("libbot_conversions_total",
+		"Conversions by target format and result.", "format", "result")
+	conversionDuration = metrics.NewHistogramVec("libbot_conversion_duration_seconds",
+		"Duration of the conversions by target format.", metrics.DefBuckets, "format")
+	sourceDuration = metrics.NewHistogramVec("libbot_source_request_duration_seconds",
+		"Latency of the requests to the book sources.", metrics.DefBuckets, "source", "result")
+	telegramErrors = metrics.NewCounterVec("libbot_telegram_api_errors_total",
+		"Failed Telegram API calls by method.", "method")
+	limitedTotal = metrics.NewCounterVec("libbot_limited_total",
+		"Actions refused by the rate limits and the daily quotas.", "action", "reason")
+	breakerTransitions = metrics.NewCounterVec("libbot_source_breaker_transitions_total",
+		"Circuit breaker state changes by source and new state.", "source", "state")
+	transferredBytes = metrics.NewCounterVec("libbot_transferred_bytes_total",
+		"Bytes exchanged with Telegram and the book sources.", "peer", "direction")
+)
+
+// registerQueueMetrics exposes the depth of the job queue
+func registerQueueMetrics(q *jobs.Queue) {
+	metrics.NewGaugeFunc("libbot_queue_waiting_jobs", "Jobs waiting for a worker.",
+		func() float64 { return float64(q.Waiting()) })
+	metrics.NewGaugeFunc("libbot_queue_running_jobs", "Jobs running.",
+		func() float64 { return float64(q.Running()) })
+}
+
+// observeJob counts a finished job
+func observeJob(kind string, result pipeline.Result) {
+	switch err := result.Err(); {
+	case err == nil:
+		jobsTotal.Inc(kind, "succeeded")
+	case errors.Is(err, jobs.ErrClosed), errors.Is(err, errCancelled):
+		jobsTotal.Inc(kind, "cancelled")
+	default:
+		jobsTotal.Inc(kind, "failed")
+	}
+}
+
+// instrumentedConverter measures the conversions
+type instrumentedConverter struct {
+	pipeline.Converter
+}
+
+func (c instrumentedConverter) Convert(ctx context.Context, filename string, content []byte, format string) (string, []byte, error) {
+	start := time.Now()
+	name, converted, err := c.Converter.Convert(ctx, filename, content, format)
+	conversionDuration.Observe(time.Since(start).Seconds(), format)
+	conversionsTotal.Inc(format, resultLabel(err == nil))
+	return name, converted, err
+}
+
+// telegramTransport counts the failed Telegram API calls and the bytes
+// exchanged with Telegram
+type telegramTransport struct {
+	base http.RoundTripper
+}
+
+func (t telegramTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := roundTrip(t.base, req, "telegram")
+	if err != nil || resp.StatusCode >= 400 {
+		// the path ends with the method, the token must not leak in the labels
+		telegramErrors.Inc(path.Base(req.URL.Path))
+	}
+	return resp, err
+}
+
+// sourceTransport measures the requests to the book sources
+type sourceTransport struct {
+	base http.RoundTripper
+}
+
+func (t sourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := roundTrip(t.base, req, "source")
+	sourceDuration.Observe(time.Since(start).Seconds(), req.URL.Host, resultLabel(err == nil && resp.StatusCode < 400))
+	return resp, err
+}
+
+// newSourceTransport returns the transport of the requests to the book
+// sources: rate limited, behind a circuit breaker and measured. Requests
+// rejected by the breaker are not measured
+func newSourceTransport(cfg config.Source) *throttle.Transport {
+	t := &throttle.Transport{
+		Base:     sourceTransport{},
+		Failures: cfg.BreakerFailures,
+		Cooldown: time.Duration(cfg.BreakerCooldown) * time.Second,
+		OnStateChange: func(host string, state throttle.State) {
+			breakerTransitions.Inc(host, state.String())
+		},
+	}
+	if cfg.RateLimit != "" {
+		// the configuration was validated
+		t.Rate, _ = quota.ParseRate(cfg.RateLimit)
+	}
+	return t
+}
+
+// roundTrip sends a request counting the bytes of its body and of the
+// response body
+func roundTrip(base http.RoundTripper, req *http.Request, peer string) (*http.Response, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if req.Body != nil {
+		counted := *req
+		counted.Body = countingBody{ReadCloser: req.Body, peer: peer, direction: "sent"}
+		req = &counted
+	}
+	resp, err := base.RoundTrip(req)
+	if err == nil {
+		resp.Body = countingBody{ReadCloser: resp.Body, peer: peer, direction: "received"}
+	}
+	return resp, err
+}
+
+type countingBody struct {
+	io.ReadCloser
+	peer      string
+	direction string
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		transferredBytes.Add(float64(n), b.peer, b.direction)
+	}
+	return n, err
+}
+
+func resultLabel(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "error"
+}
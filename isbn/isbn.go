@@ -0,0 +1,161 @@
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors of Parse
+var (
+	ErrLength    = errors.New("an ISBN has 10 or 13 digits")
+	ErrCharacter = errors.New("an ISBN only has digits, and X as the last digit of an ISBN-10")
+	ErrPrefix    = errors.New("an ISBN-13 starts with 978 or 979")
+	ErrChecksum  = errors.New("invalid ISBN check digit")
+)
+
+// ISBN is a valid ISBN, always stored as its 13 digits
+type ISBN string
+
+// Parse reads an ISBN-10 or ISBN-13, hyphens and spaces are ignored and an
+// "ISBN" prefix is allowed. The check digit is verified
+func Parse(text string) (ISBN, error) {
+	text = strings.TrimSpace(text)
+	if len(text) >= 4 && strings.EqualFold(text[:4], "isbn") {
+		text = text[4:]
+		// ISBN-10: and ISBN-13: prefixes
+		if i := strings.IndexByte(text, ':'); i >= 0 {
+			text = text[i+1:]
+		}
+	}
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(text))
+	switch len(digits) {
+	case 10:
+		for i, r := range digits {
+			if (r < '0' || r > '9') && (r != 'X' || i != 9) {
+				return "", ErrCharacter
+			}
+		}
+		if checkDigit10(digits[:9]) != digits[9] {
+			return "", ErrChecksum
+		}
+		return to13(digits), nil
+	case 13:
+		for _, r := range digits {
+			if r < '0' || r > '9' {
+				return "", ErrCharacter
+			}
+		}
+		if !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+			return "", ErrPrefix
+		}
+		if checkDigit13(digits[:12]) != digits[12] {
+			return "", ErrChecksum
+		}
+		return ISBN(digits), nil
+	}
+	return "", ErrLength
+}
+
+// Valid tells if a text is a valid ISBN-10 or ISBN-13
+func Valid(text string) bool {
+	_, err := Parse(text)
+	return err == nil
+}
+
+// String returns the 13 digits of the ISBN
+func (i ISBN) String() string {
+	return string(i)
+}
+
+// ISBN13 returns the 13 digits of the ISBN
+func (i ISBN) ISBN13() string {
+	return string(i)
+}
+
+// ISBN10 returns the ISBN-10 of the ISBN, empty for the ISBNs starting with
+// 979 which have none
+func (i ISBN) ISBN10() string {
+	if !strings.HasPrefix(string(i), "978") {
+		return ""
+	}
+	digits := string(i)[3:12]
+	return digits + string(checkDigit10(digits))
+}
+
+// To13 converts an ISBN-10 or ISBN-13 to its ISBN-13
+func To13(text string) (string, error) {
+	i, err := Parse(text)
+	return i.ISBN13(), err
+}
+
+// To10 converts an ISBN-10 or ISBN-13 to its ISBN-10
+func To10(text string) (string, error) {
+	i, err := Parse(text)
+	if err != nil {
+		return "", err
+	}
+	if i.ISBN10() == "" {
+		return "", errors.New("an ISBN starting with 979 has no ISBN-10")
+	}
+	return i.ISBN10(), nil
+}
+
+// Normalize extracts the valid ISBNs of a text listing several of them, like
+// "0060853980, 978-0-06-085398-3". Invalid values are dropped and the
+// ISBN-10 and ISBN-13 of the same book are kept once, in the order of the text
+func Normalize(text string) []ISBN {
+	isbns := []ISBN{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ';' || r == '/' || r == '|' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		if i, err := Parse(field); err == nil {
+			isbns = append(isbns, i)
+		}
+	}
+	return Unique(isbns)
+}
+
+// Unique removes the duplicated ISBNs of a list, keeping the first ones
+func Unique(isbns []ISBN) []ISBN {
+	unique := []ISBN{}
+	seen := map[ISBN]bool{}
+	for _, i := range isbns {
+		if !seen[i] {
+			seen[i] = true
+			unique = append(unique, i)
+		}
+	}
+	return unique
+}
+
+// to13 converts the digits of a valid ISBN-10
+func to13(digits string) ISBN {
+	digits = "978" + digits[:9]
+	return ISBN(digits + string(checkDigit13(digits)))
+}
+
+// checkDigit10 computes the check digit of the 9 first digits of an ISBN-10
+func checkDigit10(digits string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(digits[i]-'0') * (10 - i)
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// checkDigit13 computes the check digit of the 12 first digits of an ISBN-13
+func checkDigit13(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += int(digits[i]-'0') * weight
+	}
+	return byte('0' + (10-sum%10)%10)
+}
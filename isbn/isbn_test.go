@@ -0,0 +1,103 @@
+package isbn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want ISBN
+		err  error
+	}{
+		{"0306406152", "9780306406157", nil},
+		{"0-306-40615-2", "9780306406157", nil},
+		{"080442957X", "9780804429573", nil},
+		{"080442957x", "9780804429573", nil},
+		{"978-0-306-40615-7", "9780306406157", nil},
+		{"978 0 306 40615 7", "9780306406157", nil},
+		{"ISBN 978-0-306-40615-7", "9780306406157", nil},
+		{"isbn-10: 0-306-40615-2", "9780306406157", nil},
+		{"ISBN-13: 9780306406157", "9780306406157", nil},
+		{" 9791090636071 ", "9791090636071", nil},
+		{"0306406153", "", ErrChecksum},
+		{"9780306406158", "", ErrChecksum},
+		{"X306406152", "", ErrCharacter},
+		{"97803064061X7", "", ErrCharacter},
+		{"030640615", "", ErrLength},
+		{"97803064061570", "", ErrLength},
+		{"", "", ErrLength},
+		{"9770306406157", "", ErrPrefix},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.text)
+		if got != tt.want || err != tt.err {
+			t.Errorf("Parse(%q) = %q, %v, want %q, %v", tt.text, got, err, tt.want, tt.err)
+		}
+		if Valid(tt.text) != (tt.err == nil) {
+			t.Errorf("Valid(%q) = %v", tt.text, !(tt.err == nil))
+		}
+	}
+}
+
+func TestConversions(t *testing.T) {
+	tests := []struct {
+		text   string
+		isbn13 string
+		isbn10 string
+	}{
+		{"0306406152", "9780306406157", "0306406152"},
+		{"9780804429573", "9780804429573", "080442957X"},
+		{"0-06-085398-0", "9780060853983", "0060853980"},
+		{"9791090636071", "9791090636071", ""},
+	}
+	for _, tt := range tests {
+		if got, err := To13(tt.text); got != tt.isbn13 || err != nil {
+			t.Errorf("To13(%q) = %q, %v, want %q", tt.text, got, err, tt.isbn13)
+		}
+		got, err := To10(tt.text)
+		if got != tt.isbn10 || (err == nil) != (tt.isbn10 != "") {
+			t.Errorf("To10(%q) = %q, %v, want %q", tt.text, got, err, tt.isbn10)
+		}
+		// the conversions go both ways
+		if tt.isbn10 != "" {
+			if back, err := To13(tt.isbn10); back != tt.isbn13 || err != nil {
+				t.Errorf("To13(%q) = %q, %v, want %q", tt.isbn10, back, err, tt.isbn13)
+			}
+		}
+	}
+	if _, err := To13("not an isbn"); err == nil {
+		t.Error("To13 of an invalid ISBN succeeded")
+	}
+	if _, err := To10("0306406153"); err != ErrChecksum {
+		t.Errorf("To10 of an invalid ISBN = %v, want ErrChecksum", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []ISBN
+	}{
+		{"", []ISBN{}},
+		{"0060853980, 978-0-06-085398-3", []ISBN{"9780060853983"}},
+		{"0306406152; 9780441172719|080442957X", []ISBN{"9780306406157", "9780441172719", "9780804429573"}},
+		{"ISBN-10: 0306406152 ISBN-13: 9780306406157", []ISBN{"9780306406157"}},
+		{"n/a, 123, 0306406153, unknown", []ISBN{}},
+		{"junk, 9780441172719, 9780441172718\n0441172717", []ISBN{"9780441172719"}},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	got := Unique([]ISBN{"9780441172719", "9780306406157", "9780441172719"})
+	want := []ISBN{"9780441172719", "9780306406157"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unique() = %q, want %q", got, want)
+	}
+}
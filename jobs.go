@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/delivery"
+	"github.com/geobeau/Libbot/jobs"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// Kinds of jobs
+const (
+	jobDownload = "download"
+	jobKindle   = "kindle"
+	jobLibrary  = "library"
+	jobConvert  = "convert"
+)
+
+// errCancelled is the error of the jobs cancelled by an admin
+var errCancelled = errors.New("cancelled by an admin")
+
+// maxAttempts is the number of times a job is started before it is dropped,
+// a job crashing the bot must not be resumed forever
+const maxAttempts = 3
+
+// storeJournal records the stages of a job in the store
+type storeJournal struct {
+	ctx   context.Context
+	store *storage.Store
+	job   storage.Job
+}
+
+func (j storeJournal) Done(stage pipeline.Stage) bool {
+	return contains(j.job.Stages, stage.String())
+}
+
+func (j storeJournal) Complete(stage pipeline.Stage) {
+	if err := j.store.CompleteStage(j.job.ID, stage.String()); err != nil {
+		logger.ErrorContext(j.ctx, "Failed to save job stage", "job", j.job.ID, "stage", stage.String(), logging.Err(err))
+	}
+}
+
+// jobPipeline returns the pipeline running a job and the message sent once
+// it succeeded. It fails when the delivery isn't possible anymore. The
+// role of the user limits the size of the files and the conversions
+func (a *app) jobPipeline(ctx context.Context, job storage.Job) (*pipeline.Pipeline, string, error) {
+	role := job.Role
+	if role == "" {
+		role = storage.RoleUser
+	}
+	if job.Kind == jobConvert && !a.access.canConvert(role) {
+		return nil, "", errors.New("conversions are reserved to " + a.cfg.Access.ConvertRole + " users")
+	}
+	p, success, err := a.kindPipeline(ctx, job)
+	if err != nil {
+		return nil, "", err
+	}
+	p.MaxSize = a.access.maxFileSize(role, p.MaxSize)
+	switch {
+	case !a.access.canConvert(role):
+		p.Converter = nil
+	case job.Kind != jobConvert:
+		// the conversions of uploads are consumed when they are asked for
+		p.Converter = limitedConverter{Converter: p.Converter, app: a, user: &tb.User{ID: job.UserID}, role: role}
+	}
+	return p, success, nil
+}
+
+// kindPipeline returns the pipeline of a kind of job
+func (a *app) kindPipeline(ctx context.Context, job storage.Job) (*pipeline.Pipeline, string, error) {
+	to := &tb.User{ID: job.UserID}
+	format := ""
+	if len(job.Formats) > 0 {
+		format = job.Formats[0]
+	}
+	switch job.Kind {
+	case jobDownload:
+		return a.downloadPipeline(to), "", nil
+	case jobKindle:
+		settings := a.store.Settings(job.UserID)
+		if a.mailer == nil || settings.Email == "" {
+			return nil, "", errors.New("no delivery email")
+		}
+		if !contains(emailFormats, format) {
+			format = defaultEmailFormat
+		}
+		convertFrom := []string{}
+		for _, extension := range ebookExtensions {
+			if extension != "."+format {
+				convertFrom = append(convertFrom, extension)
+			}
+		}
+		p := a.downloadPipeline(to)
+		p.Uploader = delivery.EmailUploader{Mailer: a.mailer, To: settings.Email}
+		p.ConvertFrom = convertFrom
+		p.ConvertTo = format
+		p.OnlyConverted = true
+		return p, "Sent to " + settings.Email, nil
+	case jobLibrary:
+		if a.library == nil {
+			return nil, "", errors.New("no library")
+		}
+		p := a.downloadPipeline(to)
+		p.Uploader = delivery.LibraryUploader{
+			Library:  a.library,
+			User:     strconv.Itoa(job.UserID),
+			Template: a.libraryTemplate,
+		}
+		return p, "Saved to your library", nil
+	case jobConvert:
+		u := upload{userID: job.UserID, file: tb.File{FileID: job.BookID}, name: job.Filename}
+		if job.Book != nil {
+			u.book = *job.Book
+		} else {
+			u.book = fileBook(u)
+		}
+		p := &pipeline.Pipeline{
+			Fetcher:       telegramFetcher{bot: a.bot, upload: u},
+			Uploader:      telegramUploader{bot: a.bot, to: to},
+			Converter:     instrumentedConverter{a.converter()},
+			Notifier:      telegramNotifier{bot: a.bot, to: to},
+			Processors:    []pipeline.Processor{epubRepairProcessor{}},
+			ConvertFrom:   []string{strings.ToLower(filepath.Ext(u.name))},
+			ConvertTo:     format,
+			OnlyConverted: true,
+			MaxSize:       a.cfg.MaxFileSize,
+		}
+		return p, "", nil
+	}
+	return nil, "", fmt.Errorf("unknown job kind %q", job.Kind)
+}
+
+// jobContext returns the context of a job, it keeps the correlation id of
+// the request which created the job
+func jobContext(job storage.Job) context.Context {
+	id := job.RequestID
+	if id == "" {
+		id = logging.NewRequestID()
+	}
+	return logging.WithRequestID(context.Background(), id)
+}
+
+// submit saves a job so it survives restarts and runs it
+func (a *app) submit(ctx context.Context, job storage.Job) pipeline.Result {
+	job.RequestID = logging.RequestID(ctx)
+	job.Role = roleOf(ctx)
+	saved, err := a.store.AddJob(job)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to save job", logging.Err(err))
+	} else {
+		job = saved
+	}
+	return a.runJob(job)
+}
+
+// runJob runs a saved job and forgets it once it is done. Jobs cancelled by
+// a shutdown are kept to be resumed on the next start
+func (a *app) runJob(job storage.Job) pipeline.Result {
+	to := &tb.User{ID: job.UserID}
+	ctx := jobContext(job)
+	var result pipeline.Result
+	p, success, err := a.jobPipeline(ctx, job)
+	if err != nil {
+		logger.ErrorContext(ctx, "Job can't run", "job", job.ID, logging.Err(err))
+		a.bot.Send(to, fmt.Sprintf("Your %s request failed: %v", job.Kind, err))
+		result.Outcomes = []pipeline.Outcome{{Stage: pipeline.Fetch, Status: pipeline.Failed, Err: err}}
+		observeJob(job.Kind, result)
+		a.stats.job(job.Kind, result)
+	} else {
+		p.Journal = storeJournal{ctx: ctx, store: a.store, job: job}
+		result = a.run(ctx, job, p)
+		observeJob(job.Kind, result)
+		a.stats.job(job.Kind, result)
+		if errors.Is(result.Err(), jobs.ErrClosed) {
+			return result
+		}
+		a.recordDeliveries(ctx, job, result)
+		if result.Err() == nil && success != "" {
+			a.bot.Send(to, success)
+		}
+	}
+	if result.Outcome(pipeline.Fetch).Status == pipeline.Failed {
+		a.refund(ctx, job)
+	}
+	if err := a.store.RemoveJob(job.ID); err != nil {
+		logger.ErrorContext(ctx, "Failed to remove job", "job", job.ID, logging.Err(err))
+	}
+	return result
+}
+
+// resumeJobs restarts the jobs interrupted by the previous shutdown
+func (a *app) resumeJobs() {
+	for _, job := range a.store.Jobs() {
+		to := &tb.User{ID: job.UserID}
+		ctx := jobContext(job)
+		if job.Attempts >= maxAttempts {
+			logger.WarnContext(ctx, "Dropping job", "job", job.ID, "attempts", job.Attempts)
+			a.bot.Send(to, fmt.Sprintf("Your %s request failed after %d attempts", job.Kind, job.Attempts))
+			if err := a.store.RemoveJob(job.ID); err != nil {
+				logger.ErrorContext(ctx, "Failed to remove job", "job", job.ID, logging.Err(err))
+			}
+			continue
+		}
+		logger.InfoContext(ctx, "Resuming job", "job", job.ID, "kind", job.Kind, "book", job.BookID)
+		a.bot.Send(to, fmt.Sprintf("Resuming your %s request after a restart...", job.Kind))
+		go a.runJob(job)
+	}
+}
+
+// cancelJobButton cancels a job listed by /jobs, its data is the id of the
+// active job
+var cancelJobButton = tb.InlineButton{
+	Unique: "cancel_job_button",
+}
+
+// handleJobs lists the jobs waiting and running, for admins
+func (a *app) handleJobs(ctx context.Context, m *tb.Message) {
+	active := a.active.list()
+	if len(active) == 0 {
+		a.bot.Send(m.Sender, "No job")
+		return
+	}
+	ids := []int{}
+	for id := range active {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	lines := []string{fmt.Sprintf("%d running, %d waiting:", a.queue.Running(), a.queue.Waiting())}
+	buttons := [][]tb.InlineButton{}
+	for _, id := range ids {
+		job := active[id]
+		state := "waiting for " + time.Since(job.queued).Round(time.Second).String()
+		if !job.started.IsZero() {
+			state = "running for " + time.Since(job.started).Round(time.Second).String()
+		}
+		lines = append(lines, fmt.Sprintf("#%d %s of user %d, %s", id, job.job.Kind, job.job.UserID, state))
+		button := cancelJobButton
+		button.Text = fmt.Sprintf("Cancel #%d", id)
+		button.Data = strconv.Itoa(id)
+		buttons = append(buttons, []tb.InlineButton{button})
+	}
+	a.bot.Send(m.Sender, strings.Join(lines, "\n"), &tb.ReplyMarkup{InlineKeyboard: buttons})
+}
+
+// cancelJob cancels a job listed by /jobs, for admins
+func (a *app) cancelJob(ctx context.Context, c *tb.Callback) {
+	if roleOf(ctx) != storage.RoleAdmin {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Reserved to admins"})
+		return
+	}
+	id, err := strconv.Atoi(c.Data)
+	if err != nil || !a.active.cancel(id) {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "The job is already finished"})
+		return
+	}
+	logger.InfoContext(ctx, "Cancelling job", "active_job", id)
+	a.bot.Respond(c, &tb.CallbackResponse{Text: fmt.Sprintf("Job #%d cancelled", id)})
+}
@@ -0,0 +1,125 @@
+package jobs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWorkers is the number of jobs running at the same time by default
+const DefaultWorkers = 2
+
+// ErrClosed is returned by Run when the queue was closed before the job
+// started
+var ErrClosed = errors.New("jobs: queue is closed")
+
+// Queue limits the number of downloads and conversions running at the same
+// time, the other jobs wait for a free slot in arrival order
+type Queue struct {
+	slots   chan struct{}
+	waiting int32
+
+	mu      sync.Mutex
+	closed  bool
+	done    chan struct{}
+	running sync.WaitGroup
+}
+
+// NewQueue returns a queue running at most workers jobs at the same time
+func NewQueue(workers int) *Queue {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	return &Queue{slots: make(chan struct{}, workers), done: make(chan struct{})}
+}
+
+// Run runs a job once a slot is free. If the job has to wait, queued is
+// called first with the number of jobs ahead of it. It returns ErrClosed
+// without running the job if the queue is closed before a slot is free
+func (q *Queue) Run(queued func(position int), job func()) error {
+	if !q.acquire(queued) {
+		return ErrClosed
+	}
+	defer q.release()
+	job()
+	return nil
+}
+
+func (q *Queue) acquire(queued func(position int)) bool {
+	select {
+	case <-q.done:
+		return false
+	case q.slots <- struct{}{}:
+	default:
+		position := atomic.AddInt32(&q.waiting, 1)
+		if queued != nil {
+			queued(int(position))
+		}
+		select {
+		case q.slots <- struct{}{}:
+			atomic.AddInt32(&q.waiting, -1)
+		case <-q.done:
+			atomic.AddInt32(&q.waiting, -1)
+			return false
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		<-q.slots
+		return false
+	}
+	q.running.Add(1)
+	return true
+}
+
+func (q *Queue) release() {
+	<-q.slots
+	q.running.Done()
+}
+
+// Close stops accepting jobs, the waiting jobs are cancelled and the
+// running ones are left to finish
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+// Drain closes the queue and waits up to timeout for the running jobs to
+// finish. It returns false if some jobs are still running
+func (q *Queue) Drain(timeout time.Duration) bool {
+	q.Close()
+	finished := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Closed tells if the queue stopped accepting jobs
+func (q *Queue) Closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// Waiting returns the number of jobs waiting for a slot
+func (q *Queue) Waiting() int {
+	return int(atomic.LoadInt32(&q.waiting))
+}
+
+// Running returns the number of jobs running
+func (q *Queue) Running() int {
+	return len(q.slots)
+}
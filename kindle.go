@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/geobeau/Libbot/config"
+	"github.com/geobeau/Libbot/delivery"
+	"github.com/geobeau/Libbot/language"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/quota"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// defaultEmailFormat is the format sent to Kindles when the user didn't pick one
+const defaultEmailFormat = "epub"
+
+// emailFormats are the formats accepted by the Kindle mail service, which
+// rejects mobi files since 2022
+var emailFormats = []string{"epub", "pdf"}
+
+// emailFormat returns the format sent by email to a user, the default one
+// replaces a format no longer accepted
+func emailFormat(settings storage.Settings) string {
+	if !contains(emailFormats, settings.EmailFormat) {
+		return defaultEmailFormat
+	}
+	return settings.EmailFormat
+}
+
+// newMailer configures the email delivery, it returns nil when no SMTP
+// server is set
+func newMailer(cfg config.SMTP) *delivery.Mailer {
+	if cfg.Host == "" {
+		return nil
+	}
+	return &delivery.Mailer{
+		Host:              cfg.Host,
+		Port:              cfg.Port,
+		Username:          cfg.Username,
+		Password:          cfg.Password,
+		From:              cfg.From,
+		AllowedDomains:    cfg.AllowedDomains,
+		MaxAttachmentSize: cfg.MaxAttachmentSize,
+	}
+}
+
+func formatSettingsMessage(settings storage.Settings, locale string) string {
+	email := settings.Email
+	if email == "" {
+		email = "not set"
+	}
+	format := emailFormat(settings)
+	preferred := "not set"
+	if settings.Language != "" {
+		preferred = language.Display(settings.Language, locale)
+	}
+	template :=
+		"Delivery email: %s\n" +
+			"Delivery format: %s\n" +
+			"Preferred language: %s\n\n" +
+			"/settings email <address> to set your Kindle address (/settings email off to remove it)\n" +
+			"/settings format <%s> to choose the format sent by email\n" +
+			"/settings language <language> to list the books in this language first (/settings language off to remove it)"
+	return fmt.Sprintf(template, email, format, preferred, strings.Join(emailFormats, "|"))
+}
+
+// handleSettings shows and updates the settings of a user
+func (a *app) handleSettings(ctx context.Context, m *tb.Message) {
+	b := a.bot
+	settings := a.store.Settings(m.Sender.ID)
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		b.Send(m.Sender, formatSettingsMessage(settings, m.Sender.LanguageCode))
+		return
+	}
+	if len(args) != 2 {
+		b.Send(m.Sender, "Usage: /settings email <address>, /settings format <format> or /settings language <language>")
+		return
+	}
+	switch args[0] {
+	case "email":
+		if a.mailer == nil {
+			b.Send(m.Sender, "Email delivery is not enabled on this bot")
+			return
+		}
+		if args[1] == "off" {
+			settings.Email = ""
+			break
+		}
+		address, err := a.mailer.CheckAddress(args[1])
+		if err != nil {
+			b.Send(m.Sender, fmt.Sprintf("Invalid address: %v", err))
+			return
+		}
+		settings.Email = address
+	case "format":
+		format := strings.ToLower(strings.TrimPrefix(args[1], "."))
+		if !contains(emailFormats, format) {
+			b.Send(m.Sender, "Supported formats: "+strings.Join(emailFormats, ", "))
+			return
+		}
+		settings.EmailFormat = format
+	case "language":
+		if args[1] == "off" {
+			settings.Language = ""
+			break
+		}
+		l, ok := language.Parse(args[1])
+		if !ok {
+			b.Send(m.Sender, "Unknown language "+args[1]+", use its name or its ISO 639 code like en or fra")
+			return
+		}
+		settings.Language = l.ID()
+	default:
+		b.Send(m.Sender, "Unknown setting "+args[0])
+		return
+	}
+	if err := a.store.SetSettings(m.Sender.ID, settings); err != nil {
+		logger.ErrorContext(ctx, "Failed to save settings", logging.Err(err))
+		b.Send(m.Sender, "Failed to save your settings")
+		return
+	}
+	b.Send(m.Sender, formatSettingsMessage(settings, m.Sender.LanguageCode))
+}
+
+// sendToKindle emails a book to the address registered by the user
+func (a *app) sendToKindle(ctx context.Context, c *tb.Callback) {
+	b := a.bot
+	settings := a.store.Settings(c.Sender.ID)
+	if settings.Email == "" {
+		b.Respond(c, &tb.CallbackResponse{Text: "No delivery email"})
+		b.Send(c.Sender, "Register your Kindle address first with /settings email <address>")
+		return
+	}
+	if !a.allow(ctx, c.Sender, quota.Download) {
+		b.Respond(c, &tb.CallbackResponse{Text: "Try again later"})
+		return
+	}
+	b.Respond(c, &tb.CallbackResponse{Text: "Sending to " + settings.Email})
+	format := emailFormat(settings)
+	job := storage.Job{UserID: c.Sender.ID, Kind: jobKindle, BookID: c.Data, Formats: []string{format}}
+	if err := a.submit(ctx, job).Err(); err != nil {
+		logger.ErrorContext(ctx, "Email delivery failed", logging.Err(err))
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
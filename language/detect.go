@@ -0,0 +1,189 @@
+package language
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Limits of the detection
+const (
+	// maxDetectedRunes is the length of the text read, the beginning of a
+	// book is enough
+	maxDetectedRunes = 20000
+	// minLetters is the number of letters needed to detect a language
+	minLetters = 50
+	// minStopwords is the number of common words needed to detect a
+	// language written in the latin script
+	minStopwords = 5
+)
+
+// stopwords are the most common words of the languages written in the latin
+// script, few of them are shared between languages
+var stopwords = map[string][]string{
+	"en": {"a", "in", "i", "the", "and", "of", "to", "is", "that", "was", "he", "she", "with", "for", "his", "her", "it", "not", "you", "they", "this", "have", "had", "which", "were", "would", "from"},
+	"fr": {"de", "à", "en", "un", "le", "la", "les", "et", "est", "une", "des", "du", "que", "qui", "dans", "pour", "pas", "il", "elle", "sur", "au", "avec", "mais", "nous", "vous", "je", "était", "ce"},
+	"de": {"in", "er", "der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "sich", "des", "auf", "für", "dem", "auch", "es", "sie", "ich", "war", "aber", "wie", "noch"},
+	"es": {"de", "la", "en", "a", "no", "un", "el", "los", "las", "y", "es", "una", "del", "que", "por", "con", "para", "su", "se", "lo", "como", "pero", "más", "era", "sus", "muy", "también", "ella", "yo", "hay"},
+	"it": {"a", "in", "un", "si", "il", "di", "che", "è", "e", "la", "gli", "della", "per", "una", "sono", "non", "del", "con", "anche", "come", "più", "ma", "era", "nel", "alla", "questo", "lui", "lei"},
+	"pt": {"de", "a", "se", "o", "os", "as", "e", "é", "um", "uma", "do", "da", "não", "que", "com", "para", "em", "no", "na", "mais", "ao", "ele", "ela", "foi", "seu", "sua", "também"},
+	"nl": {"de", "het", "een", "en", "van", "is", "niet", "dat", "op", "te", "zijn", "met", "voor", "hij", "ze", "maar", "ook", "als", "bij", "wat", "was", "er", "naar", "nog"},
+	"sv": {"och", "att", "det", "som", "en", "är", "på", "för", "med", "han", "hon", "inte", "av", "till", "den", "var", "om", "jag", "men", "har", "så", "ett", "sig", "från"},
+	"da": {"og", "at", "det", "er", "en", "af", "på", "til", "med", "han", "hun", "ikke", "der", "den", "var", "som", "jeg", "de", "for", "har", "men", "sig", "et", "fra"},
+	"no": {"og", "at", "det", "er", "en", "av", "på", "til", "med", "han", "hun", "ikke", "som", "den", "var", "jeg", "de", "for", "har", "men", "seg", "et", "fra", "ble"},
+	"fi": {"ja", "on", "ei", "se", "että", "hän", "oli", "ole", "mutta", "kun", "niin", "kuin", "tämä", "ovat", "myös", "vain", "sen", "jo", "sitten", "nyt", "minä", "hänen", "mitä", "joka"},
+	"pl": {"i", "w", "nie", "na", "się", "jest", "że", "z", "do", "to", "jak", "ale", "po", "co", "tak", "był", "była", "jego", "jej", "od", "przez", "już", "tylko", "który"},
+	"cs": {"a", "je", "se", "na", "to", "že", "v", "s", "ale", "jak", "byl", "byla", "jsem", "jeho", "její", "tak", "už", "jen", "který", "od", "aby", "také", "když", "bylo"},
+	"hu": {"a", "az", "és", "hogy", "nem", "egy", "is", "meg", "volt", "de", "csak", "még", "már", "mint", "van", "ez", "azt", "ha", "én", "után", "vagy", "minden", "amikor", "nagyon"},
+	"ro": {"și", "în", "nu", "de", "la", "cu", "pe", "este", "o", "un", "din", "care", "mai", "ca", "să", "dar", "a", "fost", "sau", "el", "ea", "lui", "când", "foarte"},
+	"tr": {"ve", "bir", "bu", "da", "de", "için", "ile", "ne", "çok", "daha", "gibi", "ama", "olan", "kadar", "sonra", "ben", "o", "var", "yok", "mi", "diye", "şey", "her", "en"},
+	"ca": {"el", "la", "els", "les", "i", "és", "una", "del", "que", "per", "amb", "no", "més", "però", "com", "seu", "seva", "va", "hi", "ho", "molt", "també", "aquest", "quan"},
+	"id": {"dan", "yang", "di", "itu", "dengan", "untuk", "tidak", "ini", "dari", "dalam", "akan", "pada", "juga", "saya", "ke", "karena", "ada", "mereka", "bisa", "sudah", "atau", "kami", "oleh", "seperti"},
+	"vi": {"và", "của", "là", "có", "không", "một", "những", "được", "trong", "người", "cho", "này", "với", "các", "đã", "anh", "tôi", "khi", "nhưng", "cũng", "thì", "đến", "ra", "lại"},
+	"la": {"et", "in", "est", "non", "ad", "cum", "quod", "sed", "ut", "qui", "quae", "esse", "ab", "enim", "sunt", "etiam", "autem", "per", "nec", "atque", "ex", "se", "hoc", "eius"},
+}
+
+// stopwordLanguages finds the languages of a stopword
+var stopwordLanguages = map[string][]string{}
+
+func init() {
+	for code, words := range stopwords {
+		for _, word := range words {
+			stopwordLanguages[word] = append(stopwordLanguages[word], code)
+		}
+	}
+}
+
+// Detect guesses the language of a text from its script and, for the latin
+// script, from its most common words. It fails on short texts and on
+// texts mixing languages too much
+func Detect(text string) (Language, bool) {
+	if runes := []rune(text); len(runes) > maxDetectedRunes {
+		text = string(runes[:maxDetectedRunes])
+	}
+	scripts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if script := scriptOf(r); script != "" {
+			scripts[script]++
+		}
+	}
+	if letters < minLetters {
+		return Language{}, false
+	}
+	dominant, count := "", 0
+	for script, n := range scripts {
+		if n > count || (n == count && script < dominant) {
+			dominant, count = script, n
+		}
+	}
+	code := ""
+	switch dominant {
+	case "latin":
+		code = detectLatin(text)
+	case "cyrillic":
+		code = detectCyrillic(text)
+	case "han", "kana":
+		code = "zh"
+		// Japanese mixes kanji with kana
+		if scripts["kana"]*10 >= scripts["han"]+scripts["kana"] {
+			code = "ja"
+		}
+	case "arabic":
+		code = "ar"
+		if strings.ContainsAny(text, "پچژگ") {
+			code = "fa"
+		}
+	default:
+		code = scriptLanguages[dominant]
+	}
+	if code == "" {
+		return Language{}, false
+	}
+	return Parse(code)
+}
+
+// scriptLanguages are the languages detected from their script alone
+var scriptLanguages = map[string]string{
+	"greek": "el", "hebrew": "he", "hangul": "ko", "devanagari": "hi", "thai": "th",
+	"armenian": "hy", "georgian": "ka",
+}
+
+// scriptOf returns the script of a letter
+func scriptOf(r rune) string {
+	switch {
+	case unicode.Is(unicode.Latin, r):
+		return "latin"
+	case unicode.Is(unicode.Cyrillic, r):
+		return "cyrillic"
+	case unicode.Is(unicode.Greek, r):
+		return "greek"
+	case unicode.Is(unicode.Arabic, r):
+		return "arabic"
+	case unicode.Is(unicode.Hebrew, r):
+		return "hebrew"
+	case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+		return "kana"
+	case unicode.Is(unicode.Han, r):
+		return "han"
+	case unicode.Is(unicode.Hangul, r):
+		return "hangul"
+	case unicode.Is(unicode.Devanagari, r):
+		return "devanagari"
+	case unicode.Is(unicode.Thai, r):
+		return "thai"
+	case unicode.Is(unicode.Armenian, r):
+		return "armenian"
+	case unicode.Is(unicode.Georgian, r):
+		return "georgian"
+	}
+	return ""
+}
+
+// detectLatin counts the stopwords of each language, a word shared by
+// several languages counts for each of them
+func detectLatin(text string) string {
+	scores := map[string]int{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for _, code := range stopwordLanguages[word] {
+			scores[code]++
+		}
+	}
+	best, bestScore, second := "", 0, 0
+	for code, score := range scores {
+		switch {
+		case score > bestScore || (score == bestScore && code < best):
+			best, bestScore, second = code, score, bestScore
+		case score > second:
+			second = score
+		}
+	}
+	// too close to tell apart, like Danish and Norwegian
+	if bestScore < minStopwords || bestScore*10 < second*11 {
+		return ""
+	}
+	return best
+}
+
+// detectCyrillic tells the languages written in cyrillic apart by the
+// letters only some of them use
+func detectCyrillic(text string) string {
+	counts := map[rune]int{}
+	for _, r := range strings.ToLower(text) {
+		counts[r]++
+	}
+	switch {
+	case counts['ў'] > 0:
+		return "be"
+	case counts['ї']+counts['є']+counts['ґ'] > 0 || counts['і'] > counts['и']/4:
+		return "uk"
+	case counts['ђ']+counts['ћ']+counts['џ']+counts['љ']+counts['њ'] > 0:
+		return "sr"
+	case counts['ы']+counts['э'] == 0 && counts['ъ'] > 0:
+		return "bg"
+	}
+	return "ru"
+}
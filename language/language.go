@@ -0,0 +1,166 @@
+package language
+
+import (
+	"strings"
+)
+
+// Locales are the languages the names of the languages are translated in
+var Locales = []string{"en", "fr", "de", "es", "ru"}
+
+// Language is a language identified by its ISO 639 codes
+type Language struct {
+	// Code is the ISO 639-1 code, like "en", empty for the languages which
+	// have none
+	Code string
+	// Code3 is the ISO 639-3 code, like "fra"
+	Code3 string
+	// Bibliographic is the ISO 639-2/B code when it differs from Code3,
+	// like "fre"
+	Bibliographic string
+	// Native is the name of the language in itself
+	Native string
+	// Names are the names of the language by locale
+	Names map[string]string
+}
+
+// ID returns the code identifying the language in the books: its ISO 639-1
+// code, or its ISO 639-3 code when it has none, as BCP 47 does
+func (l Language) ID() string {
+	if l.Code != "" {
+		return l.Code
+	}
+	return l.Code3
+}
+
+// Name returns the name of the language in a locale like "fr" or "pt-BR",
+// in English when the locale isn't translated
+func (l Language) Name(locale string) string {
+	if name, ok := l.Names[base(locale)]; ok {
+		return name
+	}
+	return l.Names["en"]
+}
+
+// languages are the languages known by Parse and Detect
+var languages = []Language{
+	newLanguage("en", "eng", "", "English", "English", "anglais", "Englisch", "inglés", "английский"),
+	newLanguage("fr", "fra", "fre", "Français", "French", "français", "Französisch", "francés", "французский"),
+	newLanguage("de", "deu", "ger", "Deutsch", "German", "allemand", "Deutsch", "alemán", "немецкий"),
+	newLanguage("es", "spa", "", "Español", "Spanish", "espagnol", "Spanisch", "español", "испанский"),
+	newLanguage("it", "ita", "", "Italiano", "Italian", "italien", "Italienisch", "italiano", "итальянский"),
+	newLanguage("pt", "por", "", "Português", "Portuguese", "portugais", "Portugiesisch", "portugués", "португальский"),
+	newLanguage("ru", "rus", "", "Русский", "Russian", "russe", "Russisch", "ruso", "русский"),
+	newLanguage("uk", "ukr", "", "Українська", "Ukrainian", "ukrainien", "Ukrainisch", "ucraniano", "украинский"),
+	newLanguage("be", "bel", "", "Беларуская", "Belarusian", "biélorusse", "Belarussisch", "bielorruso", "белорусский"),
+	newLanguage("bg", "bul", "", "Български", "Bulgarian", "bulgare", "Bulgarisch", "búlgaro", "болгарский"),
+	newLanguage("sr", "srp", "", "Српски", "Serbian", "serbe", "Serbisch", "serbio", "сербский"),
+	newLanguage("hr", "hrv", "", "Hrvatski", "Croatian", "croate", "Kroatisch", "croata", "хорватский"),
+	newLanguage("sl", "slv", "", "Slovenščina", "Slovenian", "slovène", "Slowenisch", "esloveno", "словенский"),
+	newLanguage("pl", "pol", "", "Polski", "Polish", "polonais", "Polnisch", "polaco", "польский"),
+	newLanguage("cs", "ces", "cze", "Čeština", "Czech", "tchèque", "Tschechisch", "checo", "чешский"),
+	newLanguage("sk", "slk", "slo", "Slovenčina", "Slovak", "slovaque", "Slowakisch", "eslovaco", "словацкий"),
+	newLanguage("hu", "hun", "", "Magyar", "Hungarian", "hongrois", "Ungarisch", "húngaro", "венгерский"),
+	newLanguage("ro", "ron", "rum", "Română", "Romanian", "roumain", "Rumänisch", "rumano", "румынский"),
+	newLanguage("nl", "nld", "dut", "Nederlands", "Dutch", "néerlandais", "Niederländisch", "neerlandés", "нидерландский"),
+	newLanguage("sv", "swe", "", "Svenska", "Swedish", "suédois", "Schwedisch", "sueco", "шведский"),
+	newLanguage("da", "dan", "", "Dansk", "Danish", "danois", "Dänisch", "danés", "датский"),
+	newLanguage("no", "nor", "", "Norsk", "Norwegian", "norvégien", "Norwegisch", "noruego", "норвежский"),
+	newLanguage("fi", "fin", "", "Suomi", "Finnish", "finnois", "Finnisch", "finés", "финский"),
+	newLanguage("et", "est", "", "Eesti", "Estonian", "estonien", "Estnisch", "estonio", "эстонский"),
+	newLanguage("lv", "lav", "", "Latviešu", "Latvian", "letton", "Lettisch", "letón", "латышский"),
+	newLanguage("lt", "lit", "", "Lietuvių", "Lithuanian", "lituanien", "Litauisch", "lituano", "литовский"),
+	newLanguage("el", "ell", "gre", "Ελληνικά", "Greek", "grec", "Griechisch", "griego", "греческий"),
+	newLanguage("", "grc", "", "Ἀρχαία ἑλληνικὴ", "Ancient Greek", "grec ancien", "Altgriechisch", "griego antiguo", "древнегреческий"),
+	newLanguage("la", "lat", "", "Latina", "Latin", "latin", "Latein", "latín", "латинский"),
+	newLanguage("ca", "cat", "", "Català", "Catalan", "catalan", "Katalanisch", "catalán", "каталанский"),
+	newLanguage("eo", "epo", "", "Esperanto", "Esperanto", "espéranto", "Esperanto", "esperanto", "эсперанто"),
+	newLanguage("tr", "tur", "", "Türkçe", "Turkish", "turc", "Türkisch", "turco", "турецкий"),
+	newLanguage("hy", "hye", "arm", "Հայերեն", "Armenian", "arménien", "Armenisch", "armenio", "армянский"),
+	newLanguage("ka", "kat", "geo", "ქართული", "Georgian", "géorgien", "Georgisch", "georgiano", "грузинский"),
+	newLanguage("ar", "ara", "", "العربية", "Arabic", "arabe", "Arabisch", "árabe", "арабский"),
+	newLanguage("he", "heb", "", "עברית", "Hebrew", "hébreu", "Hebräisch", "hebreo", "иврит"),
+	newLanguage("fa", "fas", "per", "فارسی", "Persian", "persan", "Persisch", "persa", "персидский"),
+	newLanguage("hi", "hin", "", "हिन्दी", "Hindi", "hindi", "Hindi", "hindi", "хинди"),
+	newLanguage("th", "tha", "", "ไทย", "Thai", "thaï", "Thailändisch", "tailandés", "тайский"),
+	newLanguage("vi", "vie", "", "Tiếng Việt", "Vietnamese", "vietnamien", "Vietnamesisch", "vietnamita", "вьетнамский"),
+	newLanguage("id", "ind", "", "Bahasa Indonesia", "Indonesian", "indonésien", "Indonesisch", "indonesio", "индонезийский"),
+	newLanguage("zh", "zho", "chi", "中文", "Chinese", "chinois", "Chinesisch", "chino", "китайский"),
+	newLanguage("ja", "jpn", "", "日本語", "Japanese", "japonais", "Japanisch", "japonés", "японский"),
+	newLanguage("ko", "kor", "", "한국어", "Korean", "coréen", "Koreanisch", "coreano", "корейский"),
+}
+
+// newLanguage builds a language from its codes, its native name and its
+// names in the Locales
+func newLanguage(code, code3, bibliographic, native string, names ...string) Language {
+	l := Language{Code: code, Code3: code3, Bibliographic: bibliographic, Native: native, Names: map[string]string{}}
+	for i, locale := range Locales {
+		l.Names[locale] = names[i]
+	}
+	return l
+}
+
+// index finds the languages by code and lower case name
+var index = map[string]int{}
+
+func init() {
+	for i, l := range languages {
+		keys := []string{l.Code, l.Code3, l.Bibliographic, l.Native}
+		for _, name := range l.Names {
+			keys = append(keys, name)
+		}
+		for _, key := range keys {
+			if key = strings.ToLower(key); key != "" {
+				if _, ok := index[key]; !ok {
+					index[key] = i
+				}
+			}
+		}
+	}
+}
+
+// Parse finds a language from a code or a name, like "en", "eng", "English",
+// "anglais" or "en-US". Case and text in parentheses are ignored
+func Parse(text string) (Language, bool) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if i := strings.IndexByte(text, '('); i > 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+	if i, ok := index[text]; ok {
+		return languages[i], true
+	}
+	if i, ok := index[base(text)]; ok {
+		return languages[i], true
+	}
+	return Language{}, false
+}
+
+// Normalize returns the code of a language given by its code or its name.
+// Unknown languages are returned in lower case
+func Normalize(text string) string {
+	if l, ok := Parse(text); ok {
+		return l.ID()
+	}
+	return strings.ToLower(strings.TrimSpace(text))
+}
+
+// Display returns the name of a language in a locale, unknown languages are
+// returned as they are
+func Display(text, locale string) string {
+	if l, ok := Parse(text); ok {
+		return l.Name(locale)
+	}
+	return text
+}
+
+// Same tells if two codes or names are the same language
+func Same(a, b string) bool {
+	return a != "" && b != "" && Normalize(a) == Normalize(b)
+}
+
+// base removes the region of a language tag, "pt-BR" becomes "pt"
+func base(tag string) string {
+	if i := strings.IndexAny(tag, "-_"); i > 0 {
+		return strings.ToLower(tag[:i])
+	}
+	return strings.ToLower(tag)
+}
@@ -0,0 +1,170 @@
+package language
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+		ok   bool
+	}{
+		{"en", "en", true},
+		{"eng", "en", true},
+		{"English", "en", true},
+		{"anglais", "en", true},
+		{"en-US", "en", true},
+		{"pt-BR", "pt", true},
+		{"PT_br", "pt", true},
+		{"fre", "fr", true},
+		{"fra", "fr", true},
+		{" French (France) ", "fr", true},
+		{"Français", "fr", true},
+		{"русский", "ru", true},
+		{"Deutsch", "de", true},
+		{"grc", "grc", true},
+		{"Ancient Greek", "grc", true},
+		{"zh-Hant-TW", "zh", true},
+		{"", "", false},
+		{"klingon", "", false},
+		{"xx-YY", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Parse(tt.text)
+		if got.ID() != tt.want || ok != tt.ok {
+			t.Errorf("Parse(%q) = %q, %v, want %q, %v", tt.text, got.ID(), ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"English", "en"},
+		{"ger", "de"},
+		{"pt-BR", "pt"},
+		{" Klingon ", "klingon"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.text); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	tests := []struct {
+		text   string
+		locale string
+		want   string
+	}{
+		{"fr", "en", "French"},
+		{"fr", "de-AT", "Französisch"},
+		{"German", "fr", "allemand"},
+		{"ru", "ru", "русский"},
+		{"es", "pt-BR", "Spanish"},
+		{"es", "", "Spanish"},
+		{"Klingon", "en", "Klingon"},
+	}
+	for _, tt := range tests {
+		if got := Display(tt.text, tt.locale); got != tt.want {
+			t.Errorf("Display(%q, %q) = %q, want %q", tt.text, tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestSame(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"fr", "fre", true},
+		{"French", "fr-CA", true},
+		{"en", "fr", false},
+		{"klingon", "Klingon", true},
+		{"", "", false},
+		{"en", "", false},
+	}
+	for _, tt := range tests {
+		if got := Same(tt.a, tt.b); got != tt.want {
+			t.Errorf("Same(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLanguagesNamed(t *testing.T) {
+	for _, l := range languages {
+		if l.Code3 == "" || l.Native == "" {
+			t.Errorf("%q has no ISO 639-3 code or native name", l.ID())
+		}
+		for _, locale := range Locales {
+			if l.Names[locale] == "" {
+				t.Errorf("%q has no name in %q", l.ID(), locale)
+			}
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"english", "It was the best of times, it was the worst of times. He said that she would come with him to the house, and they were happy that it was not raining in the town.", "en"},
+		{"french", "Il était une fois une petite fille qui vivait dans un village avec sa mère. Elle allait souvent dans la forêt pour voir sa grand-mère, mais un jour le loup était sur le chemin.", "fr"},
+		{"german", "Es war einmal ein kleines Mädchen, das mit seiner Mutter in einem Dorf lebte. Sie ging oft in den Wald und besuchte die Großmutter, aber eines Tages war der Wolf auf dem Weg.", "de"},
+		{"spanish", "Había una vez una niña que vivía en un pueblo con su madre. Ella iba muy a menudo al bosque para ver a su abuela, pero un día el lobo estaba en el camino y no había nadie.", "es"},
+		{"italian", "C'era una volta una bambina che viveva in un villaggio con la madre. Lei andava spesso nel bosco per vedere la nonna, ma un giorno il lupo era sulla strada e non c'era nessuno.", "it"},
+		{"russian", "Жила-была девочка, которая жила в деревне со своей матерью. Она часто ходила в лес, чтобы навестить бабушку, но однажды на дороге был волк, и никого не было рядом.", "ru"},
+		{"ukrainian", "Жила-була дівчинка, яка жила в селі зі своєю матір'ю. Вона часто ходила до лісу, щоб відвідати бабусю, але одного дня на дорозі був вовк, і нікого не було поруч.", "uk"},
+		{"greek", "Μια φορά κι έναν καιρό ζούσε ένα μικρό κορίτσι σε ένα χωριό με τη μητέρα του. Πήγαινε συχνά στο δάσος για να δει τη γιαγιά του.", "el"},
+		{"japanese", "昔々、ある村に小さな女の子が母親と一緒に住んでいました。彼女はよく森へおばあさんに会いに行きましたが、ある日、道に狼がいました。", "ja"},
+		{"chinese", "从前有一个小女孩和她的母亲住在一个村庄里。她经常去森林里看望她的祖母，但是有一天，路上有一只狼，周围没有任何人可以帮助她。", "zh"},
+		{"korean", "옛날 옛적에 한 마을에 어린 소녀가 어머니와 함께 살았습니다. 그녀는 자주 숲에 할머니를 만나러 갔지만 어느 날 길에 늑대가 있었습니다.", "ko"},
+		{"arabic", "كان يا ما كان في قديم الزمان فتاة صغيرة تعيش في قرية مع أمها. كانت تذهب كثيرا إلى الغابة لزيارة جدتها، ولكن في يوم من الأيام كان الذئب في الطريق.", "ar"},
+		{"hebrew", "היה היה פעם ילדה קטנה שגרה בכפר עם אמה. היא הלכה לעתים קרובות ליער כדי לבקר את סבתה, אבל יום אחד היה זאב בדרך.", "he"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Detect(tt.text)
+			if !ok || got.ID() != tt.want {
+				t.Errorf("Detect() = %q, %v, want %q", got.ID(), ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectFails(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty", ""},
+		{"short", "Bonjour le monde"},
+		{"numbers", strings.Repeat("1234 5678, ", 50)},
+		{"no stopwords", strings.Repeat("Xyzzy plugh frobnicate quux ", 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := Detect(tt.text); ok {
+				t.Errorf("Detect() = %q, want no language", got.ID())
+			}
+		})
+	}
+}
+
+func TestDetectLongText(t *testing.T) {
+	// only the beginning of a book is read
+	french := "Il était une fois une petite fille qui vivait dans la forêt avec sa mère. "
+	text := strings.Repeat(french, maxDetectedRunes/len([]rune(french))+1) +
+		strings.Repeat("It was the best of times and it was the worst of times for him. ", 1000)
+	if got, ok := Detect(text); !ok || got.ID() != "fr" {
+		t.Errorf("Detect() = %q, %v, want fr", got.ID(), ok)
+	}
+}
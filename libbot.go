@@ -1,30 +1,47 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"mime"
+	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/config"
 	"github.com/geobeau/Libbot/converter"
+	"github.com/geobeau/Libbot/delivery"
+	"github.com/geobeau/Libbot/isbn"
+	"github.com/geobeau/Libbot/jobs"
+	"github.com/geobeau/Libbot/language"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/metadata"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/quota"
 	"github.com/geobeau/Libbot/scraper"
+	"github.com/geobeau/Libbot/storage"
+	"github.com/geobeau/Libbot/throttle"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
-func formatBookMessage(book book.Book) string {
+func formatBookMessage(b book.Book) string {
 	template :=
 		"*%s*\n" +
 			"By _%s_\n" +
 			"%s | %s | %s"
-	message := fmt.Sprintf(template, book.Title, book.Author, book.Year, book.Format, book.Size)
+	format := b.Format()
+	message := fmt.Sprintf(template, b.Title, b.Author(), number(b.Year), format.Extension, size(format.Size))
 	return message
 }
 
-func formatInfoBookMessage(book book.Book) string {
+func formatInfoBookMessage(b book.Book, locale string) string {
 	template :=
 		"Title: *%s*\n" +
 			"Author: _%s_\n" +
@@ -33,151 +50,523 @@ func formatInfoBookMessage(book book.Book) string {
 			"Pages: %s\n" +
 			"Language: %s\n" +
 			"ISBN: %s\n"
-	message := fmt.Sprintf(template, book.Title, book.Author, book.Year, book.Format,
-		book.Pages, book.Language, book.Isbn)
+	format := strings.TrimSpace(b.Format().Extension + " " + size(b.Format().Size))
+	message := fmt.Sprintf(template, b.Title, b.Author(), number(b.Year), format,
+		number(b.Pages), language.Display(b.Language, locale), formatISBNs(b.ISBNs()))
+	if b.Series.Name != "" {
+		message += fmt.Sprintf("Series: %s\n", plainText(b.Series.String()))
+	}
+	if b.Publisher != "" {
+		message += fmt.Sprintf("Publisher: %s\n", plainText(b.Publisher))
+	}
+	if len(b.Tags) > 0 {
+		message += fmt.Sprintf("Tags: %s\n", plainText(strings.Join(b.Tags, ", ")))
+	}
+	if b.Description != "" {
+		message += "\n" + excerpt(plainText(b.Description), maxDescriptionRunes)
+	}
 	return message
 }
 
-func logUser(user *tb.User) {
-	log.Printf("Request from: %s %s / %s", user.FirstName, user.LastName, user.Username)
+// formatISBNs prints ISBNs as ISBN-13 followed by their ISBN-10
+func formatISBNs(isbns []isbn.ISBN) string {
+	formatted := []string{}
+	for _, i := range isbns {
+		if i.ISBN10() != "" {
+			formatted = append(formatted, fmt.Sprintf("%s (%s)", i.ISBN13(), i.ISBN10()))
+		} else {
+			formatted = append(formatted, i.ISBN13())
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// number prints a number of the book metadata, nothing when it is unknown
+func number(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+// size prints the size of a file, nothing when it is unknown
+func size(bytes int64) string {
+	if bytes <= 0 {
+		return ""
+	}
+	return book.FormatSize(bytes)
+}
+
+// maxDescriptionRunes keeps the book cards under the 1024 characters of the
+// photo captions
+const maxDescriptionRunes = 500
+
+// plainText removes the characters taken as markdown from the text given by
+// the metadata providers
+func plainText(text string) string {
+	return strings.NewReplacer("*", "", "_", " ", "`", "", "[", "(", "]", ")").Replace(text)
+}
+
+// excerpt cuts a text after a number of characters
+func excerpt(text string, max int) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) <= max {
+		return string(runes)
+	}
+	return strings.TrimSpace(string(runes[:max])) + "…"
+}
+
+var logger = logging.Package("main")
+
+// newRequest returns the context of an update, its correlation id follows
+// the request through the logs
+func newRequest(user *tb.User) context.Context {
+	ctx := logging.WithRequestID(context.Background(), logging.NewRequestID())
+	if logging.PII() {
+		logger.InfoContext(ctx, "Request", logging.User(user.ID), "first_name", user.FirstName,
+			"last_name", user.LastName, "username", user.Username)
+	} else {
+		logger.InfoContext(ctx, "Request", logging.User(user.ID))
+	}
+	return ctx
+}
+
+// fatal logs an error and exits
+func fatal(message string, err error) {
+	logger.Error(message, logging.Err(err))
+	os.Exit(1)
+}
+
+// downloadButton sends a book, its data is the id of the book
+var downloadButton = tb.InlineButton{
+	Unique: "download_button",
+	Text:   "Download",
+}
+
+// isbnPrefix starts the searches of an ISBN, like isbn:978-0-06-085398-3
+const isbnPrefix = "isbn:"
+
+// uniqueBooks removes the search results sharing an ISBN with a previous
+// result, they are the same book
+func uniqueBooks(books []book.Book) []book.Book {
+	unique := []book.Book{}
+	seen := map[isbn.ISBN]bool{}
+	for _, b := range books {
+		isbns := b.ISBNs()
+		duplicate := false
+		for _, i := range isbns {
+			duplicate = duplicate || seen[i]
+			seen[i] = true
+		}
+		if !duplicate {
+			unique = append(unique, b)
+		}
+	}
+	return unique
+}
+
+// rankBooks lists the search results in the preferred language of the user
+// first, keeping the order of the source otherwise
+func rankBooks(books []book.Book, preferred string) []book.Book {
+	if preferred == "" {
+		return books
+	}
+	ranked := []book.Book{}
+	others := []book.Book{}
+	for _, b := range books {
+		if language.Same(b.Language, preferred) {
+			ranked = append(ranked, b)
+		} else {
+			others = append(others, b)
+		}
+	}
+	return append(ranked, others...)
+}
+
+// ebookExtensions are the formats calibre can convert from
+var ebookExtensions = []string{".epub", ".mobi", ".azw3", ".fb2"}
+
+// app holds the services shared by the handlers
+type app struct {
+	cfg             *config.Config
+	bot             *tb.Bot
+	store           *storage.Store
+	queue           *jobs.Queue
+	mailer          *delivery.Mailer
+	library         delivery.Library
+	libraryTemplate *template.Template
+	uploads         *uploadRegistry
+	active          *activeJobs
+	access          *access
+	limits          *limits
+	stats           *stats
+	source          *throttle.Transport
+	metadata        metadata.Provider
+	// stopping is cancelled when the bot stops, it ends the background
+	// tasks like the follow checks and the broadcasts
+	stopping   context.Context
+	background sync.WaitGroup
+	// backgroundMu keeps background tasks from starting once the bot stops
+	backgroundMu sync.Mutex
+}
+
+// goBackground runs f in a background task the shutdown waits for, it
+// returns false without running f when the bot is stopping
+func (a *app) goBackground(f func()) bool {
+	a.backgroundMu.Lock()
+	defer a.backgroundMu.Unlock()
+	if a.stopping.Err() != nil {
+		return false
+	}
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		f()
+	}()
+	return true
+}
+
+// downloadPipeline returns the pipeline sending books as telegram documents
+func (a *app) downloadPipeline(to tb.Recipient) *pipeline.Pipeline {
+	return &pipeline.Pipeline{
+		Fetcher:     scraperFetcher{metadata: a.metadata},
+		Uploader:    telegramUploader{bot: a.bot, to: to},
+		Converter:   instrumentedConverter{a.converter()},
+		Notifier:    telegramNotifier{bot: a.bot, to: to},
+		Processors:  []pipeline.Processor{epubRepairProcessor{}, epubMetadataProcessor{}},
+		ConvertFrom: []string{".epub"},
+		ConvertTo:   "mobi",
+		MaxSize:     a.cfg.MaxFileSize,
+	}
+}
+
+// converter returns the configured calibre converter
+func (a *app) converter() converter.Calibre {
+	return converter.Calibre{Binary: a.cfg.Converter.Binary, TempDir: a.cfg.Converter.TempDir}
+}
+
+// run runs the pipeline of a job in the job queue, telling the user when it
+// has to wait. Admins can cancel the job until it is finished
+func (a *app) run(ctx context.Context, job storage.Job, p *pipeline.Pipeline) pipeline.Result {
+	to := &tb.User{ID: job.UserID}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	active := a.active.add(job, cancel)
+	defer a.active.remove(active)
+	var result pipeline.Result
+	err := a.queue.Run(func(position int) {
+		a.bot.Send(to, fmt.Sprintf("Queued, %d job(s) ahead of you...", position))
+	}, func() {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := a.store.StartJob(job.ID); err != nil {
+			logger.ErrorContext(ctx, "Failed to save job", logging.Err(err))
+		}
+		a.active.start(active)
+		result = p.Run(ctx, job.BookID)
+	})
+	switch {
+	case err != nil:
+		// the bot is shutting down
+		a.bot.Send(to, cancelledMessage)
+		result.Outcomes = []pipeline.Outcome{{Stage: pipeline.Fetch, Status: pipeline.Failed, Err: err}}
+	case a.active.cancelled(active):
+		logger.InfoContext(ctx, "Job cancelled", "job", job.ID)
+		a.bot.Send(to, fmt.Sprintf("Your %s request was cancelled by an admin", job.Kind))
+		result.Outcomes = []pipeline.Outcome{{Stage: pipeline.Fetch, Status: pipeline.Failed, Err: errCancelled}}
+	}
+	return result
+}
+
+// checkConfig implements the "config check" command: it validates the
+// configuration and prints it
+func checkConfig(args []string) {
+	cfg, err := config.Load(args, os.Getenv, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cfg.Print(os.Stdout)
+	fmt.Println("Configuration is valid")
 }
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.Println("Starting libbot")
-	token := os.Getenv("BOT_TOKEN")
-	if token == "" {
-		log.Fatal("Token is not set, please set BOT_TOKEN env variable")
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		checkConfig(os.Args[3:])
 		return
 	}
+	cfg, err := config.Load(os.Args[1:], os.Getenv, os.Stderr)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if err := logging.Configure(os.Stderr, cfg.Log.Format, cfg.Log.Level, cfg.Log.Packages); err != nil {
+		fatal("Invalid log configuration", err)
+	}
+	logging.SetPrivacy(cfg.Log.PII, cfg.Log.HashKey)
+	logger.Info("Starting libbot")
+	scraper.BaseURL = strings.TrimSuffix(cfg.Source.URL, "/")
+	source := newSourceTransport(cfg.Source)
+	scraper.Client = &http.Client{Transport: source}
+
+	var hook *webhook
+	var poller tb.Poller = &tb.LongPoller{Timeout: 10 * time.Second}
+	if cfg.Poller.Mode == "webhook" {
+		hook = newWebhook(cfg.Poller.Webhook)
+		poller = hook
+	}
 
 	b, err := tb.NewBot(tb.Settings{
-		Token:  token,
-		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
+		Token:  cfg.Token,
+		Poller: poller,
+		Client: &http.Client{Transport: telegramTransport{}},
 	})
 
 	if err != nil {
-		log.Fatal(err)
-		return
+		fatal("Failed to connect to telegram", err)
+	}
+	logger.Info("Connected to api")
+	if hook == nil {
+		// a webhook left by a previous run would prevent long polling
+		if err := deleteWebhook(b); err != nil {
+			logger.Error("Failed to delete webhook", logging.Err(err))
+		}
 	}
-	log.Println("Connected to api")
 
-	downloadButton := tb.InlineButton{
-		Unique: "download_button",
-		Text:   "Download",
+	store, err := storage.Open(cfg.StoragePath)
+	if err != nil {
+		fatal("Failed to open storage", err)
+	}
+	library, libraryTemplate, err := newLibrary(cfg.Library)
+	if err != nil {
+		fatal("Invalid library configuration", err)
+	}
+	a := &app{
+		cfg:             cfg,
+		bot:             b,
+		store:           store,
+		queue:           jobs.NewQueue(cfg.Workers),
+		mailer:          newMailer(cfg.SMTP),
+		library:         library,
+		libraryTemplate: libraryTemplate,
+		uploads:         newUploadRegistry(),
+		active:          newActiveJobs(),
+		stats:           newStats(),
+		source:          source,
+		metadata:        newMetadataProvider(cfg.Metadata),
 	}
+	a.access, err = newAccess(cfg.Access, store, b)
+	if err != nil {
+		fatal("Invalid access configuration", err)
+	}
+	a.limits, err = newLimits(cfg.Limits, store)
+	if err != nil {
+		fatal("Invalid limits configuration", err)
+	}
+	registerQueueMetrics(a.queue)
+	// conversions interrupted by a crash leave their temporary files behind
+	if err := a.converter().Cleanup(); err != nil {
+		logger.Error("Failed to remove temporary files", logging.Err(err))
+	}
+	a.resumeJobs()
+
 	infoButton := tb.InlineButton{
 		Unique: "info_button",
 		Text:   "More info",
 	}
+	kindleButton := tb.InlineButton{
+		Unique: "kindle_button",
+		Text:   "Send to Kindle",
+	}
+	libraryButton := tb.InlineButton{
+		Unique: "library_button",
+		Text:   "Save to my library",
+	}
+	bookButtons := func(id string) [][]tb.InlineButton {
+		download, info, kindle, save, shelve := downloadButton, infoButton, kindleButton, libraryButton, shelveButton
+		download.Data, info.Data, kindle.Data, save.Data, shelve.Data = id, id, id, id, id
+		row := []tb.InlineButton{info, download, shelve}
+		if a.mailer != nil {
+			row = append(row, kindle)
+		}
+		if a.library != nil {
+			row = append(row, save)
+		}
+		return [][]tb.InlineButton{row}
+	}
 
-	b.Handle(&infoButton, func(c *tb.Callback) {
-		logUser(c.Sender)
+	a.handleCallback(&infoButton, func(ctx context.Context, c *tb.Callback) {
 		b.Respond(c, &tb.CallbackResponse{Text: "Fetching more data..."})
-		log.Println("Fetching more details about: ", c.Data)
-		bookMetadata, err := scraper.FetchBookMetadata(c.Data)
+		logger.InfoContext(ctx, "Fetching more details", "book", c.Data)
+		bookMetadata, err := scraper.FetchBookMetadata(ctx, c.Data)
 		if err != nil {
-			log.Println("Failed to query URL: ", err)
+			logger.ErrorContext(ctx, "Failed to fetch details", logging.Err(err))
 			return
 		}
-		message := formatInfoBookMessage(bookMetadata)
-		log.Println(bookMetadata.CoverURL, message)
+		bookMetadata = metadata.Enrich(ctx, a.metadata, bookMetadata)
+		message := formatInfoBookMessage(bookMetadata, c.Sender.LanguageCode)
 		p := &tb.Photo{File: tb.FromURL(bookMetadata.CoverURL)}
 		p.Caption = message
-		downloadButton.Data = bookMetadata.ID
-		inlineButtons := [][]tb.InlineButton{
-			[]tb.InlineButton{downloadButton},
-		}
+		inlineButtons := bookButtons(bookMetadata.ID)
 		_, err = b.Send(c.Sender, p, tb.ModeMarkdown, &tb.ReplyMarkup{
-			InlineKeyboard: inlineButtons,
+			InlineKeyboard: [][]tb.InlineButton{inlineButtons[0][1:]},
 		})
 		if err != nil {
-			log.Println("Failed to upload to telegram: ", err)
+			logger.ErrorContext(ctx, "Failed to upload to telegram", logging.Err(err))
 			return
 		}
 	})
 
-	b.Handle(&downloadButton, func(c *tb.Callback) {
-		logUser(c.Sender)
-		b.Send(c.Sender, "Downloading...")
-		bookMetadata, err := scraper.FetchBookMetadata(c.Data)
-		if err != nil {
-			log.Println("Failed to query URL: ", err)
+	a.handleCallback(&downloadButton, func(ctx context.Context, c *tb.Callback) {
+		if !a.allow(ctx, c.Sender, quota.Download) {
+			b.Respond(c, &tb.CallbackResponse{Text: "Try again later"})
 			return
 		}
-		bookResp, err := scraper.GetBookFile(bookMetadata.Checksum)
-		if err != nil {
-			log.Print(err)
-			return
+		b.Send(c.Sender, "Downloading...")
+		result := a.submit(ctx, storage.Job{UserID: c.Sender.ID, Kind: jobDownload, BookID: c.Data})
+		if err := result.Err(); err != nil {
+			logger.ErrorContext(ctx, "Download failed", logging.Err(err))
 		}
-		_, params, err := mime.ParseMediaType(bookResp.Header.Get("Content-Disposition"))
+	})
 
-		if err != nil {
-			log.Print(err)
-			b.Send(c.Sender, "Failed... (probably too many books downloaded today)")
-			return
+	// everyone can use /start to redeem an invite and /forgetme
+	b.Handle("/start", a.handleStart)
+	b.Handle("/forgetme", func(m *tb.Message) {
+		a.forgetMe(newRequest(m.Sender), m)
+	})
+
+	a.handleMessage("/invite", a.handleInvite)
+	a.handleMessage("/role", a.handleRole)
+	a.handleMessage("/settings", a.handleSettings)
+	a.handleMessage("/quota", a.handleQuota)
+	a.handleMessage("/history", a.handleHistory)
+	a.handleCallback(&historyPageButton, a.showHistoryPage)
+	a.handleCallback(&historyResendButton, a.resendDelivery)
+	a.handleCallback(&historyConvertButton, a.convertDelivery)
+	a.handleCallback(&historyDeleteButton, a.deleteDelivery)
+	a.handleMessage("/follow", a.handleFollow)
+	a.handleCallback(&unfollowButton, a.unfollow)
+	a.handleMessage("/shelves", a.handleShelves)
+	a.handleCallback(&shelveButton, a.shelveBook)
+	a.handleCallback(&shelfAddButton, a.addToChosenShelf)
+	a.handleCallback(&shelvesButton, a.showShelves)
+	a.handleCallback(&shelfOpenButton, a.openShelf)
+	a.handleCallback(&shelfMoveButton, a.chooseMoveTarget)
+	a.handleCallback(&shelfMoveToButton, a.moveToShelf)
+	a.handleCallback(&shelfRemoveButton, a.removeFromShelf)
+	a.handleMessage("/stats", a.adminOnly(a.handleStats))
+	a.handleMessage("/jobs", a.adminOnly(a.handleJobs))
+	a.handleCallback(&cancelJobButton, a.cancelJob)
+	a.handleMessage("/ban", a.adminOnly(a.handleBan(true)))
+	a.handleMessage("/unban", a.adminOnly(a.handleBan(false)))
+	a.handleMessage("/broadcast", a.adminOnly(a.handleBroadcast))
+
+	if a.mailer != nil {
+		a.handleCallback(&kindleButton, a.sendToKindle)
+	}
+
+	if a.library != nil {
+		a.handleCallback(&libraryButton, a.saveToLibrary)
+	}
+
+	a.handleMessage(tb.OnDocument, a.handleDocument)
+	a.handleCallback(&convertButton, a.convertUpload)
+
+	a.handleMessage(tb.OnText, func(ctx context.Context, m *tb.Message) {
+		if logging.PII() {
+			logger.InfoContext(ctx, "Searching", "query", m.Text)
+		} else {
+			logger.InfoContext(ctx, "Searching", "query_length", len(m.Text))
 		}
-		buf := new(bytes.Buffer)
-		_, err = buf.ReadFrom(bookResp.Body)
-		if err != nil {
-			log.Print(err)
+		if !a.allow(ctx, m.Sender, quota.Search) {
 			return
 		}
-
-		telegramFile := tb.FromReader(bytes.NewReader(buf.Bytes()))
-		telegramFile.FileName = params["filename"]
-
-		bookFile := &tb.Document{File: telegramFile}
-		log.Println("Sending: ", params["filename"])
-		b.Send(c.Sender, "Uploading to Telegram...")
-		_, err = bookFile.Send(b, c.Sender, nil)
-		if err != nil {
-			log.Println("Error:", err)
-		}
-		extension := filepath.Ext(params["filename"])
-		if extension == ".epub" {
-			b.Send(c.Sender, "Converting to mobi as well...")
-			filename, content, convertErr := converter.ConvertFile(params["filename"], buf.Bytes())
-			if convertErr != nil {
-				log.Println("Error while converting:", convertErr)
-				b.Send(c.Sender, "Convertion failed :'(")
-			}
-			telegramFile = tb.FromReader(bytes.NewReader(content))
-			telegramFile.FileName = filepath.Base(filename)
-			bookFile = &tb.Document{File: telegramFile}
-			_, err = bookFile.Send(b, c.Sender, nil)
+		query := m.Text
+		a.stats.search(query)
+		if strings.HasPrefix(strings.ToLower(query), isbnPrefix) {
+			i, err := isbn.Parse(query[len(isbnPrefix):])
 			if err != nil {
-				log.Println("Error:", err)
+				b.Send(m.Sender, fmt.Sprintf("Invalid ISBN: %v", err))
+				return
 			}
+			query = i.ISBN13()
 		}
-	})
-
-	b.Handle(tb.OnText, func(m *tb.Message) {
-		logUser(m.Sender)
-		log.Println("Received:", m.Text)
-		query := m.Text
 		b.Send(m.Sender, "Searching...")
-		books := scraper.SearchBooks(query)
+		books, err := scraper.SearchBooks(ctx, query)
+		if errors.Is(err, throttle.ErrOpen) {
+			searchesTotal.Inc("unavailable")
+			b.Send(m.Sender, pipeline.UnavailableMessage)
+			return
+		}
+		if err != nil {
+			searchesTotal.Inc("error")
+			b.Send(m.Sender, "Search failed, please try again later")
+			return
+		}
 		if len(books) == 0 {
+			searchesTotal.Inc("empty")
 			b.Send(m.Sender, "No result found")
 			return
 		}
+		searchesTotal.Inc("found")
+		books = rankBooks(uniqueBooks(books), a.store.Settings(m.Sender.ID).Language)
 		for i := range books {
-			log.Println(books[i])
-			downloadButton.Data = books[i].ID
-			infoButton.Data = books[i].ID
-			inlineButtons := [][]tb.InlineButton{
-				[]tb.InlineButton{infoButton, downloadButton},
-			}
+			logger.DebugContext(ctx, "Search result", "book", books[i].ID, "title", books[i].Title)
 			b.Send(m.Sender, formatBookMessage(books[i]), tb.ModeMarkdown, &tb.ReplyMarkup{
-				InlineKeyboard: inlineButtons,
+				InlineKeyboard: bookButtons(books[i].ID),
 			})
-			if i >= 10 {
+			if i+1 >= cfg.ResultsLimit {
 				break
 			}
 		}
 	})
 
-	log.Println("Handler started")
+	var admin *adminServer
+	if cfg.Admin.Listen != "" {
+		admin = a.newAdminServer(cfg.Admin.Listen)
+		go admin.serve()
+	}
+	stopping, stopBackground := context.WithCancel(context.Background())
+	a.stopping = stopping
+	a.goBackground(func() { a.flushUsage(stopping, usageFlushInterval) })
+	if cfg.Follow.Interval > 0 {
+		a.goBackground(func() {
+			a.watchFollows(stopping, time.Duration(cfg.Follow.Interval)*time.Second)
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("Stopping", "signal", sig.String())
+		b.Stop()
+	}()
+
+	logger.Info("Handler started")
 	b.Start()
+
+	// no background task starts after the cancel, the wait sees them all
+	a.backgroundMu.Lock()
+	stopBackground()
+	a.backgroundMu.Unlock()
+	a.background.Wait()
+	if hook != nil {
+		if err := hook.err(); err != nil {
+			fatal("Failed to register webhook", err)
+		}
+		hook.shutdown()
+		if err := deleteWebhook(b); err != nil {
+			logger.Error("Failed to delete webhook", logging.Err(err))
+		}
+	}
+	a.shutdown()
+	// the jobs stopped, what they consumed is written last
+	if err := a.store.Flush(); err != nil {
+		logger.Error("Failed to save usage", logging.Err(err))
+	}
+	if admin != nil {
+		admin.shutdown()
+	}
+	logger.Info("Stopped")
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"text/template"
+
+	"github.com/geobeau/Libbot/config"
+	"github.com/geobeau/Libbot/delivery"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/quota"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// newLibrary configures the library delivery, it returns a nil library
+// when neither a WebDAV server nor a directory is set
+func newLibrary(cfg config.Library) (delivery.Library, *template.Template, error) {
+	tmpl, err := delivery.ParseTemplate(cfg.Template)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.WebDAVURL != "" {
+		return delivery.WebDAV{
+			URL:      cfg.WebDAVURL,
+			Username: cfg.WebDAVUsername,
+			Password: cfg.WebDAVPassword,
+		}, tmpl, nil
+	}
+	if cfg.Dir != "" {
+		return delivery.Folder{Path: cfg.Dir}, tmpl, nil
+	}
+	return nil, nil, nil
+}
+
+// saveToLibrary stores a book in the library folder of the user
+func (a *app) saveToLibrary(ctx context.Context, c *tb.Callback) {
+	if !a.allow(ctx, c.Sender, quota.Download) {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Try again later"})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Saving to your library..."})
+	job := storage.Job{UserID: c.Sender.ID, Kind: jobLibrary, BookID: c.Data}
+	if err := a.submit(ctx, job).Err(); err != nil {
+		logger.ErrorContext(ctx, "Library delivery failed", logging.Err(err))
+	}
+}
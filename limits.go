@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/config"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/quota"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// limits applies the rate limits and the daily quotas of the users
+type limits struct {
+	store  *storage.Store
+	rates  map[string]quota.Rate
+	quotas map[string]map[string]int
+}
+
+// newLimits parses the limits configuration
+func newLimits(cfg config.Limits, store *storage.Store) (*limits, error) {
+	rates, err := quota.ParseRates(cfg.Rates)
+	if err != nil {
+		return nil, err
+	}
+	l := &limits{store: store, rates: rates, quotas: map[string]map[string]int{}}
+	for role, values := range cfg.Quotas() {
+		if l.quotas[role], err = quota.ParseQuotas(values); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// limit returns the limit of an action for a role, admins have no rate limit
+func (l *limits) limit(role, action string) quota.Limit {
+	limit := quota.Limit{Daily: quota.Unlimited}
+	if role != storage.RoleAdmin {
+		limit.Rate = l.rates[action]
+	}
+	if daily, ok := l.quotas[role][action]; ok {
+		limit.Daily = daily
+	}
+	return limit
+}
+
+// limitedMessages explain why an action was refused, by action
+var limitedMessages = map[string]string{
+	quota.Search:   "You are searching too fast",
+	quota.Download: "You are downloading too fast",
+	quota.Convert:  "You are converting too fast",
+}
+
+// allow consumes an action of the user of a request. When it is refused, the
+// user is told when to try again
+func (a *app) allow(ctx context.Context, user *tb.User, action string) bool {
+	wait, err := a.store.Consume(user.ID, action, a.limits.limit(roleOf(ctx), action), time.Now())
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, quota.ErrRateLimited):
+		limitedTotal.Inc(action, "rate")
+		logger.InfoContext(ctx, "Rate limited", "action", action, "wait", wait)
+		a.bot.Send(user, limitedMessages[action]+", try again in "+quota.FormatWait(wait))
+	case errors.Is(err, quota.ErrQuotaUsed):
+		limitedTotal.Inc(action, "quota")
+		logger.InfoContext(ctx, "Daily quota used", "action", action)
+		a.bot.Send(user, fmt.Sprintf("You used your daily %s quota, try again in %s. Send /quota to see what you have left", action, quota.FormatWait(wait)))
+	}
+	return false
+}
+
+// usageFlushInterval is how often the usage of the limits is written, the
+// actions consumed since the last write are lost by a crash
+const usageFlushInterval = 10 * time.Second
+
+// flushUsage writes the usage of the limits periodically until ctx is done
+func (a *app) flushUsage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := a.store.Flush(); err != nil {
+			logger.ErrorContext(ctx, "Failed to save usage", logging.Err(err))
+		}
+	}
+}
+
+// jobActions are the actions consumed by the jobs of each kind
+var jobActions = map[string]string{
+	jobDownload: quota.Download,
+	jobKindle:   quota.Download,
+	jobLibrary:  quota.Download,
+	jobConvert:  quota.Convert,
+}
+
+// refund gives back the action consumed by a job which couldn't fetch its
+// book, the user got nothing for it
+func (a *app) refund(ctx context.Context, job storage.Job) {
+	action, ok := jobActions[job.Kind]
+	if !ok {
+		return
+	}
+	a.store.Refund(job.UserID, action, a.limits.limit(job.Role, action), time.Now())
+	logger.InfoContext(ctx, "Refunded", "action", action, "job", job.ID)
+}
+
+// limitedConverter consumes a conversion of the user of a job before each
+// conversion is announced, the conversions done by the jobs cost as much as
+// the ones asked for
+type limitedConverter struct {
+	pipeline.Converter
+	app *app
+	// user and role are the ones of the job
+	user *tb.User
+	role string
+}
+
+// Admit implements pipeline.Admitter
+func (c limitedConverter) Admit(ctx context.Context) error {
+	if !c.app.allow(withRole(ctx, c.role), c.user, quota.Convert) {
+		return pipeline.ErrRefused
+	}
+	return nil
+}
+
+// handleQuota tells a user what is left of the limits
+func (a *app) handleQuota(ctx context.Context, m *tb.Message) {
+	role := roleOf(ctx)
+	usage := a.store.Usage(m.Sender.ID)
+	now := time.Now()
+	lines := []string{"What you have left (" + role + "):"}
+	for _, action := range quota.Actions {
+		limit := a.limits.limit(role, action)
+		available, remaining := usage.Left(action, limit, now)
+		line := "• " + action + ": "
+		if remaining == quota.Unlimited {
+			line += "no daily quota"
+		} else {
+			line += fmt.Sprintf("%d of %d today", remaining, limit.Daily)
+		}
+		if limit.Rate.Burst > 0 {
+			line += fmt.Sprintf(", %d right now", available)
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "Daily quotas reset in "+quota.FormatWait(quota.UntilTomorrow(now)))
+	a.bot.Send(m.Sender, strings.Join(lines, "\n"))
+}
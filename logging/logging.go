@@ -0,0 +1,173 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Formats of the logs
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// state is the output and the levels set by Configure, package loggers are
+// created before it runs so they read it on every call
+var state = struct {
+	sync.RWMutex
+	handler  slog.Handler
+	level    slog.Level
+	packages map[string]slog.Level
+}{
+	handler:  slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	level:    slog.LevelInfo,
+	packages: map[string]slog.Level{},
+}
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", name)
+	}
+	return level, nil
+}
+
+// ParsePackageLevels parses levels given by package, like "scraper=debug"
+func ParsePackageLevels(values []string) (map[string]slog.Level, error) {
+	levels := map[string]slog.Level{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid package log level %q, expected package=level", value)
+		}
+		level, err := ParseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		levels[strings.TrimSpace(parts[0])] = level
+	}
+	return levels, nil
+}
+
+// Configure sets the output, the format and the levels of every logger. The
+// standard log package is redirected to the "std" package logger
+func Configure(w io.Writer, format, level string, packages []string) error {
+	defaultLevel, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	packageLevels, err := ParsePackageLevels(packages)
+	if err != nil {
+		return err
+	}
+	// the levels are checked by the package handlers
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch format {
+	case FormatLogfmt, "":
+		handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	state.Lock()
+	state.handler = handler
+	state.level = defaultLevel
+	state.packages = packageLevels
+	state.Unlock()
+	slog.SetDefault(Package("std"))
+	return nil
+}
+
+// Package returns the logger of a package, its verbosity can be set
+// separately with Configure
+func Package(name string) *slog.Logger {
+	return slog.New(&packageHandler{pkg: name})
+}
+
+// packageHandler writes the records of a package to the configured handler
+type packageHandler struct {
+	pkg string
+	// ops replays the WithAttrs and WithGroup calls on the configured handler
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *packageHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	state.RLock()
+	defer state.RUnlock()
+	minimum, ok := state.packages[h.pkg]
+	if !ok {
+		minimum = state.level
+	}
+	return level >= minimum
+}
+
+func (h *packageHandler) Handle(ctx context.Context, r slog.Record) error {
+	state.RLock()
+	handler := state.handler
+	state.RUnlock()
+	handler = handler.WithAttrs([]slog.Attr{slog.String("package", h.pkg)})
+	if id := RequestID(ctx); id != "" {
+		handler = handler.WithAttrs([]slog.Attr{slog.String("request_id", id)})
+	}
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *packageHandler) with(op func(slog.Handler) slog.Handler) *packageHandler {
+	ops := append(append([]func(slog.Handler) slog.Handler(nil), h.ops...), op)
+	return &packageHandler{pkg: h.pkg, ops: ops}
+}
+
+func (h *packageHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *packageHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying a correlation id, it is added to
+// the records logged with it
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the correlation id of a context, if any
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random correlation id
+func NewRequestID() string {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Err is the attribute of an error
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.String("error", "")
+	}
+	return slog.String("error", err.Error())
+}
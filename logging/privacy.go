@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// privacy controls how users appear in the logs
+var privacy = struct {
+	sync.RWMutex
+	pii bool
+	key []byte
+}{key: randomKey()}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// SetPrivacy enables or disables the logging of personal data (user ids,
+// names, search queries). When it is disabled, user ids are replaced by a
+// keyed hash so the lines of a user can still be followed. An empty key
+// uses a random one, the hashes then change on every start
+func SetPrivacy(pii bool, hashKey string) {
+	privacy.Lock()
+	defer privacy.Unlock()
+	privacy.pii = pii
+	if hashKey == "" {
+		privacy.key = randomKey()
+	} else {
+		privacy.key = []byte(hashKey)
+	}
+}
+
+// PII tells if personal data can be logged
+func PII() bool {
+	privacy.RLock()
+	defer privacy.RUnlock()
+	return privacy.pii
+}
+
+// User is the attribute identifying a user in the logs
+func User(id int) slog.Attr {
+	privacy.RLock()
+	defer privacy.RUnlock()
+	if privacy.pii {
+		return slog.Int("user", id)
+	}
+	mac := hmac.New(sha256.New, privacy.key)
+	mac.Write([]byte(strconv.Itoa(id)))
+	return slog.String("user", hex.EncodeToString(mac.Sum(nil))[:16])
+}
@@ -0,0 +1,176 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/logging"
+)
+
+var logger = logging.Package("metadata")
+
+// ErrNotFound is returned when a provider knows nothing about a book
+var ErrNotFound = errors.New("book not found")
+
+// Query identifies the book looked up, by ISBN-13 or by title and author
+type Query struct {
+	ISBN   string
+	Title  string
+	Author string
+}
+
+// key identifies the query in the cache
+func (q Query) key() string {
+	if q.ISBN != "" {
+		return "isbn:" + q.ISBN
+	}
+	return "title:" + strings.ToLower(q.Title) + "|" + strings.ToLower(q.Author)
+}
+
+// Metadata contains what a provider knows about a book, empty fields are
+// unknown
+type Metadata struct {
+	Description string
+	Subjects    []string
+	Series      string
+	Publisher   string
+	Pages       int
+	CoverURL    string
+}
+
+// Provider looks up the metadata of books
+type Provider interface {
+	Lookup(ctx context.Context, q Query) (Metadata, error)
+}
+
+// QueryFromBook builds the query of a book: its first ISBN when it has one,
+// its title and first author otherwise
+func QueryFromBook(b book.Book) Query {
+	if isbns := b.ISBNs(); len(isbns) > 0 {
+		return Query{ISBN: isbns[0].ISBN13()}
+	}
+	q := Query{Title: strings.TrimSpace(b.Title)}
+	if len(b.Authors) > 0 {
+		q.Author = strings.TrimSpace(b.Authors[0].Name)
+	}
+	return q
+}
+
+// Merge fills the fields of a book the source left empty with the metadata
+func Merge(b book.Book, m Metadata) book.Book {
+	if b.Description == "" {
+		b.Description = m.Description
+	}
+	if len(b.Tags) == 0 && len(m.Subjects) > 0 {
+		b.Tags = append([]string(nil), m.Subjects...)
+	}
+	if b.Series.Name == "" {
+		b.Series = book.Series{Name: m.Series}
+	}
+	if b.Publisher == "" {
+		b.Publisher = m.Publisher
+	}
+	if b.Pages == 0 {
+		b.Pages = m.Pages
+	}
+	if b.CoverURL == "" {
+		b.CoverURL = m.CoverURL
+	}
+	return b
+}
+
+// Enrich looks up a book and merges what the provider knows. The book is
+// returned unchanged when the provider is nil, doesn't know the book or fails
+func Enrich(ctx context.Context, p Provider, b book.Book) book.Book {
+	if p == nil {
+		return b
+	}
+	q := QueryFromBook(b)
+	if q.ISBN == "" && q.Title == "" {
+		return b
+	}
+	m, err := p.Lookup(ctx, q)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		logger.DebugContext(ctx, "No metadata found", "book", b.ID)
+		return b
+	case err != nil:
+		logger.WarnContext(ctx, "Failed to look up metadata", "book", b.ID, logging.Err(err))
+		return b
+	}
+	return Merge(b, m)
+}
+
+// cached is a lookup result kept by the cache
+type cached struct {
+	metadata Metadata
+	err      error
+	expires  time.Time
+}
+
+// Cache keeps the results of a provider, including the books it doesn't
+// know. Failed lookups aren't kept
+type Cache struct {
+	Provider Provider
+	TTL      time.Duration
+	// Size is the maximum number of results kept, the ones expiring first
+	// are evicted
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]cached
+}
+
+// NewCache returns a cache of a provider
+func NewCache(p Provider, ttl time.Duration, size int) *Cache {
+	return &Cache{Provider: p, TTL: ttl, Size: size, entries: map[string]cached{}}
+}
+
+// Lookup implements Provider
+func (c *Cache) Lookup(ctx context.Context, q Query) (Metadata, error) {
+	key := q.key()
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.metadata, entry.err
+	}
+
+	m, err := c.Provider.Lookup(ctx, q)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return m, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, refreshed := c.entries[key]
+	if !refreshed && len(c.entries) >= c.Size {
+		c.evict(now)
+	}
+	if refreshed || len(c.entries) < c.Size {
+		c.entries[key] = cached{metadata: m, err: err, expires: now.Add(c.TTL)}
+	}
+	return m, err
+}
+
+// evict removes the expired results, or the one expiring first when none
+// has expired
+func (c *Cache) evict(now time.Time) {
+	oldest := ""
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(c.entries) >= c.Size && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
@@ -0,0 +1,201 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/geobeau/Libbot/logging"
+)
+
+// maxSubjects is the number of subjects kept from Open Library, its works
+// often list dozens
+const maxSubjects = 10
+
+// OpenLibrary looks up books with the JSON API of Open Library
+type OpenLibrary struct {
+	// BaseURL is the address of the API, like https://openlibrary.org
+	BaseURL string
+	// CoversURL is the address of the cover images, like
+	// https://covers.openlibrary.org
+	CoversURL string
+	Client    *http.Client
+}
+
+// text is a description, given either as a string or as an object with a
+// value
+type text string
+
+func (t *text) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*t = text(s)
+		return nil
+	}
+	var v struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*t = text(v.Value)
+	return nil
+}
+
+// edition is a book of /isbn/<isbn>.json
+type edition struct {
+	Description   text     `json:"description"`
+	Subjects      []string `json:"subjects"`
+	Series        []string `json:"series"`
+	Publishers    []string `json:"publishers"`
+	NumberOfPages int      `json:"number_of_pages"`
+	Covers        []int    `json:"covers"`
+	Works         []struct {
+		Key string `json:"key"`
+	} `json:"works"`
+}
+
+// work is a work of /works/<id>.json, shared by its editions
+type work struct {
+	Description text     `json:"description"`
+	Subjects    []string `json:"subjects"`
+	Covers      []int    `json:"covers"`
+}
+
+// searchResults is the answer of /search.json
+type searchResults struct {
+	Docs []struct {
+		Key                 string   `json:"key"`
+		Publishers          []string `json:"publisher"`
+		NumberOfPagesMedian int      `json:"number_of_pages_median"`
+		CoverID             int      `json:"cover_i"`
+		Subjects            []string `json:"subject"`
+	} `json:"docs"`
+}
+
+// Lookup implements Provider, books are found by ISBN or searched by title
+// and author. The description and subjects come from the work of the book
+func (o OpenLibrary) Lookup(ctx context.Context, q Query) (Metadata, error) {
+	if q.ISBN != "" {
+		return o.lookupISBN(ctx, q.ISBN)
+	}
+	return o.search(ctx, q.Title, q.Author)
+}
+
+func (o OpenLibrary) lookupISBN(ctx context.Context, isbn string) (Metadata, error) {
+	var e edition
+	if err := o.get(ctx, "/isbn/"+url.PathEscape(isbn)+".json", &e); err != nil {
+		return Metadata{}, err
+	}
+	m := Metadata{
+		Description: strings.TrimSpace(string(e.Description)),
+		Subjects:    e.Subjects,
+		Pages:       e.NumberOfPages,
+		CoverURL:    o.coverURL(e.Covers),
+	}
+	if len(e.Series) > 0 {
+		m.Series = strings.TrimSpace(e.Series[0])
+	}
+	if len(e.Publishers) > 0 {
+		m.Publisher = strings.TrimSpace(e.Publishers[0])
+	}
+	if len(e.Works) > 0 {
+		o.addWork(ctx, e.Works[0].Key, &m)
+	}
+	m.Subjects = limitSubjects(m.Subjects)
+	return m, nil
+}
+
+func (o OpenLibrary) search(ctx context.Context, title, author string) (Metadata, error) {
+	query := url.Values{"title": {title}, "limit": {"1"},
+		"fields": {"key,publisher,number_of_pages_median,cover_i,subject"}}
+	if author != "" {
+		query.Set("author", author)
+	}
+	var results searchResults
+	if err := o.get(ctx, "/search.json?"+query.Encode(), &results); err != nil {
+		return Metadata{}, err
+	}
+	if len(results.Docs) == 0 {
+		return Metadata{}, ErrNotFound
+	}
+	doc := results.Docs[0]
+	m := Metadata{Subjects: doc.Subjects, Pages: doc.NumberOfPagesMedian}
+	if len(doc.Publishers) > 0 {
+		m.Publisher = strings.TrimSpace(doc.Publishers[0])
+	}
+	if doc.CoverID > 0 {
+		m.CoverURL = o.coverURL([]int{doc.CoverID})
+	}
+	o.addWork(ctx, doc.Key, &m)
+	m.Subjects = limitSubjects(m.Subjects)
+	return m, nil
+}
+
+// addWork completes the metadata with the work of the book, a failure only
+// leaves the metadata incomplete
+func (o OpenLibrary) addWork(ctx context.Context, key string, m *Metadata) {
+	if !strings.HasPrefix(key, "/works/") {
+		return
+	}
+	var w work
+	if err := o.get(ctx, key+".json", &w); err != nil {
+		logger.DebugContext(ctx, "Failed to fetch work", "work", key, logging.Err(err))
+		return
+	}
+	if m.Description == "" {
+		m.Description = strings.TrimSpace(string(w.Description))
+	}
+	if len(m.Subjects) == 0 {
+		m.Subjects = w.Subjects
+	}
+	if m.CoverURL == "" {
+		m.CoverURL = o.coverURL(w.Covers)
+	}
+}
+
+// coverURL returns the URL of the large image of the first valid cover
+func (o OpenLibrary) coverURL(covers []int) string {
+	for _, id := range covers {
+		// Open Library marks deleted covers with -1
+		if id > 0 {
+			return fmt.Sprintf("%s/b/id/%d-L.jpg", strings.TrimSuffix(o.CoversURL, "/"), id)
+		}
+	}
+	return ""
+}
+
+// get decodes a JSON document of the API
+func (o OpenLibrary) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(o.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("open library %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func limitSubjects(subjects []string) []string {
+	if len(subjects) > maxSubjects {
+		return subjects[:maxSubjects]
+	}
+	return subjects
+}
@@ -0,0 +1,228 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/geobeau/Libbot/book"
+)
+
+// fixtures are the documents served by the fake Open Library, by path
+var fixtures = map[string]string{
+	"/isbn/9780441172719.json": `{
+		"publishers": ["Ace Books"],
+		"number_of_pages": 535,
+		"series": ["Dune Chronicles"],
+		"covers": [-1, 12345],
+		"works": [{"key": "/works/OL893415W"}]
+	}`,
+	"/works/OL893415W.json": `{
+		"description": {"type": "/type/text", "value": " Set on the desert planet Arrakis. "},
+		"subjects": ["Science fiction", "Dune (Imaginary place)"],
+		"covers": [999]
+	}`,
+	"/isbn/9780140449136.json": `{
+		"description": "A novel by Dostoevsky.",
+		"subjects": ["Fiction", "Russia"],
+		"publishers": ["Penguin"]
+	}`,
+	"/search.json": `{"docs": [{
+		"key": "/works/OL2W",
+		"publisher": ["Gollancz"],
+		"number_of_pages_median": 320,
+		"cover_i": 777
+	}]}`,
+	"/works/OL2W.json": `{"description": "Found by title.", "subjects": ["Fantasy"]}`,
+}
+
+// fixtureServer serves the fixtures, the search only knows "The Colour of
+// Magic"
+func fixtureServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/search.json" && r.URL.Query().Get("title") != "The Colour of Magic" {
+			w.Write([]byte(`{"docs": []}`))
+			return
+		}
+		fixture, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fixture))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenLibraryLookup(t *testing.T) {
+	server := fixtureServer(t)
+	o := OpenLibrary{BaseURL: server.URL + "/", CoversURL: "https://covers.example.com"}
+	tests := []struct {
+		name  string
+		query Query
+		want  Metadata
+		err   error
+	}{
+		{
+			name:  "isbn with work",
+			query: Query{ISBN: "9780441172719"},
+			want: Metadata{
+				Description: "Set on the desert planet Arrakis.",
+				Subjects:    []string{"Science fiction", "Dune (Imaginary place)"},
+				Series:      "Dune Chronicles",
+				Publisher:   "Ace Books",
+				Pages:       535,
+				CoverURL:    "https://covers.example.com/b/id/12345-L.jpg",
+			},
+		},
+		{
+			name:  "isbn with string description",
+			query: Query{ISBN: "9780140449136"},
+			want: Metadata{
+				Description: "A novel by Dostoevsky.",
+				Subjects:    []string{"Fiction", "Russia"},
+				Publisher:   "Penguin",
+			},
+		},
+		{
+			name:  "search",
+			query: Query{Title: "The Colour of Magic", Author: "Terry Pratchett"},
+			want: Metadata{
+				Description: "Found by title.",
+				Subjects:    []string{"Fantasy"},
+				Publisher:   "Gollancz",
+				Pages:       320,
+				CoverURL:    "https://covers.example.com/b/id/777-L.jpg",
+			},
+		},
+		{name: "unknown isbn", query: Query{ISBN: "9780000000002"}, err: ErrNotFound},
+		{name: "unknown title", query: Query{Title: "Nothing"}, err: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := o.Lookup(context.Background(), tt.query)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Lookup() error = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenLibraryServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer server.Close()
+	_, err := OpenLibrary{BaseURL: server.URL}.Lookup(context.Background(), Query{ISBN: "9780441172719"})
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Lookup() error = %v, want a failure", err)
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	server := fixtureServer(t)
+	o := OpenLibrary{BaseURL: server.URL, CoversURL: "https://covers.example.com"}
+	b := book.Book{
+		ID:          "1",
+		Title:       "Dune",
+		Publisher:   "Chilton",
+		Identifiers: book.ISBNIdentifiers("0-441-17271-7"),
+	}
+	got := Enrich(context.Background(), o, b)
+	if got.Publisher != "Chilton" {
+		t.Errorf("Publisher = %q, the source must win", got.Publisher)
+	}
+	if got.Series.Name != "Dune Chronicles" || got.Pages != 535 || got.Description == "" {
+		t.Errorf("Enrich() = %+v", got)
+	}
+	unknown := book.Book{ID: "2", Title: "Nothing"}
+	if got := Enrich(context.Background(), o, unknown); !reflect.DeepEqual(got, unknown) {
+		t.Errorf("Enrich() of an unknown book = %+v", got)
+	}
+}
+
+// countingProvider counts the lookups and knows no book but "known"
+type countingProvider struct {
+	lookups int
+	err     error
+}
+
+func (p *countingProvider) Lookup(ctx context.Context, q Query) (Metadata, error) {
+	p.lookups++
+	if p.err != nil {
+		return Metadata{}, p.err
+	}
+	if q.Title != "known" {
+		return Metadata{}, ErrNotFound
+	}
+	return Metadata{Publisher: "Publisher"}, nil
+}
+
+func TestCache(t *testing.T) {
+	provider := &countingProvider{}
+	cache := NewCache(provider, time.Hour, 2)
+	ctx := context.Background()
+	cache.Lookup(ctx, Query{Title: "known"})
+	// the first book expires first
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if m, err := cache.Lookup(ctx, Query{Title: "known"}); err != nil || m.Publisher != "Publisher" {
+			t.Fatalf("Lookup() = %+v, %v", m, err)
+		}
+		if _, err := cache.Lookup(ctx, Query{Title: "unknown"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Lookup() error = %v, want ErrNotFound", err)
+		}
+	}
+	if provider.lookups != 2 {
+		t.Errorf("%d lookups, want 2: found and not found results are cached", provider.lookups)
+	}
+	if _, err := cache.Lookup(ctx, Query{Title: "KNOWN"}); err != nil || provider.lookups != 2 {
+		t.Errorf("the cache must ignore the case of the titles")
+	}
+
+	// a third book evicts the one expiring first
+	cache.Lookup(ctx, Query{Title: "other"})
+	if len(cache.entries) != 2 {
+		t.Errorf("%d entries, want at most 2", len(cache.entries))
+	}
+	if _, ok := cache.entries[Query{Title: "known"}.key()]; ok {
+		t.Errorf("the oldest entry wasn't evicted")
+	}
+}
+
+func TestCacheFailures(t *testing.T) {
+	provider := &countingProvider{err: errors.New("timeout")}
+	cache := NewCache(provider, time.Hour, 10)
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Lookup(context.Background(), Query{Title: "known"}); err == nil {
+			t.Fatal("Lookup() succeeded")
+		}
+	}
+	if provider.lookups != 2 {
+		t.Errorf("%d lookups, want 2: failures aren't cached", provider.lookups)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	provider := &countingProvider{}
+	cache := NewCache(provider, time.Nanosecond, 1)
+	cache.Lookup(context.Background(), Query{Title: "known"})
+	time.Sleep(time.Millisecond)
+	refreshed := time.Now()
+	cache.Lookup(context.Background(), Query{Title: "known"})
+	if provider.lookups != 2 {
+		t.Errorf("%d lookups, want 2: expired results are looked up again", provider.lookups)
+	}
+	if entry := cache.entries[Query{Title: "known"}.key()]; entry.expires.Before(refreshed) {
+		t.Errorf("the expired entry wasn't refreshed in a full cache")
+	}
+}
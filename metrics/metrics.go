@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// collector is a metric family written by a registry
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// DefaultRegistry holds the metrics created by the New functions
+var DefaultRegistry = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes every metric of the registry
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := DefaultRegistry.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// desc describes a metric family
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// key joins label values to index a series
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// series formats the labels of a series, extra is appended to them
+func (d desc) series(key string, extra ...string) string {
+	pairs := []string{}
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec returns a counter registered in the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name, help, "counter", labels}, values: map[string]float64{}}
+	DefaultRegistry.register(c)
+	return c
+}
+
+// Inc adds one to the counter of the label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the counter of the label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counters can't decrease")
+	}
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.series(key), formatValue(c.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are written
+type GaugeFunc struct {
+	desc
+	value func() float64
+}
+
+// NewGaugeFunc returns a gauge registered in the default registry
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help, kind: "gauge"}, value: value}
+	DefaultRegistry.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec returns a histogram registered in the default registry,
+// buckets are the sorted upper bounds of the buckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+	DefaultRegistry.register(h)
+	return h
+}
+
+// Observe adds a value to the histogram of the label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.series(key, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.series(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.series(key), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.series(key), s.count)
+	}
+}
@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+// isolate replaces the default registry during a test
+func isolate(t *testing.T) *Registry {
+	t.Helper()
+	previous := DefaultRegistry
+	DefaultRegistry = NewRegistry()
+	t.Cleanup(func() { DefaultRegistry = previous })
+	return DefaultRegistry
+}
+
+// output returns what a registry writes
+func output(t *testing.T, r *Registry) string {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	r := isolate(t)
+	c := NewCounterVec("libbot_jobs_total", "Jobs by kind\nand status.", "kind", "status")
+	c.Inc("download", "succeeded")
+	c.Add(2.5, "download", "succeeded")
+	c.Inc("convert", "failed")
+	NewCounterVec("libbot_empty_total", "No series yet.")
+
+	want := `# HELP libbot_jobs_total Jobs by kind and status.
+# TYPE libbot_jobs_total counter
+libbot_jobs_total{kind="convert",status="failed"} 1
+libbot_jobs_total{kind="download",status="succeeded"} 3.5
+# HELP libbot_empty_total No series yet.
+# TYPE libbot_empty_total counter
+`
+	if got := output(t, r); got != want {
+		t.Errorf("Write() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	r := isolate(t)
+	c := NewCounterVec("libbot_restarts_total", "Restarts.")
+	c.Inc()
+	c.Inc()
+
+	want := `# HELP libbot_restarts_total Restarts.
+# TYPE libbot_restarts_total counter
+libbot_restarts_total 2
+`
+	if got := output(t, r); got != want {
+		t.Errorf("Write() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := isolate(t)
+	c := NewCounterVec("libbot_errors_total", "Errors.", "error")
+	c.Inc(`path C:\books "quoted"` + "\nsecond line")
+
+	want := `# HELP libbot_errors_total Errors.
+# TYPE libbot_errors_total counter
+libbot_errors_total{error="path C:\\books \"quoted\"\nsecond line"} 1
+`
+	if got := output(t, r); got != want {
+		t.Errorf("Write() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := isolate(t)
+	waiting := 3.0
+	NewGaugeFunc("libbot_queue_waiting_jobs", "Jobs waiting for a worker.", func() float64 { return waiting })
+	NewGaugeFunc("libbot_unbounded", "Infinite.", func() float64 { return math.Inf(1) })
+	waiting = 4
+
+	want := `# HELP libbot_queue_waiting_jobs Jobs waiting for a worker.
+# TYPE libbot_queue_waiting_jobs gauge
+libbot_queue_waiting_jobs 4
+# HELP libbot_unbounded Infinite.
+# TYPE libbot_unbounded gauge
+libbot_unbounded +Inf
+`
+	if got := output(t, r); got != want {
+		t.Errorf("Write() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := isolate(t)
+	h := NewHistogramVec("libbot_job_duration_seconds", "Duration of the jobs.", []float64{.5, 1, 2.5}, "kind")
+	for _, v := range []float64{.2, .5, .7, 2, 10} {
+		h.Observe(v, "download")
+	}
+	h.Observe(1, "convert")
+
+	want := `# HELP libbot_job_duration_seconds Duration of the jobs.
+# TYPE libbot_job_duration_seconds histogram
+libbot_job_duration_seconds_bucket{kind="convert",le="0.5"} 0
+libbot_job_duration_seconds_bucket{kind="convert",le="1"} 1
+libbot_job_duration_seconds_bucket{kind="convert",le="2.5"} 1
+libbot_job_duration_seconds_bucket{kind="convert",le="+Inf"} 1
+libbot_job_duration_seconds_sum{kind="convert"} 1
+libbot_job_duration_seconds_count{kind="convert"} 1
+libbot_job_duration_seconds_bucket{kind="download",le="0.5"} 2
+libbot_job_duration_seconds_bucket{kind="download",le="1"} 3
+libbot_job_duration_seconds_bucket{kind="download",le="2.5"} 4
+libbot_job_duration_seconds_bucket{kind="download",le="+Inf"} 5
+libbot_job_duration_seconds_sum{kind="download"} 13.4
+libbot_job_duration_seconds_count{kind="download"} 5
+`
+	if got := output(t, r); got != want {
+		t.Errorf("Write() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	r := isolate(t)
+	h := NewHistogramVec("libbot_size_bytes", "Sizes.", []float64{1024, 1048576})
+	h.Observe(2048)
+
+	want := `# HELP libbot_size_bytes Sizes.
+# TYPE libbot_size_bytes histogram
+libbot_size_bytes_bucket{le="1024"} 0
+libbot_size_bytes_bucket{le="1.048576e+06"} 1
+libbot_size_bytes_bucket{le="+Inf"} 1
+libbot_size_bytes_sum 2048
+libbot_size_bytes_count 1
+`
+	if got := output(t, r); got != want {
+		t.Errorf("Write() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPanics(t *testing.T) {
+	isolate(t)
+	c := NewCounterVec("libbot_jobs_total", "Jobs.", "kind")
+	h := NewHistogramVec("libbot_job_duration_seconds", "Duration.", DefBuckets, "kind")
+	tests := []struct {
+		name string
+		f    func()
+	}{
+		{"missing label", func() { c.Inc() }},
+		{"extra label", func() { c.Inc("download", "failed") }},
+		{"negative counter", func() { c.Add(-1, "download") }},
+		{"histogram label", func() { h.Observe(1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			tt.f()
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	isolate(t)
+	NewCounterVec("libbot_restarts_total", "Restarts.").Inc()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if body := rec.Body.String(); body != "# HELP libbot_restarts_total Restarts.\n# TYPE libbot_restarts_total counter\nlibbot_restarts_total 1\n" {
+		t.Errorf("body = %q", body)
+	}
+}
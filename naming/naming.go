@@ -0,0 +1,253 @@
+package naming
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/geobeau/Libbot/book"
+)
+
+// maxNameBytes keeps names below the 255 bytes limit of most filesystems
+// while leaving room for the extension and temporary suffixes
+const maxNameBytes = 200
+
+// maxExtensionBytes is the longest extension kept, the extension comes from
+// the name given by the source
+const maxExtensionBytes = 16
+
+// reserved contains the characters refused by at least one common filesystem
+const reserved = `/\:*?"<>|`
+
+// foldings maps precomposed characters to their base letters. It is used to
+// normalize text when an ASCII-only name is needed
+var foldings = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Ā': "A", 'Ă': "A", 'Ą': "A",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss", 'Þ': "Th", 'þ': "th",
+	'Ç': "C", 'Ć': "C", 'Ĉ': "C", 'Ċ': "C", 'Č': "C",
+	'ç': "c", 'ć': "c", 'ĉ': "c", 'ċ': "c", 'č': "c",
+	'Ð': "D", 'Ď': "D", 'Đ': "D", 'ð': "d", 'ď': "d", 'đ': "d",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E", 'Ĕ': "E", 'Ė': "E", 'Ę': "E", 'Ě': "E",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ĕ': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'Ĝ': "G", 'Ğ': "G", 'Ġ': "G", 'Ģ': "G", 'ĝ': "g", 'ğ': "g", 'ġ': "g", 'ģ': "g",
+	'Ĥ': "H", 'Ħ': "H", 'ĥ': "h", 'ħ': "h",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ĩ': "I", 'Ī': "I", 'Ĭ': "I", 'Į': "I", 'İ': "I",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ĩ': "i", 'ī': "i", 'ĭ': "i", 'į': "i", 'ı': "i",
+	'Ĵ': "J", 'ĵ': "j", 'Ķ': "K", 'ķ': "k",
+	'Ĺ': "L", 'Ļ': "L", 'Ľ': "L", 'Ŀ': "L", 'Ł': "L", 'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ŀ': "l", 'ł': "l",
+	'Ñ': "N", 'Ń': "N", 'Ņ': "N", 'Ň': "N", 'ñ': "n", 'ń': "n", 'ņ': "n", 'ň': "n",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Ō': "O", 'Ŏ': "O", 'Ő': "O",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ŏ': "o", 'ő': "o",
+	'Ŕ': "R", 'Ŗ': "R", 'Ř': "R", 'ŕ': "r", 'ŗ': "r", 'ř': "r",
+	'Ś': "S", 'Ŝ': "S", 'Ş': "S", 'Š': "S", 'Ș': "S", 'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ș': "s",
+	'Ţ': "T", 'Ť': "T", 'Ŧ': "T", 'Ț': "T", 'ţ': "t", 'ť': "t", 'ŧ': "t", 'ț': "t",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ũ': "U", 'Ū': "U", 'Ŭ': "U", 'Ů': "U", 'Ű': "U", 'Ų': "U",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ũ': "u", 'ū': "u", 'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'Ŵ': "W", 'ŵ': "w", 'Ý': "Y", 'Ÿ': "Y", 'Ŷ': "Y", 'ý': "y", 'ÿ': "y", 'ŷ': "y",
+	'Ź': "Z", 'Ż': "Z", 'Ž': "Z", 'ź': "z", 'ż': "z", 'ž': "z",
+	'‘': "'", '’': "'", '“': "\"", '”': "\"", '«': "\"", '»': "\"", '–': "-", '—': "-", '…': "...",
+}
+
+// compositions lists by combining mark the letters it composes with and the
+// precomposed letters they make. Names are composed the way NFC does, so a
+// decomposed "Cafe\u0301" and a precomposed "Café" give the same name. Only
+// the marks of the latin and cyrillic alphabets are composed, a full NFC
+// would need golang.org/x/text
+var compositions = map[rune][2]string{
+	'\u0300': {"AEIOUaeiou", "ÀÈÌÒÙàèìòù"},
+	'\u0301': {"ACEILNORSUYZaceilnorsuyz", "ÁĆÉÍĹŃÓŔŚÚÝŹáćéíĺńóŕśúýź"},
+	'\u0302': {"ACEGHIJOSUWYaceghijosuwy", "ÂĈÊĜĤÎĴÔŜÛŴŶâĉêĝĥîĵôŝûŵŷ"},
+	'\u0303': {"AINOUainou", "ÃĨÑÕŨãĩñõũ"},
+	'\u0304': {"AEIOUaeiou", "ĀĒĪŌŪāēīōū"},
+	'\u0306': {"AEGIOUaegiouИи", "ĂĔĞĬŎŬăĕğĭŏŭЙй"},
+	'\u0307': {"CEGIZcegz", "ĊĖĠİŻċėġż"},
+	'\u0308': {"AEIOUYaeiouyЕеІі", "ÄËÏÖÜŸäëïöüÿЁёЇї"},
+	'\u030A': {"AUau", "ÅŮåů"},
+	'\u030B': {"OUou", "ŐŰőű"},
+	'\u030C': {"CDENRSTZcdenrstz", "ČĎĚŇŘŠŤŽčďěňřšťž"},
+	'\u0326': {"STst", "ȘȚșț"},
+	'\u0327': {"CGKLNRSTcgklnrst", "ÇĢĶĻŅŖŞŢçģķļņŗşţ"},
+	'\u0328': {"AEIUaeiu", "ĄĘĮŲąęįų"},
+}
+
+// composed maps a letter and a combining mark to the precomposed letter
+var composed = map[[2]rune]rune{}
+
+func init() {
+	for mark, letters := range compositions {
+		precomposed := []rune(letters[1])
+		for i, letter := range []rune(letters[0]) {
+			composed[[2]rune{letter, mark}] = precomposed[i]
+		}
+	}
+}
+
+// compose replaces the letters followed by a combining mark with their
+// precomposed letter
+func compose(s string) string {
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		if n := len(runes); n > 0 && unicode.Is(unicode.Mn, r) {
+			if c, ok := composed[[2]rune{runes[n-1], r}]; ok {
+				runes[n-1] = c
+				continue
+			}
+		}
+		runes = append(runes, r)
+	}
+	return string(runes)
+}
+
+// transliterations maps non latin letters to a latin approximation
+var transliterations = map[rune]string{
+	// Cyrillic
+	'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Д': "D", 'Е': "E", 'Ё': "Yo", 'Ж': "Zh", 'З': "Z",
+	'И': "I", 'Й': "Y", 'К': "K", 'Л': "L", 'М': "M", 'Н': "N", 'О': "O", 'П': "P", 'Р': "R",
+	'С': "S", 'Т': "T", 'У': "U", 'Ф': "F", 'Х': "Kh", 'Ц': "Ts", 'Ч': "Ch", 'Ш': "Sh", 'Щ': "Shch",
+	'Ъ': "", 'Ы': "Y", 'Ь': "", 'Э': "E", 'Ю': "Yu", 'Я': "Ya", 'Є': "Ye", 'І': "I", 'Ї': "Yi", 'Ґ': "G",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh", 'з': "z",
+	'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+	'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya", 'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g",
+	// Greek
+	'Α': "A", 'Β': "V", 'Γ': "G", 'Δ': "D", 'Ε': "E", 'Ζ': "Z", 'Η': "I", 'Θ': "Th", 'Ι': "I",
+	'Κ': "K", 'Λ': "L", 'Μ': "M", 'Ν': "N", 'Ξ': "X", 'Ο': "O", 'Π': "P", 'Ρ': "R", 'Σ': "S",
+	'Τ': "T", 'Υ': "Y", 'Φ': "F", 'Χ': "Ch", 'Ψ': "Ps", 'Ω': "O",
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th", 'ι': "i",
+	'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s",
+	'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+	'ά': "a", 'έ': "e", 'ή': "i", 'ί': "i", 'ό': "o", 'ύ': "y", 'ώ': "o",
+}
+
+// Sanitize makes a string safe to use as a file name while keeping
+// every printable unicode character, accented letters are composed
+func Sanitize(name string) string {
+	if !utf8.ValidString(name) {
+		name = strings.ToValidUTF8(name, "")
+	}
+	var builder strings.Builder
+	lastSpace := false
+	for _, r := range compose(name) {
+		switch {
+		case unicode.IsSpace(r) || strings.ContainsRune(reserved, r):
+			if !lastSpace && builder.Len() > 0 {
+				builder.WriteRune(' ')
+			}
+			lastSpace = true
+			continue
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r) || r == utf8.RuneError:
+			continue
+		case unicode.Is(unicode.Mn, r):
+			// a dangling combining mark can't be rendered on its own
+			if builder.Len() == 0 {
+				continue
+			}
+		}
+		builder.WriteRune(r)
+		lastSpace = false
+	}
+	// leading dots hide the file and trailing ones are refused on Windows
+	return truncate(strings.Trim(builder.String(), " ."), maxNameBytes)
+}
+
+// Transliterate converts a string to its closest ASCII representation,
+// characters without a known equivalent are dropped
+func Transliterate(name string) string {
+	var builder strings.Builder
+	for _, r := range compose(name) {
+		switch {
+		case r < utf8.RuneSelf:
+			builder.WriteRune(r)
+		case foldings[r] != "":
+			builder.WriteString(foldings[r])
+		case transliterations[r] != "":
+			builder.WriteString(transliterations[r])
+		case unicode.IsSpace(r):
+			builder.WriteRune(' ')
+		}
+	}
+	return Sanitize(builder.String())
+}
+
+// Filename builds a readable file name for a book like
+// "Author - Title (Year).epub". It falls back to a transliterated name, and
+// then to the book download URL or ID, if nothing readable is left. The
+// extension is cut to 16 bytes
+func Filename(b book.Book, ext string) string {
+	ext = extension(ext)
+	base := baseName(b)
+	name := Sanitize(base)
+	if !hasLetterOrDigit(name) {
+		name = Transliterate(base)
+	}
+	if !hasLetterOrDigit(name) {
+		name = Transliterate(strings.NewReplacer("/", " ", ".", " ").Replace(b.Format().URL + " " + b.ID))
+	}
+	if !hasLetterOrDigit(name) {
+		name = "book"
+	}
+	return truncate(name, maxNameBytes-len(ext)) + ext
+}
+
+// ASCIIFilename is the same as Filename but only returns ASCII characters,
+// it is meant for tools which do not handle unicode paths well
+func ASCIIFilename(b book.Book, ext string) string {
+	ext = extension(ext)
+	name := Transliterate(strings.TrimSuffix(Filename(b, ext), ext))
+	if !hasLetterOrDigit(name) {
+		name = "book"
+	}
+	if ext = Transliterate(strings.TrimPrefix(ext, ".")); ext != "" {
+		ext = "." + ext
+	}
+	return name + ext
+}
+
+// extension sanitizes an extension like ".EPUB" to ".epub"
+func extension(ext string) string {
+	ext = truncate(Sanitize(strings.TrimPrefix(ext, ".")), maxExtensionBytes)
+	if ext == "" {
+		return ""
+	}
+	return "." + strings.ToLower(ext)
+}
+
+func baseName(b book.Book) string {
+	title := strings.TrimSpace(b.Title)
+	author := strings.TrimSpace(b.Author())
+	name := title
+	if author != "" && title != "" {
+		name = author + " - " + title
+	} else if author != "" {
+		name = author
+	}
+	if b.Year > 0 && name != "" {
+		name += " (" + strconv.Itoa(b.Year) + ")"
+	}
+	return name
+}
+
+func hasLetterOrDigit(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate cuts a string to at most max bytes without splitting a rune
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	if max <= 0 {
+		return ""
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return strings.TrimRight(s[:max], " .")
+}
@@ -0,0 +1,61 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/geobeau/Libbot/book"
+)
+
+func TestFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		book book.Book
+		ext  string
+		want string
+	}{
+		{"author title year", book.Book{Title: "Dune", Authors: book.Authors("Frank Herbert"), Year: 1965}, ".EPUB", "Frank Herbert - Dune (1965).epub"},
+		{"reserved characters", book.Book{Title: `What? A/B: "C"`}, ".pdf", "What A B C.pdf"},
+		{"precomposed", book.Book{Title: "Café"}, ".epub", "Café.epub"},
+		{"decomposed", book.Book{Title: "Cafe\u0301"}, ".epub", "Café.epub"},
+		{"cyrillic decomposed", book.Book{Title: "Война и мир, т. 2 и\u0306"}, ".epub", "Война и мир, т. 2 й.epub"},
+		{"long extension", book.Book{Title: "Café"}, "." + strings.Repeat("a", 300), "Café." + strings.Repeat("a", maxExtensionBytes)},
+		{"nothing readable", book.Book{ID: "42", Title: "???"}, ".epub", "42.epub"},
+		{"empty", book.Book{}, "", "book"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Filename(tt.book, tt.ext); got != tt.want {
+				t.Errorf("Filename() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilenameLength(t *testing.T) {
+	b := book.Book{Title: strings.Repeat("é", 300)}
+	got := Filename(b, ".epub")
+	if len(got) > maxNameBytes {
+		t.Errorf("Filename() is %d bytes, want at most %d", len(got), maxNameBytes)
+	}
+	if !strings.HasSuffix(got, "é.epub") {
+		t.Errorf("Filename() = %q, want a whole rune before the extension", got)
+	}
+}
+
+func TestASCIIFilename(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Café", "Cafe.epub"},
+		{"Cafe\u0301", "Cafe.epub"},
+		{"Преступление и наказание", "Prestuplenie i nakazanie.epub"},
+		{"日本", "book.epub"},
+	}
+	for _, tt := range tests {
+		if got := ASCIIFilename(book.Book{Title: tt.title}, ".epub"); got != tt.want {
+			t.Errorf("ASCIIFilename(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
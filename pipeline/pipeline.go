@@ -0,0 +1,355 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/naming"
+)
+
+var logger = logging.Package("pipeline")
+
+// Stage identifies a step of the download pipeline
+type Stage int
+
+// Stages run in this order: a stage is skipped when the stage producing its
+// input did not succeed. A failed Process stage doesn't stop the pipeline,
+// the unprocessed file is delivered instead
+const (
+	Fetch Stage = iota
+	Store
+	Process
+	UploadOriginal
+	Convert
+	UploadConverted
+)
+
+var stageNames = [...]string{"fetch", "store", "process", "upload original", "convert", "upload converted"}
+
+func (s Stage) String() string {
+	if int(s) < len(stageNames) {
+		return stageNames[s]
+	}
+	return fmt.Sprintf("stage(%d)", int(s))
+}
+
+// Status tells how a stage ended
+type Status int
+
+// Possible status of a stage
+const (
+	Skipped Status = iota
+	Succeeded
+	Failed
+)
+
+var statusNames = [...]string{"skipped", "succeeded", "failed"}
+
+func (s Status) String() string {
+	if int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprintf("status(%d)", int(s))
+}
+
+// ErrNoConversion is the reason given when a file doesn't need to be converted
+var ErrNoConversion = errors.New("no conversion needed")
+
+// ErrTooLarge is returned when a file exceeds the size limit of the pipeline
+var ErrTooLarge = errors.New("file too large")
+
+// UnavailableMessage tells the user the book source is unavailable
+const UnavailableMessage = "The book source is temporarily unavailable, please try again later"
+
+// ErrRefused is returned by an Admitter or a Converter refusing a
+// conversion, the user was already told why
+var ErrRefused = errors.New("conversion refused")
+
+// ErrUnavailable is returned by a Fetcher when its source is temporarily
+// unavailable
+var ErrUnavailable = errors.New("source temporarily unavailable")
+
+// File is a book file moving through the pipeline
+type File struct {
+	Name    string
+	Content []byte
+	// Book is the metadata of the book the file contains
+	Book book.Book
+}
+
+// Download is the raw file returned by a Fetcher
+type Download struct {
+	// Filename is the name given by the source, only its extension is kept
+	Filename string
+	Body     io.ReadCloser
+}
+
+// Outcome is the result of a single stage
+type Outcome struct {
+	Stage  Stage
+	Status Status
+	File   *File
+	Err    error
+	// Detail describes what the stage did, if relevant
+	Detail string
+	// Ref is the reference to the file given by the uploader
+	Ref string
+}
+
+// Result gathers the outcome of every stage of a run
+type Result struct {
+	Book     book.Book
+	Outcomes []Outcome
+}
+
+// Outcome returns the outcome of a stage
+func (r Result) Outcome(stage Stage) Outcome {
+	for _, outcome := range r.Outcomes {
+		if outcome.Stage == stage {
+			return outcome
+		}
+	}
+	return Outcome{Stage: stage, Status: Skipped}
+}
+
+// Err returns the error of the first failed stage, if any. Process failures
+// are ignored as they don't prevent the delivery
+func (r Result) Err() error {
+	for _, outcome := range r.Outcomes {
+		if outcome.Status == Failed && outcome.Stage != Process {
+			return fmt.Errorf("%s: %w", outcome.Stage, outcome.Err)
+		}
+	}
+	return nil
+}
+
+// Fetcher fetches the metadata and the file of a book
+type Fetcher interface {
+	Fetch(ctx context.Context, id string) (book.Book, Download, error)
+}
+
+// Converter converts a file to another format and returns the converted file
+type Converter interface {
+	Convert(ctx context.Context, filename string, content []byte, format string) (string, []byte, error)
+}
+
+// Admitter is implemented by the converters which can refuse a conversion,
+// Admit runs before the user is told the file is being converted
+type Admitter interface {
+	Admit(ctx context.Context) error
+}
+
+// Uploader delivers a file to the user. It returns a reference to the
+// delivered file when the destination gives one, like a telegram file id
+type Uploader interface {
+	Upload(ctx context.Context, file File) (string, error)
+}
+
+// Processor transforms a stored file before it is uploaded and converted,
+// it returns the new file and a description of what it changed
+type Processor interface {
+	Process(ctx context.Context, bookMetadata book.Book, file File) (File, string, error)
+}
+
+// Notifier sends progress messages to the user
+type Notifier interface {
+	Notify(message string)
+}
+
+// Journal records the stages completed by a job. A job resumed after a
+// restart runs again from the start, but skips the uploads already done so
+// the user doesn't receive a file twice, and the conversion of a converted
+// file already sent
+type Journal interface {
+	Done(stage Stage) bool
+	Complete(stage Stage)
+}
+
+// Pipeline runs the download stages of a book
+type Pipeline struct {
+	Fetcher   Fetcher
+	Uploader  Uploader
+	Converter Converter
+	Notifier  Notifier
+	// Processors run in order on the stored file
+	Processors []Processor
+	// ConvertFrom lists the extensions which are converted
+	ConvertFrom []string
+	// ConvertTo is the format files are converted to
+	ConvertTo string
+	// OnlyConverted skips the upload of the original file when it is converted
+	OnlyConverted bool
+	// MaxSize is the maximum size of a file in bytes, 0 means no limit
+	MaxSize int
+	// Journal is optional, it makes the uploads idempotent
+	Journal Journal
+}
+
+// Run fetches a book and delivers it, converting it when needed
+func (p *Pipeline) Run(ctx context.Context, id string) Result {
+	result := Result{}
+
+	logger.InfoContext(ctx, "Fetching book", "id", id)
+	bookMetadata, download, err := p.Fetcher.Fetch(ctx, id)
+	if err != nil {
+		logger.ErrorContext(ctx, "Fetch failed", logging.Err(err))
+		if errors.Is(err, ErrUnavailable) {
+			p.notify(UnavailableMessage)
+		} else {
+			p.notify("Failed... (probably too many books downloaded today)")
+		}
+		return p.fail(result, Fetch, err)
+	}
+	result.Book = bookMetadata
+	result.Outcomes = append(result.Outcomes, Outcome{Stage: Fetch, Status: Succeeded})
+	p.complete(Fetch)
+
+	original, err := p.store(bookMetadata, download)
+	if err != nil {
+		logger.ErrorContext(ctx, "Download failed", logging.Err(err))
+	}
+	if errors.Is(err, ErrTooLarge) {
+		p.notify(fmt.Sprintf("The book is too large (limit is %d MB)", p.MaxSize>>20))
+		return p.fail(result, Store, err)
+	}
+	if err != nil {
+		p.notify("Failed to download the book")
+		return p.fail(result, Store, err)
+	}
+	result.Outcomes = append(result.Outcomes, Outcome{Stage: Store, Status: Succeeded, File: &original})
+	p.complete(Store)
+
+	for _, processor := range p.Processors {
+		processed, detail, err := processor.Process(ctx, bookMetadata, original)
+		if err != nil {
+			logger.WarnContext(ctx, "Processing failed", "file", original.Name, logging.Err(err))
+			result.Outcomes = append(result.Outcomes, Outcome{Stage: Process, Status: Failed, Err: err, Detail: detail})
+			continue
+		}
+		original = processed
+		result.Outcomes = append(result.Outcomes, Outcome{Stage: Process, Status: Succeeded, File: &processed, Detail: detail})
+	}
+
+	if !p.shouldConvert(original) {
+		result.Outcomes = append(result.Outcomes,
+			p.upload(ctx, UploadOriginal, original),
+			Outcome{Stage: Convert, Status: Skipped, Err: ErrNoConversion},
+			Outcome{Stage: UploadConverted, Status: Skipped, Err: ErrNoConversion})
+		return result
+	}
+	if p.OnlyConverted {
+		result.Outcomes = append(result.Outcomes, Outcome{Stage: UploadOriginal, Status: Skipped})
+	} else {
+		result.Outcomes = append(result.Outcomes, p.upload(ctx, UploadOriginal, original))
+	}
+	if p.Journal != nil && p.Journal.Done(UploadConverted) {
+		logger.InfoContext(ctx, "Converted file already sent", "format", p.ConvertTo)
+		result.Outcomes = append(result.Outcomes,
+			Outcome{Stage: Convert, Status: Succeeded, Detail: "already sent"},
+			Outcome{Stage: UploadConverted, Status: Succeeded, Detail: "already sent"})
+		return result
+	}
+	if admitter, ok := p.Converter.(Admitter); ok {
+		if err := admitter.Admit(ctx); err != nil {
+			logger.InfoContext(ctx, "Conversion refused", "file", original.Name, "format", p.ConvertTo, logging.Err(err))
+			return p.fail(result, Convert, err)
+		}
+	}
+	if p.OnlyConverted {
+		p.notify(fmt.Sprintf("Converting to %s...", p.ConvertTo))
+	} else {
+		p.notify(fmt.Sprintf("Converting to %s as well...", p.ConvertTo))
+	}
+	convertedName, content, err := p.Converter.Convert(ctx, original.Name, original.Content, p.ConvertTo)
+	if err != nil {
+		logger.ErrorContext(ctx, "Conversion failed", "file", original.Name, "format", p.ConvertTo, logging.Err(err))
+		if !errors.Is(err, ErrRefused) {
+			p.notify("Convertion failed :'(")
+		}
+		return p.fail(result, Convert, err)
+	}
+	converted := File{Name: convertedName, Content: content, Book: original.Book}
+	p.complete(Convert)
+	result.Outcomes = append(result.Outcomes,
+		Outcome{Stage: Convert, Status: Succeeded, File: &converted},
+		p.upload(ctx, UploadConverted, converted))
+	return result
+}
+
+// store reads the downloaded file and names it after the book
+func (p *Pipeline) store(bookMetadata book.Book, download Download) (File, error) {
+	defer download.Body.Close()
+	var body io.Reader = download.Body
+	if p.MaxSize > 0 {
+		body = io.LimitReader(body, int64(p.MaxSize)+1)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(body); err != nil {
+		return File{}, err
+	}
+	if p.MaxSize > 0 && buf.Len() > p.MaxSize {
+		return File{}, ErrTooLarge
+	}
+	if buf.Len() == 0 {
+		return File{}, errors.New("downloaded file is empty")
+	}
+	name := naming.Filename(bookMetadata, filepath.Ext(download.Filename))
+	return File{Name: name, Content: buf.Bytes(), Book: bookMetadata}, nil
+}
+
+func (p *Pipeline) upload(ctx context.Context, stage Stage, file File) Outcome {
+	if p.Journal != nil && p.Journal.Done(stage) {
+		logger.InfoContext(ctx, "Already sent", "file", file.Name)
+		return Outcome{Stage: stage, Status: Succeeded, File: &file, Detail: "already sent"}
+	}
+	logger.InfoContext(ctx, "Sending", "file", file.Name, "size", len(file.Content))
+	ref, err := p.Uploader.Upload(ctx, file)
+	if err != nil {
+		logger.ErrorContext(ctx, "Upload failed", "file", file.Name, logging.Err(err))
+		p.notify(fmt.Sprintf("Failed to send %s: %v", file.Name, err))
+		return Outcome{Stage: stage, Status: Failed, File: &file, Err: err}
+	}
+	p.complete(stage)
+	return Outcome{Stage: stage, Status: Succeeded, File: &file, Ref: ref}
+}
+
+func (p *Pipeline) complete(stage Stage) {
+	if p.Journal != nil {
+		p.Journal.Complete(stage)
+	}
+}
+
+func (p *Pipeline) shouldConvert(file File) bool {
+	if p.Converter == nil || p.ConvertTo == "" {
+		return false
+	}
+	extension := strings.ToLower(filepath.Ext(file.Name))
+	for _, from := range p.ConvertFrom {
+		if extension == from {
+			return true
+		}
+	}
+	return false
+}
+
+// fail records a failed stage and marks every following stage as skipped
+func (p *Pipeline) fail(result Result, stage Stage, err error) Result {
+	result.Outcomes = append(result.Outcomes, Outcome{Stage: stage, Status: Failed, Err: err})
+	for next := stage + 1; next <= UploadConverted; next++ {
+		result.Outcomes = append(result.Outcomes, Outcome{Stage: next, Status: Skipped})
+	}
+	return result
+}
+
+func (p *Pipeline) notify(message string) {
+	if p.Notifier != nil {
+		p.Notifier.Notify(message)
+	}
+}
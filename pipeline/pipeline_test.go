@@ -0,0 +1,350 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/geobeau/Libbot/book"
+)
+
+// fakeFetcher returns the same book and file for every id
+type fakeFetcher struct {
+	book     book.Book
+	filename string
+	content  string
+	err      error
+}
+
+func (f fakeFetcher) Fetch(ctx context.Context, id string) (book.Book, Download, error) {
+	if f.err != nil {
+		return book.Book{}, Download{}, f.err
+	}
+	return f.book, Download{Filename: f.filename, Body: ioutil.NopCloser(strings.NewReader(f.content))}, nil
+}
+
+// fakeConverter changes the extension and prefixes the content
+type fakeConverter struct {
+	err error
+}
+
+func (c fakeConverter) Convert(ctx context.Context, filename string, content []byte, format string) (string, []byte, error) {
+	if c.err != nil {
+		return "", nil, c.err
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + format, append([]byte("converted "), content...), nil
+}
+
+// fakeAdmitter is a converter refusing the conversions
+type fakeAdmitter struct {
+	fakeConverter
+}
+
+func (a fakeAdmitter) Admit(ctx context.Context) error {
+	return ErrRefused
+}
+
+// fakeUploader records the uploaded files
+type fakeUploader struct {
+	files []File
+	err   error
+}
+
+func (u *fakeUploader) Upload(ctx context.Context, file File) (string, error) {
+	u.files = append(u.files, file)
+	if u.err != nil {
+		return "", u.err
+	}
+	return "ref " + file.Name, nil
+}
+
+// fakeProcessor appends a suffix to the content
+type fakeProcessor struct {
+	err error
+}
+
+func (p fakeProcessor) Process(ctx context.Context, bookMetadata book.Book, file File) (File, string, error) {
+	if p.err != nil {
+		return File{}, "", p.err
+	}
+	file.Content = append(file.Content, " processed"...)
+	return file, "processed", nil
+}
+
+// fakeNotifier records the messages
+type fakeNotifier struct {
+	messages []string
+}
+
+func (n *fakeNotifier) Notify(message string) {
+	n.messages = append(n.messages, message)
+}
+
+// fakeJournal records the completed stages
+type fakeJournal map[Stage]bool
+
+func (j fakeJournal) Done(stage Stage) bool { return j[stage] }
+
+func (j fakeJournal) Complete(stage Stage) { j[stage] = true }
+
+func TestRun(t *testing.T) {
+	dune := book.Book{ID: "1", Title: "Dune", Authors: book.Authors("Frank Herbert")}
+	epub := fakeFetcher{book: dune, filename: "1.epub", content: "epub"}
+	failed := errors.New("calibre crashed")
+	tests := []struct {
+		name       string
+		fetcher    fakeFetcher
+		converter  Converter
+		processors []Processor
+		only       bool
+		maxSize    int
+		done       []Stage
+		uploadErr  error
+		// statuses are the status of each stage, in order
+		statuses []Status
+		uploaded []string
+		// notified is a message the user must receive
+		notified string
+		// unnotified is a message the user must not receive
+		unnotified string
+		err        error
+	}{
+		{
+			name:      "converted",
+			fetcher:   epub,
+			converter: fakeConverter{},
+			statuses:  []Status{Succeeded, Succeeded, Succeeded, Succeeded, Succeeded},
+			uploaded:  []string{"Frank Herbert - Dune.epub", "Frank Herbert - Dune.mobi"},
+			notified:  "Converting to mobi as well...",
+		},
+		{
+			name:      "no conversion needed",
+			fetcher:   fakeFetcher{book: dune, filename: "1.pdf", content: "pdf"},
+			converter: fakeConverter{},
+			statuses:  []Status{Succeeded, Succeeded, Succeeded, Skipped, Skipped},
+			uploaded:  []string{"Frank Herbert - Dune.pdf"},
+		},
+		{
+			name:     "no converter",
+			fetcher:  epub,
+			statuses: []Status{Succeeded, Succeeded, Succeeded, Skipped, Skipped},
+			uploaded: []string{"Frank Herbert - Dune.epub"},
+		},
+		{
+			name:      "conversion failure stops the pipeline",
+			fetcher:   epub,
+			converter: fakeConverter{err: failed},
+			statuses:  []Status{Succeeded, Succeeded, Succeeded, Failed, Skipped},
+			uploaded:  []string{"Frank Herbert - Dune.epub"},
+			notified:  "Convertion failed :'(",
+			err:       failed,
+		},
+		{
+			name:      "only converted",
+			fetcher:   epub,
+			converter: fakeConverter{},
+			only:      true,
+			statuses:  []Status{Succeeded, Succeeded, Skipped, Succeeded, Succeeded},
+			uploaded:  []string{"Frank Herbert - Dune.mobi"},
+			notified:  "Converting to mobi...",
+		},
+		{
+			name:      "only converted failure sends nothing",
+			fetcher:   epub,
+			converter: fakeConverter{err: failed},
+			only:      true,
+			statuses:  []Status{Succeeded, Succeeded, Skipped, Failed, Skipped},
+			err:       failed,
+		},
+		{
+			name:      "refused conversion",
+			fetcher:   epub,
+			converter: fakeConverter{err: ErrRefused},
+			statuses:  []Status{Succeeded, Succeeded, Succeeded, Failed, Skipped},
+			uploaded:  []string{"Frank Herbert - Dune.epub"},
+			err:       ErrRefused,
+		},
+		{
+			name:       "conversion refused before the notice",
+			fetcher:    epub,
+			converter:  fakeAdmitter{},
+			statuses:   []Status{Succeeded, Succeeded, Succeeded, Failed, Skipped},
+			uploaded:   []string{"Frank Herbert - Dune.epub"},
+			unnotified: "Converting to mobi as well...",
+			err:        ErrRefused,
+		},
+		{
+			name:      "journal skips the uploads done",
+			fetcher:   epub,
+			converter: fakeConverter{},
+			done:      []Stage{Fetch, Store, UploadOriginal},
+			statuses:  []Status{Succeeded, Succeeded, Succeeded, Succeeded, Succeeded},
+			uploaded:  []string{"Frank Herbert - Dune.mobi"},
+		},
+		{
+			name:    "journal skips the conversion sent",
+			fetcher: epub,
+			// the conversion fails if it runs again
+			converter:  fakeConverter{err: errors.New("converted again")},
+			done:       []Stage{Fetch, Store, UploadOriginal, Convert, UploadConverted},
+			statuses:   []Status{Succeeded, Succeeded, Succeeded, Succeeded, Succeeded},
+			unnotified: "Converting to mobi as well...",
+		},
+		{
+			name:       "processed",
+			fetcher:    epub,
+			converter:  fakeConverter{},
+			processors: []Processor{fakeProcessor{}},
+			statuses:   []Status{Succeeded, Succeeded, Succeeded, Succeeded, Succeeded, Succeeded},
+			uploaded:   []string{"Frank Herbert - Dune.epub", "Frank Herbert - Dune.mobi"},
+		},
+		{
+			name:       "processing failure delivers the original",
+			fetcher:    epub,
+			converter:  fakeConverter{},
+			processors: []Processor{fakeProcessor{err: failed}, fakeProcessor{}},
+			statuses:   []Status{Succeeded, Succeeded, Failed, Succeeded, Succeeded, Succeeded, Succeeded},
+			uploaded:   []string{"Frank Herbert - Dune.epub", "Frank Herbert - Dune.mobi"},
+		},
+		{
+			name:     "source unavailable",
+			fetcher:  fakeFetcher{err: ErrUnavailable},
+			statuses: []Status{Failed, Skipped, Skipped, Skipped, Skipped, Skipped},
+			notified: UnavailableMessage,
+			err:      ErrUnavailable,
+		},
+		{
+			name:     "fetch failure",
+			fetcher:  fakeFetcher{err: failed},
+			statuses: []Status{Failed, Skipped, Skipped, Skipped, Skipped, Skipped},
+			notified: "Failed... (probably too many books downloaded today)",
+			err:      failed,
+		},
+		{
+			name:     "too large",
+			fetcher:  epub,
+			maxSize:  2,
+			statuses: []Status{Succeeded, Failed, Skipped, Skipped, Skipped, Skipped},
+			err:      ErrTooLarge,
+		},
+		{
+			name:      "empty file",
+			fetcher:   fakeFetcher{book: dune, filename: "1.epub"},
+			converter: fakeConverter{},
+			statuses:  []Status{Succeeded, Failed, Skipped, Skipped, Skipped, Skipped},
+			notified:  "Failed to download the book",
+			err:       errors.New("store: downloaded file is empty"),
+		},
+		{
+			name:      "upload failure",
+			fetcher:   fakeFetcher{book: dune, filename: "1.pdf", content: "pdf"},
+			uploadErr: failed,
+			statuses:  []Status{Succeeded, Succeeded, Failed, Skipped, Skipped},
+			uploaded:  []string{"Frank Herbert - Dune.pdf"},
+			err:       failed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploader := &fakeUploader{err: tt.uploadErr}
+			notifier := &fakeNotifier{}
+			journal := fakeJournal{}
+			for _, stage := range tt.done {
+				journal[stage] = true
+			}
+			p := &Pipeline{
+				Fetcher:       tt.fetcher,
+				Uploader:      uploader,
+				Converter:     tt.converter,
+				Notifier:      notifier,
+				Processors:    tt.processors,
+				ConvertFrom:   []string{".epub"},
+				ConvertTo:     "mobi",
+				OnlyConverted: tt.only,
+				MaxSize:       tt.maxSize,
+				Journal:       journal,
+			}
+			result := p.Run(context.Background(), "1")
+
+			statuses := []Status{}
+			for _, outcome := range result.Outcomes {
+				statuses = append(statuses, outcome.Status)
+			}
+			if !reflect.DeepEqual(statuses, tt.statuses) {
+				t.Errorf("statuses = %v, want %v", statuses, tt.statuses)
+			}
+			uploaded := []string{}
+			for _, file := range uploader.files {
+				if file.Name == "" || len(file.Content) == 0 {
+					t.Errorf("uploaded an empty file %q", file.Name)
+				}
+				uploaded = append(uploaded, file.Name)
+			}
+			if len(tt.uploaded) == 0 {
+				tt.uploaded = []string{}
+			}
+			if !reflect.DeepEqual(uploaded, tt.uploaded) {
+				t.Errorf("uploaded %v, want %v", uploaded, tt.uploaded)
+			}
+			if tt.notified != "" && !contains(notifier.messages, tt.notified) {
+				t.Errorf("messages %q don't contain %q", notifier.messages, tt.notified)
+			}
+			if tt.unnotified != "" && contains(notifier.messages, tt.unnotified) {
+				t.Errorf("messages %q contain %q", notifier.messages, tt.unnotified)
+			}
+			if errors.Is(tt.err, ErrRefused) && contains(notifier.messages, "Convertion failed :'(") {
+				t.Errorf("a refused conversion was reported as failed")
+			}
+			err := result.Err()
+			switch {
+			case tt.err == nil && err != nil:
+				t.Errorf("Err() = %v, want nil", err)
+			case tt.err != nil && err == nil:
+				t.Errorf("Err() = nil, want %v", tt.err)
+			case tt.err != nil && !errors.Is(err, tt.err) && err.Error() != tt.err.Error():
+				t.Errorf("Err() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRunConvertedContent(t *testing.T) {
+	uploader := &fakeUploader{}
+	p := &Pipeline{
+		Fetcher:     fakeFetcher{book: book.Book{ID: "1", Title: "Dune"}, filename: "1.epub", content: "epub"},
+		Uploader:    uploader,
+		Converter:   fakeConverter{},
+		ConvertFrom: []string{".epub"},
+		ConvertTo:   "mobi",
+	}
+	result := p.Run(context.Background(), "1")
+	converted := result.Outcome(Convert).File
+	if converted == nil || string(converted.Content) != "converted epub" || converted.Name != "Dune.mobi" {
+		t.Fatalf("converted file = %+v", converted)
+	}
+	if ref := result.Outcome(UploadConverted).Ref; ref != "ref Dune.mobi" {
+		t.Errorf("Ref = %q, want the reference given by the uploader", ref)
+	}
+}
+
+func TestStageString(t *testing.T) {
+	if got := UploadConverted.String(); got != "upload converted" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := Stage(42).String(); got != "stage(42)" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func contains(messages []string, message string) bool {
+	for _, m := range messages {
+		if m == message {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/config"
+	"github.com/geobeau/Libbot/logging"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// secretHeader holds the secret token in the updates posted by telegram
+const secretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// webhookPath returns the path the updates are posted to, the secret keeps
+// it unknown to anyone but telegram
+func webhookPath(cfg config.Webhook) string {
+	return "/" + cfg.Secret
+}
+
+// webhook is a poller receiving the updates on its own HTTP server. The
+// listener is only started once the webhook is registered to telegram
+type webhook struct {
+	server *http.Server
+	cfg    config.Webhook
+	url    string
+	// dest receives the updates, it is set before the listener starts
+	dest chan tb.Update
+	// stopped is closed when the bot stops polling
+	stopped chan struct{}
+	// failed receives the error of a failed registration
+	failed chan error
+}
+
+// newWebhook returns a webhook poller
+func newWebhook(cfg config.Webhook) *webhook {
+	path := webhookPath(cfg)
+	w := &webhook{
+		cfg:     cfg,
+		url:     strings.TrimSuffix(cfg.PublicURL, "/") + path,
+		stopped: make(chan struct{}),
+		failed:  make(chan error, 1),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != path {
+			http.NotFound(rw, r)
+			return
+		}
+		w.receive(rw, r)
+	})
+	w.server = &http.Server{Addr: cfg.Listen, Handler: mux}
+	return w
+}
+
+// Poll implements tb.Poller: it registers the webhook then serves the
+// updates until the bot stops. A failed registration stops the bot, the
+// error is returned by err
+func (w *webhook) Poll(b *tb.Bot, dest chan tb.Update, stop chan struct{}) {
+	if err := w.register(b); err != nil {
+		w.failed <- err
+		close(stop)
+		return
+	}
+	w.dest = dest
+	go w.serve()
+	<-stop
+	close(w.stopped)
+	close(stop)
+}
+
+// err returns the error of a failed registration, nil otherwise
+func (w *webhook) err() error {
+	select {
+	case err := <-w.failed:
+		return err
+	default:
+		return nil
+	}
+}
+
+// receive forwards an update posted by telegram to the bot
+func (w *webhook) receive(rw http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(w.cfg.Secret)) != 1 {
+		logger.Warn("Webhook update without the secret token", "remote", r.RemoteAddr)
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+	var update tb.Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		logger.Warn("Invalid webhook update", logging.Err(err))
+		http.Error(rw, "invalid update", http.StatusBadRequest)
+		return
+	}
+	select {
+	case w.dest <- update:
+	case <-w.stopped:
+		// telegram posts the update again later
+		http.Error(rw, "stopping", http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+	}
+}
+
+// register sets the webhook and the secret token telegram sends with the
+// updates, the certificate is uploaded when it is self signed
+func (w *webhook) register(b *tb.Bot) error {
+	if !w.cfg.SelfSigned {
+		data, err := b.Raw("setWebhook", map[string]string{"url": w.url, "secret_token": w.cfg.Secret})
+		if err != nil {
+			return err
+		}
+		return apiResult("setWebhook", data)
+	}
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	if err := form.WriteField("url", w.url); err != nil {
+		return err
+	}
+	if err := form.WriteField("secret_token", w.cfg.Secret); err != nil {
+		return err
+	}
+	cert, err := os.Open(w.cfg.TLSCert)
+	if err != nil {
+		return err
+	}
+	defer cert.Close()
+	part, err := form.CreateFormFile("certificate", filepath.Base(w.cfg.TLSCert))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, cert); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	client := &http.Client{Transport: telegramTransport{}, Timeout: 30 * time.Second}
+	resp, err := client.Post(fmt.Sprintf("%s/bot%s/setWebhook", b.URL, b.Token), form.FormDataContentType(), body)
+	if err != nil {
+		// the error contains the URL, the token must not be logged
+		return fmt.Errorf("setWebhook failed: %s", strings.Replace(err.Error(), b.Token, "<token>", -1))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return apiResult("setWebhook", data)
+}
+
+// serve runs the HTTP listener until shutdown is called
+func (w *webhook) serve() {
+	logger.Info("Webhook listening", "address", w.cfg.Listen)
+	var err error
+	if w.cfg.TLSCert != "" {
+		err = w.server.ListenAndServeTLS(w.cfg.TLSCert, w.cfg.TLSKey)
+	} else {
+		err = w.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		fatal("Webhook listener failed", err)
+	}
+}
+
+// shutdown stops the HTTP listener
+func (w *webhook) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.server.Shutdown(ctx); err != nil {
+		logger.Error("Failed to stop webhook listener", logging.Err(err))
+	}
+}
+
+// deleteWebhook removes the webhook registered to telegram, long polling
+// doesn't work while a webhook is set
+func deleteWebhook(b *tb.Bot) error {
+	data, err := b.Raw("deleteWebhook", map[string]string{})
+	if err != nil {
+		return err
+	}
+	return apiResult("deleteWebhook", data)
+}
+
+// apiResult returns the error of a telegram API call
+func apiResult(method string, data []byte) error {
+	var resp struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if !resp.Ok {
+		return fmt.Errorf("%s failed: %s", method, resp.Description)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions limited per user
+const (
+	Search   = "search"
+	Download = "download"
+	Convert  = "convert"
+)
+
+// Actions lists the limited actions
+var Actions = []string{Search, Download, Convert}
+
+// Rate is a token bucket: Burst actions can be done at once, then one more
+// every Interval
+type Rate struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// Bucket is the state of a token bucket
+type Bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// refill returns the bucket with the tokens earned since its last update,
+// a new bucket is full
+func (r Rate) refill(b Bucket, now time.Time) Bucket {
+	if b.Updated.IsZero() {
+		return Bucket{Tokens: float64(r.Burst), Updated: now}
+	}
+	elapsed := now.Sub(b.Updated)
+	if elapsed > 0 && r.Interval > 0 {
+		b.Tokens = math.Min(float64(r.Burst), b.Tokens+float64(elapsed)/float64(r.Interval))
+	}
+	b.Updated = now
+	return b
+}
+
+// Take takes a token from the bucket. When it is empty, it returns false
+// with the time to wait for the next token
+func (r Rate) Take(b Bucket, now time.Time) (Bucket, time.Duration, bool) {
+	b = r.refill(b, now)
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return b, 0, true
+	}
+	wait := time.Duration((1 - b.Tokens) * float64(r.Interval))
+	return b, wait, false
+}
+
+// Available returns the number of actions which can be done right away
+func (r Rate) Available(b Bucket, now time.Time) int {
+	return int(r.refill(b, now).Tokens)
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.Burst, r.Interval)
+}
+
+// ParseRates parses rates by action, like "search=5/10s": 5 searches at
+// once, then one every 10 seconds
+func ParseRates(values []string) (map[string]Rate, error) {
+	rates := map[string]Rate{}
+	for _, value := range values {
+		action, limit, err := splitAction(value)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := ParseRate(limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", action, err)
+		}
+		rates[action] = rate
+	}
+	return rates, nil
+}
+
+// ParseRate parses a rate like "5/10s": 5 at once, then one every 10 seconds
+func ParseRate(value string) (Rate, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected burst/interval", value)
+	}
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil || burst <= 0 {
+		return Rate{}, fmt.Errorf("invalid burst in rate %q", value)
+	}
+	interval, err := time.ParseDuration(parts[1])
+	if err != nil || interval <= 0 {
+		return Rate{}, fmt.Errorf("invalid interval in rate %q", value)
+	}
+	return Rate{Burst: burst, Interval: interval}, nil
+}
+
+// ParseQuotas parses daily quotas by action, like "download=20"
+func ParseQuotas(values []string) (map[string]int, error) {
+	quotas := map[string]int{}
+	for _, value := range values {
+		action, limit, err := splitAction(value)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(limit)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid quota %q, expected action=count", value)
+		}
+		quotas[action] = count
+	}
+	return quotas, nil
+}
+
+func splitAction(value string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid limit %q, expected action=limit", value)
+	}
+	action := strings.TrimSpace(parts[0])
+	for _, known := range Actions {
+		if action == known {
+			return action, strings.TrimSpace(parts[1]), nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown action %q in %q, expected %s", action, value, strings.Join(Actions, ", "))
+}
+
+// Day returns the day daily quotas are counted for, in UTC
+func Day(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// UntilTomorrow returns the time left before the daily quotas reset
+func UntilTomorrow(now time.Time) time.Duration {
+	now = now.UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return tomorrow.Sub(now)
+}
+
+// FormatWait rounds a wait up for humans, like "5 minutes"
+func FormatWait(wait time.Duration) string {
+	switch minutes := int((wait + time.Minute - 1) / time.Minute); {
+	case minutes <= 1:
+		return "a minute"
+	case minutes < 120:
+		return fmt.Sprintf("%d minutes", minutes)
+	default:
+		return fmt.Sprintf("%d hours", (minutes+59)/60)
+	}
+}
+
+// Errors returned when an action is refused
+var (
+	ErrRateLimited = errors.New("rate limited")
+	ErrQuotaUsed   = errors.New("daily quota used")
+)
+
+// Unlimited is the daily quota of an action without quota
+const Unlimited = -1
+
+// Limit is what a user can do of an action. A zero Rate doesn't limit the
+// rate
+type Limit struct {
+	Rate  Rate
+	Daily int
+}
+
+// Usage is what a user consumed of the limits
+type Usage struct {
+	Buckets map[string]Bucket `json:"buckets,omitempty"`
+	// Day is the day of Counts, they are reset the next day
+	Day    string         `json:"day,omitempty"`
+	Counts map[string]int `json:"counts,omitempty"`
+}
+
+// Empty tells if nothing was consumed
+func (u *Usage) Empty() bool {
+	return len(u.Buckets) == 0 && len(u.Counts) == 0
+}
+
+// count returns how many times an action was done today
+func (u *Usage) count(action string, now time.Time) int {
+	if u.Day != Day(now) {
+		return 0
+	}
+	return u.Counts[action]
+}
+
+// Consume records an action if the limit allows it. Otherwise it returns
+// ErrRateLimited or ErrQuotaUsed with the time to wait before trying again
+func (u *Usage) Consume(action string, limit Limit, now time.Time) (time.Duration, error) {
+	if limit.Daily != Unlimited && u.count(action, now) >= limit.Daily {
+		return UntilTomorrow(now), ErrQuotaUsed
+	}
+	if limit.Rate.Burst > 0 {
+		bucket, wait, ok := limit.Rate.Take(u.Buckets[action], now)
+		if !ok {
+			return wait, ErrRateLimited
+		}
+		if u.Buckets == nil {
+			u.Buckets = map[string]Bucket{}
+		}
+		u.Buckets[action] = bucket
+	}
+	if u.Day != Day(now) {
+		u.Day = Day(now)
+		u.Counts = map[string]int{}
+	}
+	if u.Counts == nil {
+		u.Counts = map[string]int{}
+	}
+	u.Counts[action]++
+	return 0, nil
+}
+
+// Refund gives back an action consumed today, when what it was consumed
+// for failed
+func (u *Usage) Refund(action string, limit Limit, now time.Time) {
+	if u.count(action, now) > 0 {
+		u.Counts[action]--
+	}
+	if bucket, ok := u.Buckets[action]; ok && limit.Rate.Burst > 0 {
+		bucket = limit.Rate.refill(bucket, now)
+		bucket.Tokens = math.Min(float64(limit.Rate.Burst), bucket.Tokens+1)
+		u.Buckets[action] = bucket
+	}
+}
+
+// Left returns how many times an action can be done right away and what is
+// left of the daily quota, Unlimited when there is no limit
+func (u *Usage) Left(action string, limit Limit, now time.Time) (int, int) {
+	available, remaining := Unlimited, Unlimited
+	if limit.Rate.Burst > 0 {
+		available = limit.Rate.Available(u.Buckets[action], now)
+	}
+	if limit.Daily != Unlimited {
+		remaining = limit.Daily - u.count(action, now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if available == Unlimited || available > remaining {
+			available = remaining
+		}
+	}
+	return available, remaining
+}
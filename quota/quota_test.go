@@ -0,0 +1,228 @@
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+// start is the time of the first action of the tests
+var start = time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func TestRateTake(t *testing.T) {
+	rate := Rate{Burst: 3, Interval: 10 * time.Second}
+	tests := []struct {
+		name string
+		// after is the time of each take since start
+		after []time.Duration
+		ok    []bool
+		// wait is the wait returned by the last take
+		wait time.Duration
+	}{
+		{"burst", []time.Duration{0, 0, 0}, []bool{true, true, true}, 0},
+		{"empty", []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}, 10 * time.Second},
+		{"partial refill", []time.Duration{0, 0, 0, 4 * time.Second}, []bool{true, true, true, false}, 6 * time.Second},
+		{"refill", []time.Duration{0, 0, 0, 10 * time.Second, 10 * time.Second}, []bool{true, true, true, true, false}, 10 * time.Second},
+		{"refill up to the burst", []time.Duration{0, 0, 0, time.Hour, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, true, true, true, false}, 10 * time.Second},
+		{"clock going back", []time.Duration{0, 0, 0, -time.Minute}, []bool{true, true, true, false}, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bucket Bucket
+			var wait time.Duration
+			var ok bool
+			for i, after := range tt.after {
+				bucket, wait, ok = rate.Take(bucket, start.Add(after))
+				if ok != tt.ok[i] {
+					t.Fatalf("take %d: ok = %v, want %v", i, ok, tt.ok[i])
+				}
+			}
+			if wait != tt.wait {
+				t.Errorf("wait = %v, want %v", wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestRateAvailable(t *testing.T) {
+	rate := Rate{Burst: 3, Interval: time.Minute}
+	if n := rate.Available(Bucket{}, start); n != 3 {
+		t.Errorf("Available() of a new bucket = %d, want 3", n)
+	}
+	bucket := Bucket{Tokens: 0.5, Updated: start}
+	if n := rate.Available(bucket, start.Add(time.Minute)); n != 1 {
+		t.Errorf("Available() = %d, want 1", n)
+	}
+}
+
+func TestUsageConsume(t *testing.T) {
+	daily := Limit{Daily: 2}
+	tests := []struct {
+		name  string
+		limit Limit
+		// at are the times of the actions, the last one is refused when err
+		// is set
+		at   []time.Time
+		err  error
+		wait time.Duration
+	}{
+		{"unlimited", Limit{Daily: Unlimited}, []time.Time{start, start, start, start}, nil, 0},
+		{"quota", daily, []time.Time{start, start, start}, ErrQuotaUsed, 12 * time.Hour},
+		{"quota reset at midnight UTC", daily, []time.Time{
+			time.Date(2024, 3, 10, 23, 59, 0, 0, time.UTC),
+			time.Date(2024, 3, 10, 23, 59, 30, 0, time.UTC),
+			time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+		}, nil, 0},
+		{"day in UTC", daily, []time.Time{
+			// 23:30 in UTC, already the 11th in Paris
+			time.Date(2024, 3, 11, 0, 30, 0, 0, time.FixedZone("CET", 3600)),
+			time.Date(2024, 3, 10, 23, 40, 0, 0, time.UTC),
+			time.Date(2024, 3, 10, 23, 50, 0, 0, time.UTC),
+		}, ErrQuotaUsed, 10 * time.Minute},
+		{"zero quota", Limit{Daily: 0}, []time.Time{start}, ErrQuotaUsed, 12 * time.Hour},
+		{"rate", Limit{Rate: Rate{Burst: 1, Interval: time.Minute}, Daily: Unlimited}, []time.Time{start, start.Add(20 * time.Second)}, ErrRateLimited, 40 * time.Second},
+		{"quota before rate", Limit{Rate: Rate{Burst: 1, Interval: time.Minute}, Daily: 1}, []time.Time{start, start}, ErrQuotaUsed, 12 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Usage{}
+			for i, now := range tt.at {
+				wait, err := u.Consume(Download, tt.limit, now)
+				if i < len(tt.at)-1 || tt.err == nil {
+					if err != nil {
+						t.Fatalf("action %d: %v", i, err)
+					}
+					continue
+				}
+				if err != tt.err || wait != tt.wait {
+					t.Errorf("Consume() = %v, %v, want %v, %v", wait, err, tt.wait, tt.err)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageRefusedNotCounted(t *testing.T) {
+	u := &Usage{}
+	limit := Limit{Rate: Rate{Burst: 1, Interval: time.Minute}, Daily: 5}
+	u.Consume(Search, limit, start)
+	if _, err := u.Consume(Search, limit, start); err != ErrRateLimited {
+		t.Fatalf("Consume() error = %v, want %v", err, ErrRateLimited)
+	}
+	if available, remaining := u.Left(Search, limit, start); available != 0 || remaining != 4 {
+		t.Errorf("Left() = %d, %d, want 0, 4", available, remaining)
+	}
+}
+
+func TestUsageRefund(t *testing.T) {
+	limit := Limit{Rate: Rate{Burst: 2, Interval: time.Minute}, Daily: 5}
+	u := &Usage{}
+	u.Consume(Download, limit, start)
+	u.Consume(Download, limit, start)
+	u.Refund(Download, limit, start)
+	if available, remaining := u.Left(Download, limit, start); available != 1 || remaining != 4 {
+		t.Errorf("Left() after a refund = %d, %d, want 1, 4", available, remaining)
+	}
+
+	// the refunds don't go over the limits
+	u.Refund(Download, limit, start)
+	u.Refund(Download, limit, start)
+	if available, remaining := u.Left(Download, limit, start); available != 2 || remaining != 5 {
+		t.Errorf("Left() after more refunds = %d, %d, want 2, 5", available, remaining)
+	}
+
+	// an action of yesterday isn't refunded on today's quota
+	u = &Usage{Day: Day(start), Counts: map[string]int{Download: 1}}
+	u.Refund(Download, Limit{Daily: 5}, start.Add(24*time.Hour))
+	if u.Counts[Download] != 1 {
+		t.Errorf("Refund() changed the count of another day to %d", u.Counts[Download])
+	}
+}
+
+func TestUsageLeft(t *testing.T) {
+	limit := Limit{Rate: Rate{Burst: 5, Interval: time.Minute}, Daily: 3}
+	u := &Usage{}
+	if available, remaining := u.Left(Download, limit, start); available != 3 || remaining != 3 {
+		t.Errorf("Left() = %d, %d, want 3, 3", available, remaining)
+	}
+	u.Consume(Download, limit, start)
+	u.Consume(Download, limit, start)
+	if available, remaining := u.Left(Download, limit, start); available != 1 || remaining != 1 {
+		t.Errorf("Left() = %d, %d, want 1, 1", available, remaining)
+	}
+	if available, remaining := u.Left(Download, limit, start.Add(24*time.Hour)); available != 3 || remaining != 3 {
+		t.Errorf("Left() the next day = %d, %d, want 3, 3", available, remaining)
+	}
+	if available, remaining := u.Left(Download, Limit{Daily: Unlimited}, start); available != Unlimited || remaining != Unlimited {
+		t.Errorf("Left() without limit = %d, %d, want unlimited", available, remaining)
+	}
+}
+
+func TestUntilTomorrow(t *testing.T) {
+	tests := []struct {
+		now  time.Time
+		want time.Duration
+	}{
+		{time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC), 12 * time.Hour},
+		{time.Date(2024, 3, 10, 23, 59, 59, 0, time.UTC), time.Second},
+		{time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), 24 * time.Hour},
+		{time.Date(2024, 3, 10, 20, 0, 0, 0, time.FixedZone("EST", -5*3600)), 23 * time.Hour},
+		{time.Date(2024, 12, 31, 18, 0, 0, 0, time.UTC), 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := UntilTomorrow(tt.now); got != tt.want {
+			t.Errorf("UntilTomorrow(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestFormatWait(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "a minute"},
+		{10 * time.Second, "a minute"},
+		{time.Minute, "a minute"},
+		{time.Minute + time.Second, "2 minutes"},
+		{40 * time.Minute, "40 minutes"},
+		{119 * time.Minute, "119 minutes"},
+		{120 * time.Minute, "2 hours"},
+		{2*time.Hour + time.Second, "3 hours"},
+		{12 * time.Hour, "12 hours"},
+	}
+	for _, tt := range tests {
+		if got := FormatWait(tt.wait); got != tt.want {
+			t.Errorf("FormatWait(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates([]string{"search=5/10s", " download = 3/1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates[Search] != (Rate{5, 10 * time.Second}) || rates[Download] != (Rate{3, time.Minute}) {
+		t.Errorf("ParseRates() = %v", rates)
+	}
+	for _, value := range []string{"search", "search=5", "search=0/1s", "search=5/0s", "search=x/1s", "search=5/fast", "read=5/1s"} {
+		if _, err := ParseRates([]string{value}); err == nil {
+			t.Errorf("ParseRates(%q) succeeded", value)
+		}
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := ParseQuotas([]string{"download=20", "convert=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quotas[Download] != 20 || quotas[Convert] != 0 || len(quotas) != 2 {
+		t.Errorf("ParseQuotas() = %v", quotas)
+	}
+	for _, value := range []string{"download", "download=-1", "download=many", "upload=1"} {
+		if _, err := ParseQuotas([]string{value}); err == nil {
+			t.Errorf("ParseQuotas(%q) succeeded", value)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package scraper
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -9,8 +11,18 @@ import (
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/geobeau/Libbot/book"
+	lang "github.com/geobeau/Libbot/language"
+	"github.com/geobeau/Libbot/logging"
 )
 
+var logger = logging.Package("scraper")
+
+// BaseURL is the address of the website books are fetched from
+var BaseURL = "https://1lib.education"
+
+// Client is the HTTP client used to query the website
+var Client = http.DefaultClient
+
 // ExtractBookMetadata extracts metadata from a webpage
 func ExtractBookMetadata(resp http.Response, id string) book.Book {
 	doc, err := goquery.NewDocumentFromReader(resp.Body)
@@ -22,23 +34,52 @@ func ExtractBookMetadata(resp http.Response, id string) book.Book {
 
 	title := strings.TrimSpace(doc.Find(".itemFullText h1").Eq(0).Text())
 
-	author := strings.TrimSpace(doc.Find(".itemFullText i a").Eq(0).Text())
+	authors := extractAuthors(doc.Find(".itemFullText i a"))
 
 	selector := doc.Find(".bookDetailsBox")
 
-	year := strings.TrimSpace(selector.Find(".property_year .property_value").Eq(0).Text())
+	year := selector.Find(".property_year .property_value").Eq(0).Text()
 	language := strings.TrimSpace(selector.Find(".property_language .property_value").Eq(0).Text())
 	pages := selector.Find(".property_pages span").Eq(0).Text()
 	isbn := strings.TrimSpace(selector.Find(".property_isbn .property_value").Eq(0).Text())
-	fileData := strings.TrimSpace(selector.Find(".property__file .property_value").Eq(0).Text())
-	files := strings.Split(fileData, ",")
-	format := files[0]
-	size := files[1]
+	format := extractFormat(selector.Find(".property__file .property_value").Eq(0).Text())
+	format.URL = url
 	coverURL := doc.Find(".cardBooks .details-book-cover img").Eq(0).AttrOr("src", "")
-	bookMetadata := book.Book{id, author, title, year, url, format, pages, size, language, isbn, coverURL}
+	bookMetadata := book.Book{
+		ID:          id,
+		Authors:     authors,
+		Title:       title,
+		Year:        book.ParseYear(year),
+		Formats:     []book.Format{format},
+		Pages:       book.ParsePages(pages),
+		Language:    lang.Normalize(language),
+		Identifiers: book.ISBNIdentifiers(isbn),
+		CoverURL:    coverURL,
+	}
 	return bookMetadata
 }
 
+// extractAuthors reads the author links of a book, one per author
+func extractAuthors(selector *goquery.Selection) []book.Author {
+	authors := []book.Author{}
+	selector.Each(func(i int, s *goquery.Selection) {
+		if name := strings.TrimSpace(s.Text()); name != "" {
+			authors = append(authors, book.Author{Name: name})
+		}
+	})
+	return authors
+}
+
+// extractFormat reads the file property of a book, like "EPUB, 1.20 MB"
+func extractFormat(text string) book.Format {
+	parts := strings.SplitN(text, ",", 2)
+	format := book.Format{Extension: strings.ToLower(strings.TrimSpace(parts[0]))}
+	if len(parts) > 1 {
+		format.Size = book.ParseSize(parts[1])
+	}
+	return format
+}
+
 // extractBooksFromList extracts multiple book's metada from a search web page
 func extractBooksFromList(resp http.Response) []book.Book {
 	doc, err := goquery.NewDocumentFromReader(resp.Body)
@@ -48,21 +89,23 @@ func extractBooksFromList(resp http.Response) []book.Book {
 	books := []book.Book{}
 	doc.Find("div#searchResultBox div.resItemBox").Each(func(i int, s *goquery.Selection) {
 		id := s.Find("h3 a").Eq(0).AttrOr("href", "")
-		authors := []string{}
-		selector := s.Find(".authors a")
-		for i := range selector.Nodes {
-			authors = append(authors, selector.Eq(i).Text())
-		}
-		author := strings.Join(authors, "")
+		authors := extractAuthors(s.Find(".authors a"))
 
-		checksum := ""
 		title := s.Find("h3 a").Eq(0).Text()
 		year := s.Find(".property_year .property_value").Eq(0).Text()
-		file := strings.Split(s.Find(".property__file .property_value").Eq(0).Text(), ",")
-		format := file[0]
-		pages := ""
-		size := file[1]
-		books = append(books, book.Book{id, author, title, year, checksum, format, pages, size, "", "", ""})
+		format := extractFormat(s.Find(".property__file .property_value").Eq(0).Text())
+		// the ISBNs are only listed by some sources
+		isbn := s.Find(".property_isbn .property_value").Eq(0).Text()
+		language := s.Find(".property_language .property_value").Eq(0).Text()
+		books = append(books, book.Book{
+			ID:          id,
+			Authors:     authors,
+			Title:       title,
+			Year:        book.ParseYear(year),
+			Formats:     []book.Format{format},
+			Identifiers: book.ISBNIdentifiers(isbn),
+			Language:    lang.Normalize(language),
+		})
 	})
 	return books
 }
@@ -74,7 +117,7 @@ func ExtractDownloadURL(resp http.Response) string {
 		log.Fatal(err)
 	}
 	downloadURL := ""
-	log.Println("Searching")
+	logger.Debug("Searching")
 	doc.Find("#info a").Each(func(i int, s *goquery.Selection) {
 		if s.Text() == "GET" {
 			downloadURL = s.AttrOr("href", "")
@@ -89,47 +132,74 @@ func ExtractDetailedMetadataURL(resp http.Response) string {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Searching")
+	logger.Debug("Searching")
 	return doc.Find("td.itemCover a").Eq(0).AttrOr("href", "")
 }
 
+// get queries a URL of the website. Private URLs, like the ones holding
+// search queries, are only logged when personal data can be
+func get(ctx context.Context, rawURL string, private bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	logged := rawURL
+	if private && !logging.PII() {
+		logged = req.URL.Scheme + "://" + req.URL.Host + "/(redacted)"
+	}
+	logger.DebugContext(ctx, "Querying", "url", logged)
+	resp, err := Client.Do(req)
+	if err != nil {
+		logErr := err
+		if urlErr, ok := err.(*url.Error); ok && logged != rawURL {
+			logErr = urlErr.Err
+		}
+		logger.ErrorContext(ctx, "Failed to query URL", "url", logged, logging.Err(logErr))
+		return nil, err
+	}
+	return resp, nil
+}
+
 // FetchBookMetadata crawl and parse the correct api to fetch book metadata
-func FetchBookMetadata(id string) (book.Book, error) {
-	apiBaseURL := "https://1lib.education%s"
-	apiURL := fmt.Sprintf(apiBaseURL, id)
-	log.Println(apiURL)
-	resp, err := http.Get(apiURL)
+func FetchBookMetadata(ctx context.Context, id string) (book.Book, error) {
+	resp, err := get(ctx, BaseURL+id, false)
 	if err != nil {
-		log.Println("Failed to query URL: ", apiURL)
 		return book.Book{}, err
 	}
+	defer resp.Body.Close()
 	bookMetadata := ExtractBookMetadata(*resp, id)
 	return bookMetadata, nil
 }
 
 // GetBookFile Download the book file
-func GetBookFile(id string) (*http.Response, error) {
-	apiBaseURL := "https://1lib.education%s"
-	downloadURL := fmt.Sprintf(apiBaseURL, id)
-	log.Println("Downloading: ", downloadURL)
-	resp, err := http.Get(downloadURL)
+func GetBookFile(ctx context.Context, id string) (*http.Response, error) {
+	logger.InfoContext(ctx, "Downloading", "url", BaseURL+id)
+	return get(ctx, BaseURL+id, false)
+}
+
+// FetchCover downloads a cover image and returns it with its media type
+func FetchCover(ctx context.Context, coverURL string) ([]byte, string, error) {
+	resp, err := get(ctx, coverURL, false)
 	if err != nil {
-		log.Println("Failed to query URL: ", downloadURL)
-		return nil, err
+		return nil, "", err
 	}
-	return resp, nil
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch cover %s: %s", coverURL, resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, resp.Header.Get("Content-Type"), nil
 }
 
 // SearchBooks search for books
-func SearchBooks(query string) []book.Book {
-	cleanQuery := url.PathEscape(query)
-	apiURL := "https://1lib.education/s/" + cleanQuery
-	log.Printf(apiURL)
-	resp, err := http.Get(apiURL)
+func SearchBooks(ctx context.Context, query string) ([]book.Book, error) {
+	resp, err := get(ctx, BaseURL+"/s/"+url.PathEscape(query), true)
 	if err != nil {
-		log.Println("Failed to query URL: ", apiURL)
-		return []book.Book{}
+		return []book.Book{}, err
 	}
-	return extractBooksFromList(*resp)
-
+	defer resp.Body.Close()
+	return extractBooksFromList(*resp), nil
 }
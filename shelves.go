@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/scraper"
+	"github.com/geobeau/Libbot/storage"
+	"github.com/geobeau/Libbot/throttle"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// shelfPageSize is the number of books shown per page of a shelf
+const shelfPageSize = 5
+
+// Buttons of the shelves. The data of shelveButton is the book id, the data
+// of the others is made of the shelf id, the page or the target shelf and
+// the book id, separated by |
+var (
+	shelveButton      = tb.InlineButton{Unique: "shelve_button", Text: "⭐ Save"}
+	shelfAddButton    = tb.InlineButton{Unique: "shelf_add_button"}
+	shelvesButton     = tb.InlineButton{Unique: "shelves_button", Text: "All shelves"}
+	shelfOpenButton   = tb.InlineButton{Unique: "shelf_open_button"}
+	shelfMoveButton   = tb.InlineButton{Unique: "shelf_move_button", Text: "Move"}
+	shelfMoveToButton = tb.InlineButton{Unique: "shelf_move_to_button"}
+	shelfRemoveButton = tb.InlineButton{Unique: "shelf_remove_button", Text: "Remove"}
+)
+
+// shelfData splits the data of a shelf button: the shelf id, a number and the
+// book id
+func shelfData(data string) (int, int, string) {
+	parts := strings.SplitN(data, "|", 3)
+	shelfID, _ := strconv.Atoi(parts[0])
+	number := 0
+	if len(parts) > 1 {
+		number, _ = strconv.Atoi(parts[1])
+	}
+	bookID := ""
+	if len(parts) > 2 {
+		bookID = parts[2]
+	}
+	return shelfID, number, bookID
+}
+
+// shelveBook saves a book of a result or info card. With several shelves the
+// user picks the shelf
+func (a *app) shelveBook(ctx context.Context, c *tb.Callback) {
+	shelves := a.store.Shelves(c.Sender.ID)
+	if len(shelves) <= 1 {
+		a.addToShelf(ctx, c, 0, c.Data)
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{})
+	keyboard := [][]tb.InlineButton{}
+	for _, shelf := range shelves {
+		button := shelfAddButton
+		button.Text = shelf.Name
+		button.Data = fmt.Sprintf("%d|0|%s", shelf.ID, c.Data)
+		keyboard = append(keyboard, []tb.InlineButton{button})
+	}
+	a.bot.Send(c.Sender, "Save to which shelf?", &tb.ReplyMarkup{InlineKeyboard: keyboard})
+}
+
+// addToChosenShelf saves a book on the shelf picked by the user
+func (a *app) addToChosenShelf(ctx context.Context, c *tb.Callback) {
+	shelfID, _, bookID := shelfData(c.Data)
+	a.addToShelf(ctx, c, shelfID, bookID)
+}
+
+// addToShelf saves a book on a shelf, its title and author are fetched from
+// the source
+func (a *app) addToShelf(ctx context.Context, c *tb.Callback, shelfID int, bookID string) {
+	bookMetadata, err := scraper.FetchBookMetadata(ctx, bookID)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to fetch book to save", logging.Err(err))
+		if errors.Is(err, throttle.ErrOpen) {
+			a.bot.Respond(c, &tb.CallbackResponse{Text: pipeline.UnavailableMessage})
+		} else {
+			a.bot.Respond(c, &tb.CallbackResponse{Text: "Failed to save the book"})
+		}
+		return
+	}
+	shelf, err := a.store.AddToShelf(c.Sender.ID, shelfID, storage.ShelfBook{
+		ID:     bookID,
+		Title:  bookMetadata.Title,
+		Author: bookMetadata.Author(),
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to save book", logging.Err(err))
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Failed to save the book"})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Saved to " + shelf.Name})
+}
+
+// shelvesList describes the shelves of a user
+func (a *app) shelvesList(userID int) (string, *tb.ReplyMarkup) {
+	shelves := a.store.Shelves(userID)
+	usage := "/shelves new <name> creates a shelf, /shelves delete <name> deletes one, " +
+		"/shelves export sends them as a CSV file"
+	if len(shelves) == 0 {
+		return "You have no shelf yet, save a book with ⭐ Save or create a shelf.\n" + usage, &tb.ReplyMarkup{}
+	}
+	keyboard := [][]tb.InlineButton{}
+	for _, shelf := range shelves {
+		button := shelfOpenButton
+		button.Text = fmt.Sprintf("%s (%d)", shelf.Name, len(shelf.Books))
+		button.Data = fmt.Sprintf("%d|0", shelf.ID)
+		keyboard = append(keyboard, []tb.InlineButton{button})
+	}
+	return "Your shelves:\n" + usage, &tb.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+// shelfPage describes a page of a shelf
+func (a *app) shelfPage(userID, shelfID, page int) (string, *tb.ReplyMarkup) {
+	shelf, ok := a.store.Shelf(userID, shelfID)
+	if !ok {
+		return a.shelvesList(userID)
+	}
+	back := []tb.InlineButton{shelvesButton}
+	if len(shelf.Books) == 0 {
+		return shelf.Name + " is empty", &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{back}}
+	}
+	page, pages, start, end := paginate(len(shelf.Books), shelfPageSize, page)
+	lines := []string{fmt.Sprintf("%s (page %d/%d):", shelf.Name, page+1, pages)}
+	keyboard := [][]tb.InlineButton{}
+	for i, book := range shelf.Books[start:end] {
+		number := start + i + 1
+		line := fmt.Sprintf("%d. %s", number, book.Title)
+		if book.Author != "" {
+			line += " - " + book.Author
+		}
+		lines = append(lines, line)
+
+		data := fmt.Sprintf("%d|%d|%s", shelf.ID, page, book.ID)
+		download, move, remove := downloadButton, shelfMoveButton, shelfRemoveButton
+		download.Text = fmt.Sprintf("%d. %s", number, download.Text)
+		download.Data, move.Data, remove.Data = book.ID, data, data
+		keyboard = append(keyboard, []tb.InlineButton{download, move, remove})
+	}
+	navigation := pageButtons(shelfOpenButton, page, pages, func(page int) string {
+		return fmt.Sprintf("%d|%d", shelf.ID, page)
+	})
+	keyboard = append(keyboard, append(navigation, back...))
+	return strings.Join(lines, "\n"), &tb.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+// handleShelves lists, creates, deletes and exports the shelves of a user
+func (a *app) handleShelves(ctx context.Context, m *tb.Message) {
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		text, markup := a.shelvesList(m.Sender.ID)
+		a.bot.Send(m.Sender, text, markup)
+		return
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(m.Payload), args[0]))
+	switch args[0] {
+	case "new":
+		shelf, err := a.store.CreateShelf(m.Sender.ID, name)
+		if err != nil {
+			a.bot.Send(m.Sender, fmt.Sprintf("Failed to create the shelf: %v", err))
+			return
+		}
+		a.bot.Send(m.Sender, "Shelf "+shelf.Name+" created")
+	case "delete":
+		for _, shelf := range a.store.Shelves(m.Sender.ID) {
+			if strings.EqualFold(shelf.Name, name) {
+				if err := a.store.DeleteShelf(m.Sender.ID, shelf.ID); err != nil {
+					a.bot.Send(m.Sender, fmt.Sprintf("Failed to delete the shelf: %v", err))
+					return
+				}
+				a.bot.Send(m.Sender, fmt.Sprintf("Shelf %s deleted with its %d book(s)", shelf.Name, len(shelf.Books)))
+				return
+			}
+		}
+		a.bot.Send(m.Sender, "You have no shelf named "+name)
+	case "export":
+		a.exportShelves(ctx, m)
+	default:
+		a.bot.Send(m.Sender, "Usage: /shelves [new <name>|delete <name>|export]")
+	}
+}
+
+// exportShelves sends the shelves of a user as a CSV file
+func (a *app) exportShelves(ctx context.Context, m *tb.Message) {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Write([]string{"shelf", "title", "author", "book_id", "added"})
+	for _, shelf := range a.store.Shelves(m.Sender.ID) {
+		for _, book := range shelf.Books {
+			w.Write([]string{shelf.Name, book.Title, book.Author, book.ID, book.Added.UTC().Format(time.RFC3339)})
+		}
+	}
+	w.Flush()
+	file := tb.FromReader(buf)
+	file.FileName = "shelves.csv"
+	if _, err := a.bot.Send(m.Sender, &tb.Document{File: file}); err != nil {
+		logger.ErrorContext(ctx, "Failed to export shelves", logging.Err(err))
+		a.bot.Send(m.Sender, "Failed to export your shelves")
+	}
+}
+
+// showShelves shows the list of shelves in place of a shelf
+func (a *app) showShelves(ctx context.Context, c *tb.Callback) {
+	a.bot.Respond(c, &tb.CallbackResponse{})
+	text, markup := a.shelvesList(c.Sender.ID)
+	a.bot.Edit(c.Message, text, markup)
+}
+
+// openShelf shows a page of a shelf
+func (a *app) openShelf(ctx context.Context, c *tb.Callback) {
+	shelfID, page, _ := shelfData(c.Data)
+	a.bot.Respond(c, &tb.CallbackResponse{})
+	text, markup := a.shelfPage(c.Sender.ID, shelfID, page)
+	a.bot.Edit(c.Message, text, markup)
+}
+
+// chooseMoveTarget offers the other shelves to move a book to
+func (a *app) chooseMoveTarget(ctx context.Context, c *tb.Callback) {
+	shelfID, page, bookID := shelfData(c.Data)
+	a.bot.Respond(c, &tb.CallbackResponse{})
+	keyboard := [][]tb.InlineButton{}
+	for _, shelf := range a.store.Shelves(c.Sender.ID) {
+		if shelf.ID == shelfID {
+			continue
+		}
+		button := shelfMoveToButton
+		button.Text = "Move to " + shelf.Name
+		button.Data = fmt.Sprintf("%d|%d|%s", shelfID, shelf.ID, bookID)
+		keyboard = append(keyboard, []tb.InlineButton{button})
+	}
+	if len(keyboard) == 0 {
+		a.bot.Send(c.Sender, "Create another shelf first with /shelves new <name>")
+		return
+	}
+	cancel := shelfOpenButton
+	cancel.Text, cancel.Data = "Cancel", fmt.Sprintf("%d|%d", shelfID, page)
+	keyboard = append(keyboard, []tb.InlineButton{cancel})
+	a.bot.Edit(c.Message, "Move the book to:", &tb.ReplyMarkup{InlineKeyboard: keyboard})
+}
+
+// moveToShelf moves a book to the chosen shelf and shows the shelf it was on
+func (a *app) moveToShelf(ctx context.Context, c *tb.Callback) {
+	from, to, bookID := shelfData(c.Data)
+	if err := a.store.MoveBook(c.Sender.ID, from, to, bookID); err != nil {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Failed to move the book: " + err.Error()})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Moved"})
+	text, markup := a.shelfPage(c.Sender.ID, from, 0)
+	a.bot.Edit(c.Message, text, markup)
+}
+
+// removeFromShelf removes a book from a shelf
+func (a *app) removeFromShelf(ctx context.Context, c *tb.Callback) {
+	shelfID, page, bookID := shelfData(c.Data)
+	if err := a.store.RemoveFromShelf(c.Sender.ID, shelfID, bookID); err != nil {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Failed to remove the book"})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Removed"})
+	text, markup := a.shelfPage(c.Sender.ID, shelfID, page)
+	a.bot.Edit(c.Message, text, markup)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// cancelledMessage is sent to the users whose job was interrupted by a shutdown
+const cancelledMessage = "Libbot is restarting, your request will resume in a minute"
+
+// activeJobs remembers the jobs waiting in the queue or running, so they can
+// be listed and cancelled by the admins, and their users told when a
+// shutdown interrupts them
+type activeJobs struct {
+	mu   sync.Mutex
+	next int
+	jobs map[int]*activeJob
+}
+
+// activeJob is a job waiting in the queue or running
+type activeJob struct {
+	job     storage.Job
+	queued  time.Time
+	started time.Time
+	cancel  context.CancelFunc
+	// cancelled is set when an admin cancelled the job
+	cancelled bool
+}
+
+func newActiveJobs() *activeJobs {
+	return &activeJobs{jobs: map[int]*activeJob{}}
+}
+
+// add registers a queued job, cancel stops it
+func (j *activeJobs) add(job storage.Job, cancel context.CancelFunc) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.next++
+	j.jobs[j.next] = &activeJob{job: job, queued: time.Now(), cancel: cancel}
+	return j.next
+}
+
+// start marks a job as running
+func (j *activeJobs) start(id int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job, ok := j.jobs[id]; ok {
+		job.started = time.Now()
+	}
+}
+
+func (j *activeJobs) remove(id int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.jobs, id)
+}
+
+// cancel cancels a job, it returns false if the job is already finished
+func (j *activeJobs) cancel(id int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return false
+	}
+	job.cancelled = true
+	job.cancel()
+	return true
+}
+
+// cancelled tells if an admin cancelled a job
+func (j *activeJobs) cancelled(id int) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	return ok && job.cancelled
+}
+
+// list returns a copy of the jobs by id
+func (j *activeJobs) list() map[int]activeJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	jobs := map[int]activeJob{}
+	for id, job := range j.jobs {
+		jobs[id] = *job
+	}
+	return jobs
+}
+
+// recipients returns the users of the running jobs
+func (j *activeJobs) recipients() []tb.Recipient {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	recipients := []tb.Recipient{}
+	for _, job := range j.jobs {
+		if !job.started.IsZero() {
+			recipients = append(recipients, &tb.User{ID: job.job.UserID})
+		}
+	}
+	return recipients
+}
+
+// shutdown stops accepting jobs and waits for the running ones up to the
+// configured timeout. The users of the jobs still running after it are told
+// their request resumes on the next start. The temporary files are removed
+// once every job is finished, the ones of the interrupted jobs are removed
+// by the next start: removing them now would fail the jobs, which would be
+// forgotten instead of resumed
+func (a *app) shutdown() {
+	timeout := time.Duration(a.cfg.ShutdownTimeout) * time.Second
+	logger.Info("Waiting for running jobs", "timeout", timeout, "running", a.queue.Running())
+	if !a.queue.Drain(timeout) {
+		recipients := a.active.recipients()
+		logger.Warn("Interrupting running jobs", "running", len(recipients))
+		for _, to := range recipients {
+			a.bot.Send(to, cancelledMessage)
+		}
+		return
+	}
+	if err := a.converter().Cleanup(); err != nil {
+		logger.Error("Failed to remove temporary files", logging.Err(err))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/scraper"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// maxTrackedQueries bounds the number of distinct queries counted for the top
+// queries
+const maxTrackedQueries = 1000
+
+// topQueries is the number of queries listed by /stats
+const topQueries = 5
+
+// stats counts what the users did since the start, for /stats. The queries
+// are only counted in memory and are never linked to a user
+type stats struct {
+	mu       sync.Mutex
+	started  time.Time
+	searches int
+	queries  map[string]int
+	// jobs counts the jobs by kind and result
+	jobs map[string]map[string]int
+}
+
+func newStats() *stats {
+	return &stats{started: time.Now(), queries: map[string]int{}, jobs: map[string]map[string]int{}}
+}
+
+// search counts a search
+func (s *stats) search(query string) {
+	query = strings.ToLower(strings.Join(strings.Fields(query), " "))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.searches++
+	if _, ok := s.queries[query]; ok || len(s.queries) < maxTrackedQueries {
+		s.queries[query]++
+	}
+}
+
+// job counts a finished job
+func (s *stats) job(kind string, result pipeline.Result) {
+	label := "succeeded"
+	if result.Err() != nil {
+		label = "failed"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs[kind] == nil {
+		s.jobs[kind] = map[string]int{}
+	}
+	s.jobs[kind][label]++
+}
+
+// summary describes the counters
+func (s *stats) summary() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lines := []string{
+		fmt.Sprintf("Since %s:", s.started.UTC().Format("2006-01-02 15:04 MST")),
+		fmt.Sprintf("• searches: %d", s.searches),
+	}
+	kinds := []string{}
+	for kind := range s.jobs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		lines = append(lines, fmt.Sprintf("• %s: %d succeeded, %d failed", kind, s.jobs[kind]["succeeded"], s.jobs[kind]["failed"]))
+	}
+	queries := []string{}
+	for query := range s.queries {
+		queries = append(queries, query)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if s.queries[queries[i]] != s.queries[queries[j]] {
+			return s.queries[queries[i]] > s.queries[queries[j]]
+		}
+		return queries[i] < queries[j]
+	})
+	if len(queries) > topQueries {
+		queries = queries[:topQueries]
+	}
+	if len(queries) > 0 {
+		lines = append(lines, "Top queries:")
+		for _, query := range queries {
+			lines = append(lines, fmt.Sprintf("• %s (%d)", query, s.queries[query]))
+		}
+	}
+	return lines
+}
+
+// handleStats describes the activity of the bot, for admins
+func (a *app) handleStats(ctx context.Context, m *tb.Message) {
+	users := a.store.CountUsers(time.Now())
+	lines := []string{fmt.Sprintf("Users: %d known, %d active today, %d banned", users.Total, users.Active, users.Banned)}
+	lines = append(lines, a.stats.summary()...)
+	lines = append(lines, fmt.Sprintf("Queue: %d running, %d waiting", a.queue.Running(), a.queue.Waiting()))
+	if source, err := url.Parse(scraper.BaseURL); err == nil {
+		lines = append(lines, fmt.Sprintf("Source %s: %s", source.Host, a.source.State(source.Host)))
+	}
+	a.bot.Send(m.Sender, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Roles of the users, in increasing order of privileges
+const (
+	RoleUser    = "user"
+	RoleTrusted = "trusted"
+	RoleAdmin   = "admin"
+)
+
+// Roles lists the roles in increasing order of privileges
+var Roles = []string{RoleUser, RoleTrusted, RoleAdmin}
+
+// RoleRank returns the position of a role in Roles, -1 if it is unknown
+func RoleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// ErrInvalidInvite is returned when an invite code is unknown or used
+var ErrInvalidInvite = errors.New("invalid invite code")
+
+// Invite is a code giving access to the bot
+type Invite struct {
+	Code      string    `json:"code"`
+	Role      string    `json:"role"`
+	CreatedBy int       `json:"created_by"`
+	Created   time.Time `json:"created"`
+	UsedBy    int       `json:"used_by,omitempty"`
+	Used      time.Time `json:"used,omitempty"`
+}
+
+// Access is what a user was granted
+type Access struct {
+	// Role is the role given by an admin or an invite
+	Role string `json:"role,omitempty"`
+	// Invited is set once the user redeemed an invite code
+	Invited bool `json:"invited,omitempty"`
+	// Banned users can't use the bot anymore
+	Banned bool `json:"banned,omitempty"`
+}
+
+// Access returns what a user was granted
+func (s *Store) Access(userID int) Access {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.data.Users[userID]; ok {
+		return u.Access
+	}
+	return Access{}
+}
+
+// SetRole changes the role of a user
+func (s *Store) SetRole(userID int, role string) error {
+	if RoleRank(role) < 0 {
+		return errors.New("unknown role " + role)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user(userID).Access.Role = role
+	return s.save()
+}
+
+// SetBanned bans or unbans a user
+func (s *Store) SetBanned(userID int, banned bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user(userID).Access.Banned = banned
+	return s.save()
+}
+
+// CreateInvite creates a single use invite code giving a role
+func (s *Store) CreateInvite(createdBy int, role string) (Invite, error) {
+	if RoleRank(role) < 0 {
+		return Invite{}, errors.New("unknown role " + role)
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return Invite{}, err
+	}
+	invite := Invite{Code: hex.EncodeToString(buf), Role: role, CreatedBy: createdBy, Created: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := invite
+	s.data.Invites[invite.Code] = &saved
+	return invite, s.save()
+}
+
+// RedeemInvite gives access to a user with an invite code, the code can't be
+// used again
+func (s *Store) RedeemInvite(code string, userID int) (Invite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.data.Invites[code]
+	if !ok || invite.UsedBy != 0 {
+		return Invite{}, ErrInvalidInvite
+	}
+	invite.UsedBy = userID
+	invite.Used = time.Now()
+	access := &s.user(userID).Access
+	access.Invited = true
+	if RoleRank(invite.Role) > RoleRank(access.Role) {
+		access.Role = invite.Role
+	}
+	return *invite, s.save()
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Kinds of follows
+const (
+	FollowAuthor = "author"
+	FollowSeries = "series"
+)
+
+// Limits of the follows of a user
+const (
+	maxFollows = 20
+	// maxSeen is the number of book ids remembered per follow
+	maxSeen = 500
+)
+
+// ErrFollowExists is returned when a user already follows an author or series
+var ErrFollowExists = errors.New("already followed")
+
+// Follow is an author or a series followed by a user
+type Follow struct {
+	ID   int    `json:"id"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Seen are the ids of the books already found, newest last
+	Seen []string `json:"seen,omitempty"`
+	// Checked is the last time the books were searched, zero until the
+	// first search which only records the existing books
+	Checked time.Time `json:"checked,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// AddFollow adds a follow to a user and returns it with its id
+func (s *Store) AddFollow(userID int, kind, name string) (Follow, error) {
+	name = strings.TrimSpace(name)
+	if kind != FollowAuthor && kind != FollowSeries {
+		return Follow{}, errors.New("unknown kind " + kind)
+	}
+	if name == "" {
+		return Follow{}, errors.New("empty name")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.activeUser(userID)
+	for _, follow := range u.Follows {
+		if follow.Kind == kind && strings.EqualFold(follow.Name, name) {
+			return Follow{}, ErrFollowExists
+		}
+	}
+	if len(u.Follows) >= maxFollows {
+		return Follow{}, errors.New("too many follows")
+	}
+	u.NextFollowID++
+	follow := Follow{ID: u.NextFollowID, Kind: kind, Name: name, Created: time.Now()}
+	u.Follows = append(u.Follows, follow)
+	return follow, s.save()
+}
+
+// Follows returns the follows of a user
+func (s *Store) Follows(userID int) []Follow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	follows := []Follow{}
+	if u, ok := s.data.Users[userID]; ok {
+		for _, follow := range u.Follows {
+			follows = append(follows, copyFollow(follow))
+		}
+	}
+	return follows
+}
+
+// AllFollows returns the follows of the users who aren't banned, by user id
+func (s *Store) AllFollows() map[int][]Follow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := map[int][]Follow{}
+	for id, u := range s.data.Users {
+		if u.Access.Banned || len(u.Follows) == 0 {
+			continue
+		}
+		for _, follow := range u.Follows {
+			all[id] = append(all[id], copyFollow(follow))
+		}
+	}
+	return all
+}
+
+// RemoveFollow removes a follow of a user
+func (s *Store) RemoveFollow(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userID)
+	for i, follow := range u.Follows {
+		if follow.ID == id {
+			u.Follows = append(u.Follows[:i], u.Follows[i+1:]...)
+			return s.save()
+		}
+	}
+	return errors.New("no such follow")
+}
+
+// MarkSeen records the books found by a search of a follow
+func (s *Store) MarkSeen(userID, id int, bookIDs []string, checked time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[userID]
+	if !ok {
+		return nil
+	}
+	for i := range u.Follows {
+		follow := &u.Follows[i]
+		if follow.ID != id {
+			continue
+		}
+		for _, bookID := range bookIDs {
+			if !contains(follow.Seen, bookID) {
+				follow.Seen = append(follow.Seen, bookID)
+			}
+		}
+		if len(follow.Seen) > maxSeen {
+			follow.Seen = append([]string(nil), follow.Seen[len(follow.Seen)-maxSeen:]...)
+		}
+		follow.Checked = checked
+		return s.save()
+	}
+	return nil
+}
+
+func copyFollow(follow Follow) Follow {
+	follow.Seen = append([]string(nil), follow.Seen...)
+	return follow
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/geobeau/Libbot/book"
+)
+
+// maxHistory is the number of deliveries remembered per user, the oldest are
+// dropped
+const maxHistory = 100
+
+// Delivery is a file delivered to a user
+type Delivery struct {
+	ID   int    `json:"id"`
+	Kind string `json:"kind"`
+	// BookID is the id of the book at the source, empty for the files sent
+	// by the user
+	BookID   string    `json:"book_id,omitempty"`
+	Book     book.Book `json:"book"`
+	Filename string    `json:"filename"`
+	Format   string    `json:"format"`
+	// FileID is the telegram file id of the files sent on telegram, they can
+	// be sent again without downloading them
+	FileID    string    `json:"file_id,omitempty"`
+	Delivered time.Time `json:"delivered"`
+}
+
+// ErrForgotten is returned when adding a delivery to a forgotten user, like
+// the ones of a job which was running when the user was forgotten
+var ErrForgotten = errors.New("user forgotten")
+
+// AddDelivery adds a delivery to the history of a user and returns it with
+// its id
+func (s *Store) AddDelivery(userID int, delivery Delivery) (Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userID)
+	if u.Forgotten {
+		return Delivery{}, ErrForgotten
+	}
+	u.NextDeliveryID++
+	delivery.ID = u.NextDeliveryID
+	if delivery.Delivered.IsZero() {
+		delivery.Delivered = time.Now()
+	}
+	u.History = append(u.History, delivery)
+	if len(u.History) > maxHistory {
+		u.History = append([]Delivery(nil), u.History[len(u.History)-maxHistory:]...)
+	}
+	return delivery, s.save()
+}
+
+// History returns the deliveries of a user, newest first
+func (s *Store) History(userID int) []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := []Delivery{}
+	if u, ok := s.data.Users[userID]; ok {
+		for i := len(u.History) - 1; i >= 0; i-- {
+			history = append(history, u.History[i])
+		}
+	}
+	return history
+}
+
+// Delivery returns a delivery of a user
+func (s *Store) Delivery(userID, id int) (Delivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.data.Users[userID]; ok {
+		for _, delivery := range u.History {
+			if delivery.ID == id {
+				return delivery, true
+			}
+		}
+	}
+	return Delivery{}, false
+}
+
+// RemoveDelivery removes a delivery from the history of a user
+func (s *Store) RemoveDelivery(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[userID]
+	if !ok {
+		return nil
+	}
+	history := u.History[:0]
+	for _, delivery := range u.History {
+		if delivery.ID != id {
+			history = append(history, delivery)
+		}
+	}
+	u.History = history
+	return s.save()
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/geobeau/Libbot/book"
+)
+
+// Job is a download or a conversion requested by a user. It is kept until it
+// finishes so it can be resumed after a restart
+type Job struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	Kind   string `json:"kind"`
+	// BookID is the id of the book, or the telegram file id of an upload
+	BookID string `json:"book_id"`
+	// Formats are the formats requested by the user
+	Formats []string `json:"formats,omitempty"`
+	// Filename and Book describe the file sent by the user of a conversion
+	Filename string     `json:"filename,omitempty"`
+	Book     *book.Book `json:"book,omitempty"`
+	// Stages are the stages already completed
+	Stages []string `json:"stages,omitempty"`
+	// Role is the role of the user when the job was requested
+	Role string `json:"role,omitempty"`
+	// RequestID is the correlation id of the request which created the job
+	RequestID string `json:"request_id,omitempty"`
+	// Attempts is the number of times the job was started
+	Attempts int       `json:"attempts"`
+	Created  time.Time `json:"created"`
+}
+
+// AddJob saves a new job and returns it with its id
+func (s *Store) AddJob(job Job) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.NextJobID++
+	job.ID = s.data.NextJobID
+	if job.Created.IsZero() {
+		job.Created = time.Now()
+	}
+	saved := job
+	s.data.Jobs[job.ID] = &saved
+	return job, s.save()
+}
+
+// Jobs returns the saved jobs, oldest first
+func (s *Store) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []Job{}
+	for _, job := range s.data.Jobs {
+		copied := *job
+		copied.Stages = append([]string(nil), job.Stages...)
+		jobs = append(jobs, copied)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// StartJob counts an attempt of a job
+func (s *Store) StartJob(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.data.Jobs[id]
+	if !ok {
+		return nil
+	}
+	job.Attempts++
+	return s.save()
+}
+
+// CompleteStage records a stage completed by a job
+func (s *Store) CompleteStage(id int, stage string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.data.Jobs[id]
+	if !ok {
+		return nil
+	}
+	for _, done := range job.Stages {
+		if done == stage {
+			return nil
+		}
+	}
+	job.Stages = append(job.Stages, stage)
+	return s.save()
+}
+
+// RemoveJob deletes a finished job
+func (s *Store) RemoveJob(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Jobs[id]; !ok {
+		return nil
+	}
+	delete(s.data.Jobs, id)
+	return s.save()
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/geobeau/Libbot/quota"
+)
+
+// Consume records an action of a user if the limit allows it, see
+// quota.Usage.Consume. The usage is written by Flush or with the next change
+// of the store, not on every action
+func (s *Store) Consume(userID int, action string, limit quota.Limit, now time.Time) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait, err := s.activeUser(userID).Usage.Consume(action, limit, now)
+	if err != nil {
+		return wait, err
+	}
+	s.unsaved = true
+	return 0, nil
+}
+
+// Refund gives back an action of a user, see quota.Usage.Refund
+func (s *Store) Refund(userID int, action string, limit quota.Limit, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user(userID).Usage.Refund(action, limit, now)
+	s.unsaved = true
+}
+
+// Flush writes the usage recorded since the last write
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.unsaved {
+		return nil
+	}
+	return s.save()
+}
+
+// Usage returns what a user consumed of the limits
+func (s *Store) Usage(userID int) quota.Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[userID]
+	if !ok {
+		return quota.Usage{}
+	}
+	usage := quota.Usage{Day: u.Usage.Day, Buckets: map[string]quota.Bucket{}, Counts: map[string]int{}}
+	for action, bucket := range u.Usage.Buckets {
+		usage.Buckets[action] = bucket
+	}
+	for action, count := range u.Usage.Counts {
+		usage.Counts[action] = count
+	}
+	return usage
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/geobeau/Libbot/quota"
+)
+
+// openTemp opens a store in a temporary directory
+func openTemp(t *testing.T) (*Store, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "libbot-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "libbot.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, path
+}
+
+func TestStoreConsume(t *testing.T) {
+	s, path := openTemp(t)
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	limit := quota.Limit{Rate: quota.Rate{Burst: 1, Interval: time.Minute}, Daily: 2}
+
+	if _, err := s.Consume(1, quota.Download, limit, now); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := s.Consume(1, quota.Download, limit, now.Add(15*time.Second)); err != quota.ErrRateLimited || wait != 45*time.Second {
+		t.Errorf("Consume() = %v, %v, want 45s, %v", wait, err, quota.ErrRateLimited)
+	}
+	if _, err := s.Consume(2, quota.Download, limit, now); err != nil {
+		t.Errorf("Consume() of another user: %v", err)
+	}
+	if usage := s.Usage(1); usage.Counts[quota.Download] != 1 || usage.Day != "2024-03-10" {
+		t.Errorf("Usage() = %+v, want one download on 2024-03-10", usage)
+	}
+
+	// the actions aren't written one by one
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Consume() wrote the store: %v", err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage := reopened.Usage(1); usage.Counts[quota.Download] != 1 {
+		t.Errorf("Usage() after a flush = %+v, want one download", usage)
+	}
+}
+
+func TestStoreFlush(t *testing.T) {
+	s, path := openTemp(t)
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	limit := quota.Limit{Daily: quota.Unlimited}
+
+	// nothing to write
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Flush() wrote an unchanged store: %v", err)
+	}
+
+	// the other changes write the usage along
+	s.Consume(1, quota.Search, limit, now)
+	if err := s.ForgetUser(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Flush() wrote the usage already written: %v", err)
+	}
+}
+
+func TestStoreRefund(t *testing.T) {
+	s, path := openTemp(t)
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	limit := quota.Limit{Daily: 1}
+
+	s.Consume(1, quota.Convert, limit, now)
+	if _, err := s.Consume(1, quota.Convert, limit, now); err != quota.ErrQuotaUsed {
+		t.Fatalf("Consume() error = %v, want %v", err, quota.ErrQuotaUsed)
+	}
+	s.Refund(1, quota.Convert, limit, now)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Consume(1, quota.Convert, limit, now); err != nil {
+		t.Errorf("Consume() after a refund: %v", err)
+	}
+}
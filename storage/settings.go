@@ -0,0 +1,30 @@
+package storage
+
+// Settings are the preferences of a user
+type Settings struct {
+	// Email is the address books are sent to, usually a Kindle address
+	Email string `json:"email,omitempty"`
+	// EmailFormat is the format of the books sent by email
+	EmailFormat string `json:"email_format,omitempty"`
+	// Language is the code of the language whose books are listed first in
+	// the search results
+	Language string `json:"language,omitempty"`
+}
+
+// Settings returns the settings of a user
+func (s *Store) Settings(userID int) Settings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.data.Users[userID]; ok {
+		return u.Settings
+	}
+	return Settings{}
+}
+
+// SetSettings replaces the settings of a user
+func (s *Store) SetSettings(userID int, settings Settings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activeUser(userID).Settings = settings
+	return s.save()
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// DefaultShelf is the shelf created for the first saved book
+const DefaultShelf = "Favorites"
+
+// Limits of the shelves of a user
+const (
+	maxShelves        = 20
+	maxShelfNameRunes = 32
+)
+
+// Errors of the shelves
+var (
+	ErrNoShelf     = errors.New("no such shelf")
+	ErrShelfExists = errors.New("a shelf already has this name")
+)
+
+// Shelf is a named list of books saved by a user
+type Shelf struct {
+	ID    int         `json:"id"`
+	Name  string      `json:"name"`
+	Books []ShelfBook `json:"books,omitempty"`
+}
+
+// ShelfBook is a book saved on a shelf
+type ShelfBook struct {
+	// ID is the id of the book at the source
+	ID     string    `json:"id"`
+	Title  string    `json:"title"`
+	Author string    `json:"author,omitempty"`
+	Added  time.Time `json:"added"`
+}
+
+// Shelves returns the shelves of a user
+func (s *Store) Shelves(userID int) []Shelf {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shelves := []Shelf{}
+	if u, ok := s.data.Users[userID]; ok {
+		for _, shelf := range u.Shelves {
+			shelves = append(shelves, copyShelf(shelf))
+		}
+	}
+	return shelves
+}
+
+// Shelf returns a shelf of a user
+func (s *Store) Shelf(userID, id int) (Shelf, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.data.Users[userID]; ok {
+		if shelf := u.shelf(id); shelf != nil {
+			return copyShelf(*shelf), true
+		}
+	}
+	return Shelf{}, false
+}
+
+// CreateShelf creates an empty shelf
+func (s *Store) CreateShelf(userID int, name string) (Shelf, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > maxShelfNameRunes {
+		return Shelf{}, errors.New("the name of a shelf must have 1 to 32 characters")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.activeUser(userID)
+	if len(u.Shelves) >= maxShelves {
+		return Shelf{}, errors.New("too many shelves")
+	}
+	for _, shelf := range u.Shelves {
+		if strings.EqualFold(shelf.Name, name) {
+			return Shelf{}, ErrShelfExists
+		}
+	}
+	shelf := u.addShelf(name)
+	return copyShelf(*shelf), s.save()
+}
+
+// DeleteShelf deletes a shelf with its books
+func (s *Store) DeleteShelf(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userID)
+	for i, shelf := range u.Shelves {
+		if shelf.ID == id {
+			u.Shelves = append(u.Shelves[:i], u.Shelves[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNoShelf
+}
+
+// AddToShelf saves a book on a shelf, a zero shelf id is the first shelf of
+// the user, created if needed. It returns the shelf
+func (s *Store) AddToShelf(userID, shelfID int, book ShelfBook) (Shelf, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.activeUser(userID)
+	var shelf *Shelf
+	switch {
+	case shelfID != 0:
+		shelf = u.shelf(shelfID)
+	case len(u.Shelves) > 0:
+		shelf = &u.Shelves[0]
+	default:
+		shelf = u.addShelf(DefaultShelf)
+	}
+	if shelf == nil {
+		return Shelf{}, ErrNoShelf
+	}
+	if shelf.book(book.ID) < 0 {
+		if book.Added.IsZero() {
+			book.Added = time.Now()
+		}
+		shelf.Books = append(shelf.Books, book)
+	}
+	return copyShelf(*shelf), s.save()
+}
+
+// RemoveFromShelf removes a book from a shelf
+func (s *Store) RemoveFromShelf(userID, shelfID int, bookID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shelf := s.user(userID).shelf(shelfID)
+	if shelf == nil {
+		return ErrNoShelf
+	}
+	if i := shelf.book(bookID); i >= 0 {
+		shelf.Books = append(shelf.Books[:i], shelf.Books[i+1:]...)
+	}
+	return s.save()
+}
+
+// MoveBook moves a book from a shelf to another
+func (s *Store) MoveBook(userID, from, to int, bookID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userID)
+	source, target := u.shelf(from), u.shelf(to)
+	if source == nil || target == nil {
+		return ErrNoShelf
+	}
+	i := source.book(bookID)
+	if i < 0 {
+		return errors.New("the book is not on the shelf anymore")
+	}
+	book := source.Books[i]
+	source.Books = append(source.Books[:i], source.Books[i+1:]...)
+	if target.book(bookID) < 0 {
+		target.Books = append(target.Books, book)
+	}
+	return s.save()
+}
+
+// shelf returns a shelf of the user, nil if it doesn't exist
+func (u *User) shelf(id int) *Shelf {
+	for i := range u.Shelves {
+		if u.Shelves[i].ID == id {
+			return &u.Shelves[i]
+		}
+	}
+	return nil
+}
+
+// addShelf adds an empty shelf to the user
+func (u *User) addShelf(name string) *Shelf {
+	u.NextShelfID++
+	u.Shelves = append(u.Shelves, Shelf{ID: u.NextShelfID, Name: name})
+	return &u.Shelves[len(u.Shelves)-1]
+}
+
+// book returns the position of a book on the shelf, -1 if it isn't on it
+func (shelf *Shelf) book(id string) int {
+	for i, book := range shelf.Books {
+		if book.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func copyShelf(shelf Shelf) Shelf {
+	shelf.Books = append([]ShelfBook(nil), shelf.Books...)
+	return shelf
+}
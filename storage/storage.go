@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/geobeau/Libbot/quota"
+)
+
+// Store persists the bot data in a JSON file. Every change is written to
+// disk right away but the usage of the limits, written by Flush. An empty
+// path keeps the data in memory only
+type Store struct {
+	path string
+	mu   sync.Mutex
+	data data
+	// unsaved tells if the usage changed since the last write
+	unsaved bool
+}
+
+// data is the content of the storage file
+type data struct {
+	Users     map[int]*User      `json:"users"`
+	Jobs      map[int]*Job       `json:"jobs"`
+	NextJobID int                `json:"next_job_id"`
+	Invites   map[string]*Invite `json:"invites"`
+}
+
+// User holds what is known about a telegram user
+type User struct {
+	ID       int      `json:"id"`
+	Settings Settings `json:"settings"`
+	Access   Access   `json:"access"`
+	// Usage is kept when the user is forgotten, or forgetting would reset
+	// the limits
+	Usage quota.Usage `json:"usage"`
+	// History are the files delivered to the user, oldest first
+	History        []Delivery `json:"history,omitempty"`
+	NextDeliveryID int        `json:"next_delivery_id,omitempty"`
+	// Shelves are the books saved by the user
+	Shelves     []Shelf `json:"shelves,omitempty"`
+	NextShelfID int     `json:"next_shelf_id,omitempty"`
+	// Follows are the authors and series followed by the user
+	Follows      []Follow `json:"follows,omitempty"`
+	NextFollowID int      `json:"next_follow_id,omitempty"`
+	// Forgotten is set by ForgetUser until the user uses the bot again
+	Forgotten bool `json:"forgotten,omitempty"`
+}
+
+// Open loads the store from a file, the file is created on the first write
+// if it doesn't exist
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(content) > 0 {
+			if err := json.Unmarshal(content, &s.data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.init()
+	return s, nil
+}
+
+// init creates the missing collections
+func (s *Store) init() {
+	if s.data.Users == nil {
+		s.data.Users = map[int]*User{}
+	}
+	if s.data.Jobs == nil {
+		s.data.Jobs = map[int]*Job{}
+	}
+	if s.data.Invites == nil {
+		s.data.Invites = map[string]*Invite{}
+	}
+}
+
+// user returns a user, creating it if needed. The lock must be held
+func (s *Store) user(id int) *User {
+	u, ok := s.data.Users[id]
+	if !ok {
+		u = &User{ID: id}
+		s.data.Users[id] = u
+	}
+	return u
+}
+
+// activeUser returns a user using the bot, a forgotten user is remembered
+// again. The lock must be held
+func (s *Store) activeUser(id int) *User {
+	u := s.user(id)
+	u.Forgotten = false
+	return u
+}
+
+// UserCounts counts the known users
+type UserCounts struct {
+	Total int
+	// Active is the number of users who used the bot today
+	Active int
+	Banned int
+}
+
+// CountUsers counts the known users
+func (s *Store) CountUsers(now time.Time) UserCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := UserCounts{Total: len(s.data.Users)}
+	today := quota.Day(now)
+	for _, u := range s.data.Users {
+		if u.Usage.Day == today {
+			counts.Active++
+		}
+		if u.Access.Banned {
+			counts.Banned++
+		}
+	}
+	return counts
+}
+
+// Recipients returns the ids of the known users who aren't banned nor
+// forgotten
+func (s *Store) Recipients() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []int{}
+	for id, u := range s.data.Users {
+		if !u.Access.Banned && !u.Forgotten {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// ForgetUser deletes everything stored about a user: everything the user
+// record holds and the pending jobs of the user. Only the access the user
+// was granted and the usage of the limits are kept. The user is marked as
+// forgotten so broadcasts and the deliveries of the jobs still running skip
+// it
+func (s *Store) ForgetUser(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(id)
+	s.data.Users[id] = &User{ID: id, Access: u.Access, Usage: u.Usage, Forgotten: true}
+	for jobID, job := range s.data.Jobs {
+		if job.UserID == id {
+			delete(s.data.Jobs, jobID)
+		}
+	}
+	return s.save()
+}
+
+// save writes the data to disk. The lock must be held
+func (s *Store) save() error {
+	if s.path == "" {
+		s.unsaved = false
+		return nil
+	}
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// the rename is atomic so a crash never leaves a truncated file
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.unsaved = false
+	return nil
+}
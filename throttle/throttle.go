@@ -0,0 +1,231 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/quota"
+)
+
+var logger = logging.Package("throttle")
+
+// ErrOpen is returned instead of sending a request to a host whose circuit
+// breaker is open
+var ErrOpen = errors.New("source temporarily unavailable")
+
+// State is the state of the circuit breaker of a host
+type State int
+
+// States of a circuit breaker: closed lets the requests through, open
+// rejects them and half-open lets a single probe request through
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+var stateNames = [...]string{"closed", "open", "half-open"}
+
+func (s State) String() string {
+	if int(s) >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// Transport limits the rate of the requests sent to each host and stops
+// sending requests to the hosts failing repeatedly. It must not be copied
+type Transport struct {
+	Base http.RoundTripper
+	// Rate limits the requests per host, requests wait for their turn. A zero
+	// rate doesn't limit
+	Rate quota.Rate
+	// Failures is the number of consecutive failures opening the breaker of
+	// a host, 0 disables the breaker
+	Failures int
+	// Cooldown is how long a breaker stays open before a probe request
+	Cooldown time.Duration
+	// OnStateChange is called when the breaker of a host changes state, with
+	// the lock held: it must not use the transport
+	OnStateChange func(host string, state State)
+
+	mu    sync.Mutex
+	hosts map[string]*host
+
+	// now and sleep are replaced by a fake clock in the tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// clock returns the current time
+func (t *Transport) clock() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// pause waits for d unless ctx is done first
+func (t *Transport) pause(ctx context.Context, d time.Duration) error {
+	if t.sleep != nil {
+		return t.sleep(ctx, d)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// host is what is known about a host. The lock of the transport protects it
+type host struct {
+	bucket   quota.Bucket
+	state    State
+	failures int
+	opened   time.Time
+	// probing is set while the probe request of a half-open breaker runs
+	probing bool
+}
+
+// host returns the state of a host, creating it if needed. The lock must be
+// held
+func (t *Transport) host(name string) *host {
+	if t.hosts == nil {
+		t.hosts = map[string]*host{}
+	}
+	h, ok := t.hosts[name]
+	if !ok {
+		h = &host{}
+		t.hosts[name] = h
+	}
+	return h
+}
+
+// setState changes the state of the breaker of a host. The lock must be held
+func (t *Transport) setState(name string, h *host, state State) {
+	if h.state == state {
+		return
+	}
+	h.state = state
+	logger.Warn("Circuit breaker changed", "host", name, "state", state.String())
+	if t.OnStateChange != nil {
+		t.OnStateChange(name, state)
+	}
+}
+
+// State returns the state of the breaker of a host
+func (t *Transport) State(name string) State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.host(name).state
+}
+
+// acquire checks the breaker of a host, a request can be sent when it
+// returns nil
+func (t *Transport) acquire(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.host(name)
+	if h.state == Open && t.clock().Sub(h.opened) >= t.Cooldown {
+		t.setState(name, h, HalfOpen)
+	}
+	switch {
+	case h.state == Open, h.state == HalfOpen && h.probing:
+		return ErrOpen
+	case h.state == HalfOpen:
+		h.probing = true
+	}
+	return nil
+}
+
+// wait waits for the turn of a request to a host
+func (t *Transport) wait(ctx context.Context, name string) error {
+	if t.Rate.Burst <= 0 {
+		return nil
+	}
+	for {
+		t.mu.Lock()
+		h := t.host(name)
+		bucket, wait, ok := t.Rate.Take(h.bucket, t.clock())
+		h.bucket = bucket
+		t.mu.Unlock()
+		if ok {
+			return nil
+		}
+		if err := t.pause(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// outcome is what a request tells about a host
+type outcome int
+
+const (
+	succeeded outcome = iota
+	failed
+	// unknown is the outcome of a request cancelled by the caller
+	unknown
+)
+
+// record updates the breaker of a host with the outcome of a request
+func (t *Transport) record(name string, o outcome) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.host(name)
+	// when the probe didn't tell anything, the next request probes again
+	probe := h.probing
+	h.probing = false
+	switch o {
+	case succeeded:
+		h.failures = 0
+		t.setState(name, h, Closed)
+	case failed:
+		h.failures++
+		if probe || (t.Failures > 0 && h.failures >= t.Failures) {
+			h.opened = t.clock()
+			t.setState(name, h, Open)
+		}
+	}
+}
+
+// RoundTrip sends a request unless the breaker of the host is open, after
+// waiting for its turn. Network errors, 5xx and 429 responses are failures
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name := req.URL.Host
+	if t.Failures > 0 {
+		if err := t.acquire(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.wait(req.Context(), name); err != nil {
+		if t.Failures > 0 {
+			t.record(name, unknown)
+		}
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if t.Failures > 0 {
+		o := succeeded
+		switch {
+		case req.Context().Err() != nil:
+			o = unknown
+		case err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			o = failed
+		}
+		t.record(name, o)
+	}
+	return resp, err
+}
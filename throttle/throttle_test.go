@@ -0,0 +1,298 @@
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geobeau/Libbot/quota"
+)
+
+// fakeClock is a clock only moving when told to, or when the transport
+// sleeps
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// fakeRoundTripper answers the requests with a status, or fails them when
+// the status is 0
+type fakeRoundTripper struct {
+	mu       sync.Mutex
+	status   int
+	requests int
+}
+
+func (f *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: f.status, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+// newTransport returns a transport using a fake clock and round tripper,
+// the state changes are recorded
+func newTransport(failures int, cooldown time.Duration) (*Transport, *fakeClock, *fakeRoundTripper, *[]string) {
+	clock := newFakeClock()
+	base := &fakeRoundTripper{status: http.StatusOK}
+	changes := &[]string{}
+	t := &Transport{
+		Base:     base,
+		Failures: failures,
+		Cooldown: cooldown,
+		OnStateChange: func(host string, state State) {
+			*changes = append(*changes, host+" "+state.String())
+		},
+		now:   clock.Now,
+		sleep: clock.Sleep,
+	}
+	return t, clock, base, changes
+}
+
+func get(t *testing.T, transport *Transport, url string) error {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestBreaker(t *testing.T) {
+	transport, clock, base, changes := newTransport(2, time.Minute)
+	steps := []struct {
+		name    string
+		advance time.Duration
+		// status is the answer of the source, 0 for a network error
+		status int
+		err    error
+		sent   bool
+		state  State
+	}{
+		{"first failure", 0, http.StatusInternalServerError, nil, true, Closed},
+		{"success resets the failures", 0, http.StatusOK, nil, true, Closed},
+		{"failure", 0, http.StatusBadGateway, nil, true, Closed},
+		{"second consecutive failure opens", 0, 0, errors.New("connection refused"), true, Open},
+		{"rejected while open", 30 * time.Second, http.StatusOK, ErrOpen, false, Open},
+		{"failed probe opens again", 30 * time.Second, http.StatusTooManyRequests, nil, true, Open},
+		{"cooldown restarted", 59 * time.Second, http.StatusOK, ErrOpen, false, Open},
+		{"successful probe closes", time.Second, http.StatusOK, nil, true, Closed},
+		{"client errors aren't failures", 0, http.StatusNotFound, nil, true, Closed},
+		{"still closed", 0, http.StatusNotFound, nil, true, Closed},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		base.status = step.status
+		before := base.requests
+		err := get(t, transport, "https://source.example.com/book/1")
+		switch {
+		case step.err == nil && err != nil, step.err != nil && (err == nil || err.Error() != step.err.Error()):
+			t.Errorf("%s: error = %v, want %v", step.name, err, step.err)
+		}
+		if sent := base.requests > before; sent != step.sent {
+			t.Errorf("%s: sent = %v, want %v", step.name, sent, step.sent)
+		}
+		if state := transport.State("source.example.com"); state != step.state {
+			t.Errorf("%s: state = %v, want %v", step.name, state, step.state)
+		}
+	}
+	want := []string{
+		"source.example.com open",
+		"source.example.com half-open",
+		"source.example.com open",
+		"source.example.com half-open",
+		"source.example.com closed",
+	}
+	if !reflect.DeepEqual(*changes, want) {
+		t.Errorf("state changes = %q, want %q", *changes, want)
+	}
+}
+
+func TestBreakerHosts(t *testing.T) {
+	transport, _, base, _ := newTransport(1, time.Minute)
+	base.status = http.StatusServiceUnavailable
+	get(t, transport, "https://down.example.com/")
+	base.status = http.StatusOK
+	if err := get(t, transport, "https://down.example.com/"); err != ErrOpen {
+		t.Errorf("error = %v, want %v", err, ErrOpen)
+	}
+	if err := get(t, transport, "https://up.example.com/"); err != nil {
+		t.Errorf("another host: %v", err)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	transport, _, base, changes := newTransport(0, time.Minute)
+	base.status = http.StatusInternalServerError
+	for i := 0; i < 10; i++ {
+		get(t, transport, "https://source.example.com/")
+	}
+	if base.requests != 10 || len(*changes) != 0 {
+		t.Errorf("%d requests sent and state changes %q, want 10 and none", base.requests, *changes)
+	}
+}
+
+// blockingRoundTripper answers once release is closed
+type blockingRoundTripper struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	close(b.started)
+	select {
+	case <-b.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	transport, clock, base, _ := newTransport(1, time.Minute)
+	base.status = 0
+	get(t, transport, "https://source.example.com/")
+	clock.Advance(time.Minute)
+
+	probe := &blockingRoundTripper{started: make(chan struct{}), release: make(chan struct{})}
+	transport.Base = probe
+	done := make(chan error)
+	go func() {
+		done <- get(t, transport, "https://source.example.com/probe")
+	}()
+	<-probe.started
+	if state := transport.State("source.example.com"); state != HalfOpen {
+		t.Errorf("state during the probe = %v, want %v", state, HalfOpen)
+	}
+	if err := get(t, transport, "https://source.example.com/other"); err != ErrOpen {
+		t.Errorf("request during the probe: error = %v, want %v", err, ErrOpen)
+	}
+	close(probe.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if state := transport.State("source.example.com"); state != Closed {
+		t.Errorf("state after the probe = %v, want %v", state, Closed)
+	}
+}
+
+func TestBreakerCancelledProbe(t *testing.T) {
+	transport, clock, base, _ := newTransport(1, time.Minute)
+	base.status = 0
+	get(t, transport, "https://source.example.com/")
+	clock.Advance(time.Minute)
+
+	probe := &blockingRoundTripper{started: make(chan struct{}), release: make(chan struct{})}
+	transport.Base = probe
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest(http.MethodGet, "https://source.example.com/probe", nil)
+	done := make(chan error)
+	go func() {
+		_, err := transport.RoundTrip(req.WithContext(ctx))
+		done <- err
+	}()
+	<-probe.started
+	cancel()
+	<-done
+
+	// the cancelled probe told nothing, the next request probes again
+	if state := transport.State("source.example.com"); state != HalfOpen {
+		t.Errorf("state = %v, want %v", state, HalfOpen)
+	}
+	transport.Base = base
+	base.status = http.StatusOK
+	if err := get(t, transport, "https://source.example.com/"); err != nil {
+		t.Errorf("second probe: %v", err)
+	}
+	if state := transport.State("source.example.com"); state != Closed {
+		t.Errorf("state = %v, want %v", state, Closed)
+	}
+}
+
+func TestRate(t *testing.T) {
+	transport, clock, base, _ := newTransport(0, time.Minute)
+	transport.Rate = quota.Rate{Burst: 2, Interval: time.Second}
+	for i := 0; i < 4; i++ {
+		if err := get(t, transport, "https://source.example.com/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// another host has its own rate
+	if err := get(t, transport, "https://other.example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Duration{time.Second, time.Second}; !reflect.DeepEqual(clock.slept, want) {
+		t.Errorf("waits = %v, want %v", clock.slept, want)
+	}
+	if base.requests != 5 {
+		t.Errorf("%d requests sent, want 5", base.requests)
+	}
+}
+
+func TestRateCancelled(t *testing.T) {
+	transport, clock, base, _ := newTransport(1, time.Minute)
+	transport.Rate = quota.Rate{Burst: 1, Interval: time.Minute}
+	get(t, transport, "https://source.example.com/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequest(http.MethodGet, "https://source.example.com/", nil)
+	if _, err := transport.RoundTrip(req.WithContext(ctx)); err != context.Canceled {
+		t.Errorf("error = %v, want %v", err, context.Canceled)
+	}
+	if base.requests != 1 || len(clock.slept) != 0 {
+		t.Errorf("%d requests sent and waits %v, want 1 and none", base.requests, clock.slept)
+	}
+	if state := transport.State("source.example.com"); state != Closed {
+		t.Errorf("a cancelled request changed the state to %v", state)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	for state, want := range map[State]string{Closed: "closed", Open: "open", HalfOpen: "half-open", State(7): "state(7)"} {
+		if got := state.String(); got != want {
+			t.Errorf("State(%d).String() = %q, want %q", int(state), got, want)
+		}
+	}
+}
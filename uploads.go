@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/geobeau/Libbot/book"
+	"github.com/geobeau/Libbot/epub"
+	"github.com/geobeau/Libbot/language"
+	"github.com/geobeau/Libbot/logging"
+	"github.com/geobeau/Libbot/pipeline"
+	"github.com/geobeau/Libbot/quota"
+	"github.com/geobeau/Libbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// maxUploadSize is the size limit of the files bots can download from telegram
+const maxUploadSize = 20 << 20
+
+// maxUploads is the number of uploaded files remembered for conversion
+const maxUploads = 1000
+
+// convertFormats are the formats offered for uploaded files
+var convertFormats = []string{"epub", "mobi", "azw3", "pdf"}
+
+var convertButton = tb.InlineButton{
+	Unique: "convert_button",
+}
+
+// upload is a file sent by a user
+type upload struct {
+	userID int
+	file   tb.File
+	name   string
+	book   book.Book
+}
+
+// uploadRegistry remembers the files sent by users so they can be converted
+// later, callback data is too short to hold telegram file ids
+type uploadRegistry struct {
+	mu    sync.Mutex
+	files map[string]upload
+	order []string
+}
+
+func newUploadRegistry() *uploadRegistry {
+	return &uploadRegistry{files: map[string]upload{}}
+}
+
+func (r *uploadRegistry) add(key string, u upload) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.files[key]; !ok {
+		r.order = append(r.order, key)
+	}
+	r.files[key] = u
+	for len(r.order) > maxUploads {
+		delete(r.files, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// forget removes the files sent by a user
+func (r *uploadRegistry) forget(userID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	order := r.order[:0]
+	for _, key := range r.order {
+		if r.files[key].userID == userID {
+			delete(r.files, key)
+			continue
+		}
+		order = append(order, key)
+	}
+	r.order = order
+}
+
+func (r *uploadRegistry) get(key string) (upload, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.files[key]
+	return u, ok
+}
+
+// telegramFetcher fetches a file sent by a user
+type telegramFetcher struct {
+	bot    *tb.Bot
+	upload upload
+}
+
+func (f telegramFetcher) Fetch(ctx context.Context, id string) (book.Book, pipeline.Download, error) {
+	body, err := f.bot.GetFile(&f.upload.file)
+	if err != nil {
+		return f.upload.book, pipeline.Download{}, err
+	}
+	return f.upload.book, pipeline.Download{Filename: f.upload.name, Body: body}, nil
+}
+
+func formatUploadMessage(u upload, locale string) string {
+	template :=
+		"Title: %s\n" +
+			"Author: %s\n" +
+			"Language: %s\n" +
+			"Format: %s | %d KB\n\n" +
+			"Convert to:"
+	author := u.book.Author()
+	if author == "" {
+		author = "unknown"
+	}
+	name := "unknown"
+	if u.book.Language != "" {
+		name = language.Display(u.book.Language, locale)
+	}
+	extension := strings.TrimPrefix(strings.ToLower(filepath.Ext(u.name)), ".")
+	return fmt.Sprintf(template, u.book.Title, author, name, extension, u.file.FileSize>>10)
+}
+
+// fileBook describes an uploaded file from its name and size
+func fileBook(u upload) book.Book {
+	title := strings.TrimSuffix(u.name, filepath.Ext(u.name))
+	format := book.Format{Extension: strings.ToLower(strings.TrimPrefix(filepath.Ext(u.name), ".")), Size: int64(u.file.FileSize)}
+	return book.Book{ID: u.file.FileID, Title: title, Formats: []book.Format{format}}
+}
+
+// epubBook completes the description of an uploaded EPUB with its package
+// document, the file is downloaded to read it
+func (a *app) epubBook(ctx context.Context, u upload) (book.Book, error) {
+	uploaded := u.book
+	body, err := a.bot.GetFile(&u.file)
+	if err != nil {
+		return uploaded, err
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(body, maxUploadSize))
+	if err != nil {
+		return uploaded, err
+	}
+	metadata, err := epub.ReadMetadata(content)
+	if err != nil {
+		return uploaded, err
+	}
+	if metadata.Title != "" {
+		uploaded.Title = metadata.Title
+	}
+	for _, creator := range metadata.Creators {
+		uploaded.Authors = append(uploaded.Authors, book.Author{Name: creator.Name})
+	}
+	uploaded.Language = language.Normalize(metadata.Language)
+	if uploaded.Language == "" {
+		uploaded.Language = detectLanguage(ctx, content)
+	}
+	isbns := []string{}
+	for _, identifier := range metadata.Identifiers {
+		if strings.EqualFold(identifier.Scheme, book.ISBN) {
+			isbns = append(isbns, identifier.Value)
+		}
+	}
+	uploaded.Identifiers = book.ISBNIdentifiers(strings.Join(isbns, ","))
+	uploaded.Series.Name = metadata.Series
+	uploaded.Series.Index, _ = strconv.ParseFloat(metadata.SeriesIndex, 64)
+	return uploaded, nil
+}
+
+// handleDocument shows the name and size of an ebook sent by a user and
+// offers to convert it. The metadata of EPUB files is read afterwards in
+// the job queue, like the other downloads, and the message is updated
+func (a *app) handleDocument(ctx context.Context, m *tb.Message) {
+	doc := m.Document
+	extension := strings.ToLower(filepath.Ext(doc.FileName))
+	if !contains(ebookExtensions, extension) {
+		a.bot.Send(m.Sender, "Send me an ebook ("+strings.Join(ebookExtensions, ", ")+") to convert it")
+		return
+	}
+	if doc.FileSize > maxUploadSize {
+		a.bot.Send(m.Sender, fmt.Sprintf("This file is too large (limit is %d MB)", maxUploadSize>>20))
+		return
+	}
+	u := upload{userID: m.Sender.ID, file: doc.File, name: doc.FileName}
+	u.book = fileBook(u)
+	key := fmt.Sprintf("%d-%d", m.Sender.ID, m.ID)
+	a.uploads.add(key, u)
+	markup := &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{convertButtons(key, extension)}}
+	card, err := a.bot.Reply(m, formatUploadMessage(u, m.Sender.LanguageCode), markup)
+	if err != nil || extension != ".epub" {
+		return
+	}
+	var readErr error
+	if err := a.queue.Run(nil, func() { u.book, readErr = a.epubBook(ctx, u) }); err != nil {
+		// the bot is shutting down, the file name is enough to convert it
+		return
+	}
+	if readErr != nil {
+		logger.WarnContext(ctx, "Failed to read upload metadata", logging.Err(readErr))
+		return
+	}
+	a.uploads.add(key, u)
+	a.bot.Edit(card, formatUploadMessage(u, m.Sender.LanguageCode), markup)
+}
+
+// convertButtons offers to convert a registered upload to the formats other
+// than its own
+func convertButtons(key string, extension string) []tb.InlineButton {
+	row := []tb.InlineButton{}
+	for _, format := range convertFormats {
+		if "."+format == extension {
+			continue
+		}
+		button := convertButton
+		button.Text = strings.ToUpper(format)
+		button.Data = key + "|" + format
+		row = append(row, button)
+	}
+	return row
+}
+
+// convertUpload converts a file sent by a user to the chosen format
+func (a *app) convertUpload(ctx context.Context, c *tb.Callback) {
+	parts := strings.SplitN(c.Data, "|", 2)
+	u, ok := a.uploads.get(parts[0])
+	if len(parts) != 2 || !contains(convertFormats, parts[1]) || !ok || u.userID != c.Sender.ID {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "File expired"})
+		a.bot.Send(c.Sender, "This file has expired, please send it again")
+		return
+	}
+	format := parts[1]
+	if !a.access.canConvert(roleOf(ctx)) {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Not allowed"})
+		a.bot.Send(c.Sender, "Conversions are reserved to "+a.cfg.Access.ConvertRole+" users")
+		return
+	}
+	if !a.allow(ctx, c.Sender, quota.Convert) {
+		a.bot.Respond(c, &tb.CallbackResponse{Text: "Try again later"})
+		return
+	}
+	a.bot.Respond(c, &tb.CallbackResponse{Text: "Converting to " + format})
+	job := storage.Job{
+		UserID:   c.Sender.ID,
+		Kind:     jobConvert,
+		BookID:   u.file.FileID,
+		Formats:  []string{format},
+		Filename: u.name,
+		Book:     &u.book,
+	}
+	if err := a.submit(ctx, job).Err(); err != nil {
+		logger.ErrorContext(ctx, "Conversion of upload failed", logging.Err(err))
+	}
+}